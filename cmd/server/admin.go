@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+
+	"github.com/YusukeKishino/rtc/sfu"
+)
+
+// PlainRTPTrack declares a track of a plain rtp ingest
+type PlainRTPTrack struct {
+	ID          string `json:"id"`
+	Label       string `json:"label"`
+	Codec       string `json:"codec"`
+	PayloadType uint8  `json:"payloadType"`
+	ClockRate   uint32 `json:"clockRate"`
+	Fmtp        string `json:"fmtp"`
+	SSRC        uint32 `json:"ssrc"`
+}
+
+// PlainRTPIngest message sent when creating a plain rtp ingest
+type PlainRTPIngest struct {
+	IP      string          `json:"ip"`
+	Port    int             `json:"port"`
+	RTCPMux bool            `json:"rtcpMux"`
+	Tracks  []PlainRTPTrack `json:"tracks"`
+}
+
+// RTSPIngest message sent when pulling an rtsp camera into a session
+type RTSPIngest struct {
+	URL string `json:"url" binding:"required"`
+}
+
+// Relay message sent when linking a session with another sfu instance
+type Relay struct {
+	IP     string   `json:"ip"`
+	Port   int      `json:"port"`
+	Remote string   `json:"remote"`
+	Secret string   `json:"secret"`
+	Tracks []string `json:"tracks"`
+}
+
+// PlainRTPEgress message sent when forwarding a track as plain rtp
+type PlainRTPEgress struct {
+	TrackID  string `json:"trackId" binding:"required"`
+	Host     string `json:"host" binding:"required"`
+	Port     int    `json:"port" binding:"required"`
+	RTCPPort int    `json:"rtcpPort"`
+}
+
+// HLS message sent when starting hls, durations in milliseconds
+type HLS struct {
+	SegmentDuration int `json:"segmentDuration"`
+	PartDuration    int `json:"partDuration"`
+	Segments        int `json:"segments"`
+}
+
+// bearerAuth rejects requests without the given bearer token
+func bearerAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := c.GetHeader("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+func registerAdminRoutes(g *gin.RouterGroup, s *sfu.SFU) {
+	g.GET("/sessions", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.Snapshot())
+	})
+
+	g.GET("/sessions/:sid", func(c *gin.Context) {
+		session := s.GetSession(c.Param("sid"))
+		if session == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, session.Snapshot())
+	})
+
+	g.GET("/stats", func(c *gin.Context) {
+		c.JSON(http.StatusOK, s.Stats())
+	})
+
+	g.GET("/sessions/:sid/stats", func(c *gin.Context) {
+		session := s.GetSession(c.Param("sid"))
+		if session == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.JSON(http.StatusOK, session.Stats())
+	})
+
+	g.GET("/sessions/:sid/timeline", func(c *gin.Context) {
+		entries, err := s.Timeline(c.Param("sid"), c.Query("participant"))
+		if err == sfu.ErrTimelineNotFound {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, entries)
+	})
+
+	g.GET("/sessions/:sid/timeline/export", func(c *gin.Context) {
+		entries, err := s.Timeline(c.Param("sid"), c.Query("participant"))
+		if err == sfu.ErrTimelineNotFound {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "timeline-"+c.Param("sid")+".jsonl"))
+		c.Header("Content-Type", "application/x-ndjson")
+		c.Status(http.StatusOK)
+		enc := json.NewEncoder(c.Writer)
+		for _, e := range entries {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+	})
+
+	g.GET("/sessions/:sid/transports/:tid", func(c *gin.Context) {
+		session := s.GetSession(c.Param("sid"))
+		if session == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		for _, t := range session.Snapshot().Transports {
+			if t.ID == c.Param("tid") {
+				c.JSON(http.StatusOK, t)
+				return
+			}
+		}
+		c.Status(http.StatusNotFound)
+	})
+
+	g.POST("/sessions/:sid/plainrtp", func(c *gin.Context) {
+		var ingest PlainRTPIngest
+		if err := c.ShouldBindJSON(&ingest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		cfg := sfu.PlainRTPTransportConfig{
+			IP:      ingest.IP,
+			Port:    ingest.Port,
+			RTCPMux: ingest.RTCPMux,
+		}
+		for _, t := range ingest.Tracks {
+			cfg.Tracks = append(cfg.Tracks, sfu.PlainRTPTrack(t))
+		}
+
+		t, err := s.NewPlainRTPTransport(c.Param("sid"), cfg)
+		if err != nil {
+			logrus.Errorf("admin: error creating plain rtp transport: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logrus.Infof("plain rtp transport %s join session %s", t.ID(), c.Param("sid"))
+
+		c.JSON(http.StatusCreated, gin.H{
+			"id":       t.ID(),
+			"port":     t.Port(),
+			"rtcpPort": t.RTCPPort(),
+		})
+	})
+
+	g.POST("/sessions/:sid/rtsp", func(c *gin.Context) {
+		var ingest RTSPIngest
+		if err := c.ShouldBindJSON(&ingest); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		t, err := s.NewRTSPTransport(c.Param("sid"), sfu.RTSPTransportConfig{URL: ingest.URL})
+		if err != nil {
+			logrus.Errorf("admin: error creating rtsp transport: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logrus.Infof("rtsp transport %s join session %s", t.ID(), c.Param("sid"))
+
+		c.JSON(http.StatusCreated, gin.H{"id": t.ID()})
+	})
+
+	g.POST("/sessions/:sid/relay", func(c *gin.Context) {
+		var relay Relay
+		if err := c.ShouldBindJSON(&relay); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		t, err := s.NewRelayTransport(c.Param("sid"), sfu.RelayTransportConfig(relay))
+		if err != nil {
+			logrus.Errorf("admin: error creating relay transport: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logrus.Infof("relay transport %s join session %s", t.ID(), c.Param("sid"))
+
+		c.JSON(http.StatusCreated, gin.H{
+			"id":   t.ID(),
+			"port": t.Port(),
+		})
+	})
+
+	g.POST("/sessions/:sid/plainrtp/egress", func(c *gin.Context) {
+		var egress PlainRTPEgress
+		if err := c.ShouldBindJSON(&egress); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		sender, err := s.NewPlainRTPEgress(c.Param("sid"), egress.TrackID, sfu.PlainRTPSenderConfig{
+			Host:     egress.Host,
+			Port:     egress.Port,
+			RTCPPort: egress.RTCPPort,
+		})
+		switch err {
+		case nil:
+		case sfu.ErrSessionNotFound, sfu.ErrRouterNotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		default:
+			logrus.Errorf("admin: error creating plain rtp egress: %v", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		logrus.Infof("plain rtp egress %s of track %s to %s:%d", sender.ID(), egress.TrackID, egress.Host, egress.Port)
+
+		c.JSON(http.StatusCreated, gin.H{
+			"id":  sender.ID(),
+			"sdp": sender.SDP(),
+		})
+	})
+
+	g.GET("/plainrtp/egress/:id/sdp", func(c *gin.Context) {
+		sender := s.GetPlainRTPEgress(c.Param("id"))
+		if sender == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename=stream.sdp")
+		c.Data(http.StatusOK, "application/sdp", []byte(sender.SDP()))
+	})
+
+	g.DELETE("/plainrtp/egress/:id", func(c *gin.Context) {
+		if !s.ClosePlainRTPEgress(c.Param("id")) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	g.POST("/sessions/:sid/hls", func(c *gin.Context) {
+		var hls HLS
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&hls); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		_, err := s.StartHLS(c.Param("sid"), sfu.HLSConfig{
+			SegmentDuration: time.Duration(hls.SegmentDuration) * time.Millisecond,
+			PartDuration:    time.Duration(hls.PartDuration) * time.Millisecond,
+			Segments:        hls.Segments,
+		})
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusCreated, gin.H{
+			"playlist": "/hls/" + url.PathEscape(c.Param("sid")) + "/index.m3u8",
+		})
+	})
+
+	g.DELETE("/sessions/:sid/hls", func(c *gin.Context) {
+		if err := s.StopHLS(c.Param("sid")); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	g.POST("/sessions/:sid/transports/:tid/kick", func(c *gin.Context) {
+		session := s.GetSession(c.Param("sid"))
+		if session == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		var kick Kick
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&kick); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		if err := session.Kick(c.Param("tid"), kick.Reason); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	g.POST("/sessions/:sid/bans", func(c *gin.Context) {
+		var ban Ban
+		if err := c.ShouldBindJSON(&ban); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		s.Ban(c.Param("sid"), ban.Identity, time.Duration(ban.Duration)*time.Second, ban.Reason)
+		c.JSON(http.StatusCreated, ban)
+	})
+
+	g.DELETE("/sessions/:sid", func(c *gin.Context) {
+		session := s.GetSession(c.Param("sid"))
+		if session == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		session.End(c.Query("reason"))
+		c.Status(http.StatusNoContent)
+	})
+
+	g.DELETE("/sessions/:sid/transports/:tid", func(c *gin.Context) {
+		session := s.GetSession(c.Param("sid"))
+		if session == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		t := session.GetTransport(c.Param("tid"))
+		if t == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		if err := t.Close(); err != nil {
+			logrus.Errorf("admin: error closing transport: %v", err)
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
@@ -16,10 +16,17 @@ import (
 
 type Handler struct {
 	sfu *sfu.SFU
+	// keys access tokens are checked with, connections are not authenticated when nil
+	keys      tokenKeys
+	signaling *signalingMetrics
+	// resume keeps peers of dropped connections alive, they are closed at once when nil
+	resume *resumeStore
 }
 
-func NewHandler() *Handler {
+func NewHandler(rtmp sfu.RTMPConfig, timeline sfu.TimelineConfig, quality sfu.QualityConfig, keys tokenKeys) *Handler {
 	return &Handler{
+		keys:      keys,
+		signaling: newSignalingMetrics(),
 		sfu: sfu.NewSFU(sfu.Config{
 			WebRTC: sfu.WebRTCConfig{
 				ICEPortRange: []uint16{50000, 60000},
@@ -33,12 +40,33 @@ func NewHandler() *Handler {
 					MaxBufferTime: 1000,
 				},
 			},
+			RTMP:     rtmp,
+			Timeline: timeline,
+			Quality:  quality,
 		}),
 	}
 }
 
 type peerContext struct {
-	peer *sfu.WebRTCTransport
+	peer   *sfu.WebRTCTransport
+	claims *Claims
+}
+
+// grants checks the access token of the connection grants a right, every
+// right is granted when connections are not authenticated
+func (p *peerContext) grants(right func(*Claims) bool) error {
+	if p.claims == nil || right(p.claims) {
+		return nil
+	}
+	return errRightNotGranted
+}
+
+// moderates checks the role of the peer allows acting on other participants
+func (p *peerContext) moderates() error {
+	if p.peer.Role().CanModerate() {
+		return nil
+	}
+	return errRightNotGranted
 }
 
 type contextKey struct {
@@ -56,6 +84,48 @@ func forContext(ctx context.Context) *peerContext {
 type Join struct {
 	Sid   string                    `json:"sid"`
 	Offer webrtc.SessionDescription `json:"offer"`
+	// AutoSubscribe subscribes the peer to every track of the session, defaults to true
+	AutoSubscribe *bool `json:"autoSubscribe,omitempty"`
+	// Identity and Metadata describe the participant to the others in the session
+	Identity string          `json:"identity,omitempty"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	// Role in the session, presenter by default. Given by the access token when
+	// connections are authenticated, moderator may only be given that way.
+	Role sfu.Role `json:"role,omitempty"`
+}
+
+// JoinAnswer is the answer to a join, with the token to resume the peer with
+// when the connection drops
+type JoinAnswer struct {
+	webrtc.SessionDescription
+	ResumeToken string `json:"resumeToken,omitempty"`
+}
+
+// Resume message sent to reattach a new connection to a peer
+type Resume struct {
+	Token string `json:"token"`
+}
+
+// Resumed message sent once a peer is reattached, with the token to resume it next
+type Resumed struct {
+	ResumeToken string `json:"resumeToken"`
+	Participant string `json:"participant"`
+}
+
+// RoleChange message sent when a moderator changes the role of a participant
+type RoleChange struct {
+	Participant string   `json:"participant"`
+	Role        sfu.Role `json:"role"`
+}
+
+// Metadata message sent when updating the metadata of the participant
+type Metadata struct {
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// Subscription message sent when subscribing to or unsubscribing from tracks
+type Subscription struct {
+	Tracks []string `json:"tracks"`
 }
 
 // Negotiation message sent when renegotiating
@@ -63,6 +133,52 @@ type Negotiation struct {
 	Desc webrtc.SessionDescription `json:"desc"`
 }
 
+// TrackMute message sent when muting a published track
+type TrackMute struct {
+	Track string `json:"track"`
+	Muted bool   `json:"muted"`
+}
+
+// ParticipantMute message sent when muting all tracks of a participant
+type ParticipantMute struct {
+	Participant string `json:"participant"`
+	Muted       bool   `json:"muted"`
+}
+
+// TrackPause message sent when pausing a subscribed track
+type TrackPause struct {
+	Track  string `json:"track"`
+	Paused bool   `json:"paused"`
+}
+
+// Kick message sent when removing a participant from the session
+type Kick struct {
+	Participant string `json:"participant"`
+	Reason      string `json:"reason"`
+}
+
+// Ban message sent when banning an identity from the session, duration in seconds
+type Ban struct {
+	Identity string `json:"identity" binding:"required"`
+	Duration int    `json:"duration" binding:"required"`
+	Reason   string `json:"reason"`
+}
+
+// EndSession message sent when closing the session for everyone
+type EndSession struct {
+	Reason string `json:"reason"`
+}
+
+// Kicked message sent to a participant before it is removed
+type Kicked struct {
+	Reason string `json:"reason"`
+}
+
+// TrackRemoved message sent when a subscribed track is stopped by its publisher
+type TrackRemoved struct {
+	Track string `json:"track"`
+}
+
 // Trickle message sent when renegotiating
 type Trickle struct {
 	Candidate webrtc.ICECandidateInit `json:"candidate"`
@@ -70,6 +186,7 @@ type Trickle struct {
 
 func (h *Handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
 	p := forContext(ctx)
+	defer h.signaling.observe(req.Method, time.Now())
 
 	switch req.Method {
 	case "join":
@@ -92,7 +209,30 @@ func (h *Handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 			})
 			break
 		}
-		peer, err := h.sfu.NewWebRTCTransport(join.Sid, join.Offer)
+		if p.claims != nil {
+			if err := p.claims.join(join.Sid); err != nil {
+				logrus.Errorf("connect: join %s denied: %v", join.Sid, err)
+				replyAuthError(ctx, conn, req.ID, err)
+				break
+			}
+			join.Identity = p.claims.Identity
+			join.Role = p.claims.role()
+		} else if join.Role.CanModerate() {
+			// moderators are only granted by verified access tokens
+			logrus.Errorf("connect: join %s as %s denied without access token", join.Sid, join.Role)
+			replyAuthError(ctx, conn, req.ID, errRightNotGranted)
+			break
+		}
+
+		opts := sfu.WebRTCTransportOptions{
+			Identity: join.Identity,
+			Metadata: join.Metadata,
+			Role:     join.Role,
+		}
+		if join.AutoSubscribe != nil && !*join.AutoSubscribe || p.grants(canSubscribe) != nil {
+			opts.Subscribe = subscribeNone
+		}
+		peer, err := h.sfu.NewWebRTCTransportWithOptions(join.Sid, join.Offer, opts)
 
 		if err != nil {
 			logrus.Errorf("connect: error creating peer: %v", err)
@@ -134,41 +274,19 @@ func (h *Handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 			break
 		}
 
-		// Notify user of trickle candidates
-		peer.OnICECandidate(func(c *webrtc.ICECandidate) {
-			logrus.Debugf("Sending ICE candidate")
-			if c == nil {
-				// Gathering done
-				return
-			}
+		bind(ctx, conn, peer)
 
-			if err := conn.Notify(ctx, "trickle", c.ToJSON()); err != nil {
-				logrus.Errorf("error sending trickle %s", err)
-			}
-		})
-
-		peer.OnNegotiationNeeded(func() {
-			logrus.Debugf("on negotiation needed called")
-			offer, err := p.peer.CreateOffer()
-			if err != nil {
-				logrus.Errorf("CreateOffer error: %v", err)
-				return
-			}
+		p.peer = peer
 
-			err = p.peer.SetLocalDescription(offer)
+		reply := JoinAnswer{SessionDescription: answer}
+		if h.resume != nil {
+			reply.ResumeToken, err = h.resume.add(p, conn, join.Sid, join.Identity)
 			if err != nil {
-				logrus.Errorf("SetLocalDescription error: %v", err)
-				return
+				logrus.Errorf("resume token error: %v", err)
 			}
+		}
 
-			if err := conn.Notify(ctx, "offer", offer); err != nil {
-				logrus.Errorf("error sending offer %s", err)
-			}
-		})
-
-		p.peer = peer
-
-		_ = conn.Reply(ctx, req.ID, answer)
+		_ = conn.Reply(ctx, req.ID, reply)
 
 		// Hack until renegotation is supported in pion. Force renegotation incase there are unmatched
 		// receviers (i.e. sfu has more than one sender). We just naively create server offer. It is
@@ -177,22 +295,53 @@ func (h *Handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 		time.Sleep(1000 * time.Millisecond)
 
 		logrus.Debugf("on negotiation needed called")
-		offer, err := p.peer.CreateOffer()
-		if err != nil {
-			logrus.Errorf("CreateOffer error: %v", err)
-			return
+		sendOffer(ctx, conn, p.peer)
+
+	case "resume":
+		if p.peer != nil {
+			logrus.Errorf("connect: peer already exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("peer already exists")),
+			})
+			break
+		}
+		if h.resume == nil {
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errResumeTokenInvalid),
+			})
+			break
 		}
 
-		err = p.peer.SetLocalDescription(offer)
+		var resume Resume
+		err := json.Unmarshal(*req.Params, &resume)
 		if err != nil {
-			logrus.Errorf("SetLocalDescription error: %v", err)
-			return
+			logrus.Errorf("connect: error parsing resume: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
 		}
 
-		if err := conn.Notify(ctx, "offer", offer); err != nil {
-			logrus.Errorf("error sending offer %s", err)
+		peer, token, err := h.resume.resume(p, conn, resume.Token)
+		if err != nil {
+			logrus.Infof("resume rejected: %v", err)
+			replyAuthError(ctx, conn, req.ID, err)
+			break
 		}
 
+		logrus.Infof("peer %s resumed", peer.ID())
+		bind(ctx, conn, peer)
+		p.peer = peer
+
+		_ = conn.Reply(ctx, req.ID, Resumed{ResumeToken: token, Participant: peer.ID()})
+
+		// notifications may have been missed while detached, renegotiate in
+		// case tracks were published or removed meanwhile
+		sendOffer(ctx, conn, peer)
+
 	case "offer":
 		if p.peer == nil {
 			logrus.Errorf("connect: no peer exists for connection")
@@ -277,6 +426,381 @@ func (h *Handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 			logrus.Errorf("error setting remote description %s", err)
 		}
 
+	case "subscribe", "unsubscribe":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		logrus.Infof("peer %s %s", p.peer.ID(), req.Method)
+
+		if req.Method == "subscribe" {
+			if err := p.grants(canSubscribe); err != nil {
+				logrus.Errorf("peer %s subscribe denied: %v", p.peer.ID(), err)
+				replyAuthError(ctx, conn, req.ID, err)
+				break
+			}
+		}
+
+		var subscription Subscription
+		err := json.Unmarshal(*req.Params, &subscription)
+		if err != nil {
+			logrus.Errorf("connect: error parsing subscription: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		if req.Method == "subscribe" {
+			err = p.peer.Subscribe(subscription.Tracks)
+		} else {
+			err = p.peer.Unsubscribe(subscription.Tracks)
+		}
+		if err != nil {
+			logrus.Errorf("%s error: %v", req.Method, err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, subscription)
+
+	case "getRoster":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, p.peer.Session().Roster())
+
+	case "updateMetadata":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		var metadata Metadata
+		err := json.Unmarshal(*req.Params, &metadata)
+		if err != nil {
+			logrus.Errorf("connect: error parsing metadata: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		err = p.peer.Session().UpdateMetadata(p.peer.ID(), metadata.Metadata)
+		if err != nil {
+			logrus.Errorf("updateMetadata error: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, metadata)
+
+	case "setTrackMuted":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		var mute TrackMute
+		err := json.Unmarshal(*req.Params, &mute)
+		if err != nil {
+			logrus.Errorf("connect: error parsing setTrackMuted: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		err = p.peer.SetTrackMuted(mute.Track, mute.Muted)
+		if err != nil {
+			logrus.Errorf("setTrackMuted error: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, mute)
+
+	case "muteParticipant":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		if err := p.moderates(); err != nil {
+			logrus.Errorf("peer %s muteParticipant denied: %v", p.peer.ID(), err)
+			replyAuthError(ctx, conn, req.ID, err)
+			break
+		}
+
+		var mute ParticipantMute
+		err := json.Unmarshal(*req.Params, &mute)
+		if err != nil {
+			logrus.Errorf("connect: error parsing muteParticipant: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		err = p.peer.Session().MuteParticipant(mute.Participant, mute.Muted)
+		if err != nil {
+			logrus.Errorf("muteParticipant error: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, mute)
+
+	case "setRole":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		if err := p.moderates(); err != nil {
+			logrus.Errorf("peer %s setRole denied: %v", p.peer.ID(), err)
+			replyAuthError(ctx, conn, req.ID, err)
+			break
+		}
+
+		var change RoleChange
+		err := json.Unmarshal(*req.Params, &change)
+		if err != nil {
+			logrus.Errorf("connect: error parsing setRole: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		err = p.peer.Session().SetRole(change.Participant, change.Role)
+		if err != nil {
+			logrus.Errorf("setRole error: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, change)
+
+	case "kick":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		if err := p.moderates(); err != nil {
+			logrus.Errorf("peer %s kick denied: %v", p.peer.ID(), err)
+			replyAuthError(ctx, conn, req.ID, err)
+			break
+		}
+
+		var kick Kick
+		err := json.Unmarshal(*req.Params, &kick)
+		if err != nil {
+			logrus.Errorf("connect: error parsing kick: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		err = p.peer.Session().Kick(kick.Participant, kick.Reason)
+		if err != nil {
+			logrus.Errorf("kick error: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, kick)
+
+	case "ban":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		if err := p.moderates(); err != nil {
+			logrus.Errorf("peer %s ban denied: %v", p.peer.ID(), err)
+			replyAuthError(ctx, conn, req.ID, err)
+			break
+		}
+
+		var ban Ban
+		err := json.Unmarshal(*req.Params, &ban)
+		if err == nil && (ban.Identity == "" || ban.Duration <= 0) {
+			err = errors.New("identity and duration required")
+		}
+		if err != nil {
+			logrus.Errorf("connect: error parsing ban: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		h.sfu.Ban(p.peer.Session().ID(), ban.Identity, time.Duration(ban.Duration)*time.Second, ban.Reason)
+
+		_ = conn.Reply(ctx, req.ID, ban)
+
+	case "endSession":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		if err := p.moderates(); err != nil {
+			logrus.Errorf("peer %s endSession denied: %v", p.peer.ID(), err)
+			replyAuthError(ctx, conn, req.ID, err)
+			break
+		}
+
+		var end EndSession
+		var err error
+		if req.Params != nil {
+			err = json.Unmarshal(*req.Params, &end)
+		}
+		if err != nil {
+			logrus.Errorf("connect: error parsing endSession: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		p.peer.Session().End(end.Reason)
+
+		_ = conn.Reply(ctx, req.ID, end)
+
+	case "setTrackPaused":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		var pause TrackPause
+		err := json.Unmarshal(*req.Params, &pause)
+		if err != nil {
+			logrus.Errorf("connect: error parsing setTrackPaused: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		err = p.peer.SetTrackPaused(pause.Track, pause.Paused)
+		if err != nil {
+			logrus.Errorf("setTrackPaused error: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, pause)
+
+	case "stats":
+		if p.peer == nil {
+			logrus.Errorf("connect: no peer exists for connection")
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", errors.New("no peer exists")),
+			})
+			break
+		}
+
+		stats, err := sfu.ParseClientStats(*req.Params)
+		if err != nil {
+			logrus.Errorf("connect: error parsing stats: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		err = p.peer.SetClientStats(stats)
+		if err != nil {
+			logrus.Debugf("stats error: %v", err)
+			_ = conn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+				Code:    500,
+				Message: fmt.Sprintf("%s", err),
+			})
+			break
+		}
+
+		_ = conn.Reply(ctx, req.ID, stats)
+
 	case "trickle":
 		logrus.Debugf("trickle")
 		if p.peer == nil {
@@ -307,3 +831,22 @@ func (h *Handler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2
 		}
 	}
 }
+
+// subscribeNone leaves subscribing to the peer, tracks are only sent once subscribed
+func subscribeNone(*sfu.Router) bool {
+	return false
+}
+
+func canSubscribe(c *Claims) bool { return c.Subscribe }
+
+// replyAuthError replies with the json-rpc error code of an authentication failure
+func replyAuthError(ctx context.Context, conn *jsonrpc2.Conn, id jsonrpc2.ID, err error) {
+	code := int64(500)
+	if e, ok := err.(*authError); ok {
+		code = e.code
+	}
+	_ = conn.ReplyWithError(ctx, id, &jsonrpc2.Error{
+		Code:    code,
+		Message: err.Error(),
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/YusukeKishino/rtc/sfu"
+)
+
+const debugFeedCycle = time.Second
+
+// debugSession is a session as shown on the debug page
+type debugSession struct {
+	sfu.SessionSnapshot
+	Stats sfu.SessionStats `json:"stats"`
+}
+
+// debugAuth rejects requests without the admin token. Browsers can't set headers
+// on page loads and event sources, so it may be given as a query parameter.
+func debugAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		given := c.Query("token")
+		if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		c.Next()
+	}
+}
+
+func registerDebugRoutes(g *gin.RouterGroup, s *sfu.SFU) {
+	g.GET("/sessions", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "debug_sessions.html.tmpl", gin.H{})
+	})
+
+	g.GET("/sessions/feed", func(c *gin.Context) {
+		t := time.NewTicker(debugFeedCycle)
+		defer t.Stop()
+
+		c.SSEvent("sessions", debugSessions(s))
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case <-c.Request.Context().Done():
+				return false
+			case <-t.C:
+				c.SSEvent("sessions", debugSessions(s))
+				return true
+			}
+		})
+	})
+}
+
+// debugSessions describes every session with its stats
+func debugSessions(s *sfu.SFU) []debugSession {
+	sessions := []debugSession{}
+	for _, summary := range s.Snapshot() {
+		session := s.GetSession(summary.ID)
+		if session == nil {
+			continue
+		}
+		sessions = append(sessions, debugSession{
+			SessionSnapshot: session.Snapshot(),
+			Stats:           session.Stats(),
+		})
+	}
+	return sessions
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/YusukeKishino/rtc/sfu"
+)
+
+const (
+	playlistContentType = "application/vnd.apple.mpegurl"
+	mp4ContentType      = "video/mp4"
+
+	// blockingTimeout bounds blocking playlist reloads and preload hints
+	blockingTimeout = 10 * time.Second
+)
+
+func registerHLSRoutes(g *gin.RouterGroup, s *sfu.SFU) {
+	g.GET("/:sid/*path", func(c *gin.Context) {
+		c.Header("Access-Control-Allow-Origin", "*")
+
+		session := s.GetSession(c.Param("sid"))
+		if session == nil || session.HLS() == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		hls := session.HLS()
+
+		path := strings.TrimPrefix(c.Param("path"), "/")
+		if path == "index.m3u8" {
+			c.Header("Cache-Control", "no-cache")
+			c.Data(http.StatusOK, playlistContentType, []byte(hls.MasterPlaylist()))
+			return
+		}
+
+		i := strings.LastIndex(path, "/")
+		if i < 0 {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		sender := hls.Sender(path[:i])
+		if sender == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), blockingTimeout)
+		defer cancel()
+
+		var (
+			msn, part int
+			data      []byte
+			err       error
+		)
+		file := path[i+1:]
+		switch {
+		case file == "playlist.m3u8":
+			var playlist string
+			playlist, err = sender.Playlist(ctx, queryInt(c, "_HLS_msn"), queryInt(c, "_HLS_part"))
+			if err == nil {
+				c.Header("Cache-Control", "no-cache")
+				c.Data(http.StatusOK, playlistContentType, []byte(playlist))
+				return
+			}
+		case file == "init.mp4":
+			data, err = sender.Init()
+		case scan(file, "part%d.%d.m4s", &msn, &part):
+			data, err = sender.Part(ctx, msn, part)
+		case scan(file, "seg%d.m4s", &msn):
+			data, err = sender.Segment(msn)
+		default:
+			err = sfu.ErrHLSNotFound
+		}
+
+		switch err {
+		case nil:
+			c.Data(http.StatusOK, mp4ContentType, data)
+		case sfu.ErrHLSBadRequest:
+			c.Status(http.StatusBadRequest)
+		case context.DeadlineExceeded:
+			c.Status(http.StatusServiceUnavailable)
+		default:
+			c.Status(http.StatusNotFound)
+		}
+	})
+}
+
+// queryInt returns a non negative integer query parameter or -1
+func queryInt(c *gin.Context, key string) int {
+	v, err := strconv.Atoi(c.Query(key))
+	if err != nil || v < 0 {
+		return -1
+	}
+	return v
+}
+
+// scan matches a file name against a format
+func scan(file, format string, args ...interface{}) bool {
+	n, err := fmt.Sscanf(file, format, args...)
+	return err == nil && n == len(args)
+}
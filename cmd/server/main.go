@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"html/template"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/multitemplate"
@@ -18,13 +22,32 @@ import (
 	"github.com/sourcegraph/jsonrpc2"
 	websocketjsonrpc2 "github.com/sourcegraph/jsonrpc2/websocket"
 	ginlogrus "github.com/toorop/gin-logrus"
+
+	"github.com/YusukeKishino/rtc/sfu"
 )
 
 var (
-	cert string
-	key  string
-	addr string
-	env  string
+	cert       string
+	key        string
+	addr       string
+	env        string
+	adminToken string
+	whipToken  string
+	whepToken  string
+	rtmpAddr   string
+	rtmpKeys   string
+	rtspAddr   string
+	wsKeys     string
+	wsOrigins  string
+	statsLog   time.Duration
+
+	metricsToken    string
+	metricsSessions bool
+	debug           bool
+	timelineCycle   int
+	timelineFile    string
+	qualityCycle    int
+	resumeGrace     time.Duration
 )
 
 const (
@@ -43,6 +66,22 @@ func parse() bool {
 	flag.StringVar(&cert, "cert", "", "cert file")
 	flag.StringVar(&key, "key", "", "key file")
 	flag.StringVar(&addr, "a", ":8080", "address to use")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token of the admin api")
+	flag.StringVar(&whipToken, "whip-token", "", "bearer token of whip publishers")
+	flag.StringVar(&whepToken, "whep-token", "", "bearer token of whep viewers, open when empty")
+	flag.StringVar(&rtmpAddr, "rtmp", "", "rtmp ingest address, disabled when empty")
+	flag.StringVar(&rtmpKeys, "rtmp-keys", "", "json file mapping rtmp stream keys to session ids")
+	flag.StringVar(&rtspAddr, "rtsp", "", "rtsp egress address, disabled when empty, players authenticate with the whep token or an access token")
+	flag.StringVar(&wsKeys, "ws-keys", "", "json file mapping key ids to secrets of /ws access tokens, open when empty")
+	flag.StringVar(&wsOrigins, "ws-origins", "", "comma separated origins allowed to connect to /ws, any when empty")
+	flag.DurationVar(&statsLog, "stats-log", 0, "interval stats are logged at, disabled when 0")
+	flag.StringVar(&metricsToken, "metrics-token", "", "bearer token of /metrics, open when empty")
+	flag.BoolVar(&metricsSessions, "metrics-sessions", false, "export per session metrics labeled by session id")
+	flag.BoolVar(&debug, "debug", false, "serve /debug/sessions, behind the admin token when given")
+	flag.IntVar(&timelineCycle, "timeline-cycle", 6, "seconds between session stats samples kept for the timeline, disabled when 0")
+	flag.StringVar(&timelineFile, "timeline-file", "", "jsonl file session timelines are appended to, not persisted when empty")
+	flag.IntVar(&qualityCycle, "quality-cycle", 2, "seconds between connection quality updates, disabled when 0")
+	flag.DurationVar(&resumeGrace, "resume-grace", 10*time.Second, "time a peer stays in its session after its /ws connection dropped, not resumable when 0")
 	help := flag.Bool("h", false, "help info")
 	flag.Parse()
 
@@ -66,6 +105,22 @@ func showHelp() {
 	fmt.Println("      -cert {cert file}")
 	fmt.Println("      -key {key file}")
 	fmt.Println("      -a {listen addr}")
+	fmt.Println("      -admin-token {admin api bearer token}")
+	fmt.Println("      -whip-token {whip bearer token}")
+	fmt.Println("      -whep-token {whep bearer token}")
+	fmt.Println("      -rtmp {rtmp listen addr}")
+	fmt.Println("      -rtmp-keys {rtmp stream keys file}")
+	fmt.Println("      -rtsp {rtsp listen addr}")
+	fmt.Println("      -ws-keys {access token keys file}")
+	fmt.Println("      -ws-origins {allowed origins}")
+	fmt.Println("      -stats-log {stats log interval, e.g. 6s}")
+	fmt.Println("      -metrics-token {metrics bearer token}")
+	fmt.Println("      -metrics-sessions (export per session metrics)")
+	fmt.Println("      -debug (serve the live sessions page)")
+	fmt.Println("      -timeline-cycle {timeline sample seconds}")
+	fmt.Println("      -timeline-file {timeline jsonl file}")
+	fmt.Println("      -quality-cycle {connection quality seconds}")
+	fmt.Println("      -resume-grace {resume grace period, e.g. 10s}")
 	fmt.Println("      -h (show help info)")
 }
 
@@ -86,15 +141,52 @@ func main() {
 		c.File("config/favicon.png")
 	})
 
+	var origins []string
+	if wsOrigins != "" {
+		origins = strings.Split(wsOrigins, ",")
+	}
 	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		CheckOrigin:     checkOrigin(origins),
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 	}
-	handler := NewHandler()
+	streamKeys, err := loadStreamKeys(rtmpKeys)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	keys, err := loadTokenKeys(wsKeys)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if keys == nil {
+		logrus.Warnln("/ws open to anyone, no access token keys given")
+	}
+
+	handler := NewHandler(sfu.RTMPConfig{StreamKeys: streamKeys}, sfu.TimelineConfig{
+		SampleCycle: timelineCycle,
+		File:        timelineFile,
+	}, sfu.QualityConfig{Cycle: qualityCycle}, keys)
+	if statsLog > 0 {
+		go handler.sfu.LogStats(statsLog)
+	}
+	if resumeGrace > 0 {
+		handler.resume = newResumeStore(resumeGrace)
+	}
+
 	engine.GET("/ws", func(ctx *gin.Context) {
+		var claims *Claims
+		if handler.keys != nil {
+			c, err := handler.keys.verify(requestToken(ctx.Request))
+			if err != nil {
+				logrus.Infof("ws %s rejected: %v", ctx.ClientIP(), err)
+				ctx.String(http.StatusUnauthorized, err.Error())
+				return
+			}
+			claims = c
+		}
+
 		con, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
 		if err != nil {
 			ctx.Error(err)
@@ -102,18 +194,80 @@ func main() {
 		}
 		defer con.Close()
 
-		p := &peerContext{}
+		p := &peerContext{claims: claims}
 		c := context.WithValue(ctx, peerCtxKey, p)
 		jc := jsonrpc2.NewConn(c, websocketjsonrpc2.NewObjectStream(con), handler)
 
 		<-jc.DisconnectNotify()
 
-		if p.peer != nil {
-			logrus.Infoln("Closing peer")
-			p.peer.Close()
-		}
+		handler.release(p)
 	})
 
+	if adminToken != "" {
+		registerAdminRoutes(engine.Group("/admin", bearerAuth(adminToken)), handler.sfu)
+	} else {
+		logrus.Warnln("admin api disabled, no admin token given")
+	}
+
+	if whipToken != "" {
+		registerWHIPRoutes(engine.Group("/whip", bearerAuth(whipToken)), handler.sfu)
+	} else {
+		logrus.Warnln("whip disabled, no whip token given")
+	}
+
+	whep := engine.Group("/whep")
+	if whepToken != "" {
+		whep.Use(bearerAuth(whepToken))
+	}
+	registerWHEPRoutes(whep, handler.sfu)
+
+	registerHLSRoutes(engine.Group("/hls"), handler.sfu)
+
+	metrics := engine.Group("/metrics")
+	if metricsToken != "" {
+		metrics.Use(bearerAuth(metricsToken))
+	}
+	metrics.GET("", metricsHandler(handler.sfu, handler.signaling, metricsSessions))
+
+	if debug {
+		g := engine.Group("/debug")
+		if adminToken != "" {
+			g.Use(debugAuth(adminToken))
+		} else {
+			logrus.Warnln("/debug open to anyone, no admin token given")
+		}
+		registerDebugRoutes(g, handler.sfu)
+	}
+
+	if rtmpAddr != "" {
+		if len(streamKeys) == 0 {
+			logrus.Warnln("rtmp enabled without stream keys, every publisher will be rejected")
+		}
+		l, err := net.Listen("tcp", rtmpAddr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		go func() {
+			logrus.Errorf("rtmp listener stopped: %v", handler.sfu.ServeRTMP(l))
+		}()
+	}
+
+	if rtspAddr != "" {
+		authorize := rtspAuthorize(keys, whepToken)
+		if authorize == nil {
+			logrus.Warnln("rtsp egress open to anyone, no access token keys nor whep token given")
+		}
+		l, err := net.Listen("tcp", rtspAddr)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		go func() {
+			logrus.Errorf("rtsp listener stopped: %v", handler.sfu.ServeRTSP(l, authorize))
+		}()
+	}
+
 	engine.GET("/", func(c *gin.Context) {
 		c.HTML(200, "index.html.tmpl", gin.H{})
 	})
@@ -133,6 +287,24 @@ func main() {
 	}
 }
 
+// loadStreamKeys reads a json object of rtmp stream keys to session ids
+func loadStreamKeys(file string) (map[string]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys map[string]string
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("rtmp keys %s: %w", file, err)
+	}
+	return keys, nil
+}
+
 func setupWebpack() {
 	webpack.DevHost = "localhost:3808" // default
 	webpack.Plugin = "manifest"        // defaults to stats for compatability
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/YusukeKishino/rtc/sfu"
+)
+
+// signalingMethods are the json-rpc methods latency is observed for, others
+// are grouped so clients can't blow up the label set
+var signalingMethods = []string{
+	"join", "offer", "answer", "trickle", "subscribe", "unsubscribe", "getRoster",
+	"updateMetadata", "setTrackMuted", "muteParticipant", "setRole", "kick", "ban",
+	"endSession", "setTrackPaused", "stats", "resume",
+}
+
+// latencyBuckets are the upper bounds in seconds of the signaling latency histogram
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// histogram is a cumulative prometheus histogram
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// signalingMetrics observes the time taken to handle json-rpc requests
+type signalingMetrics struct {
+	mu      sync.Mutex
+	methods map[string]*histogram
+}
+
+func newSignalingMetrics() *signalingMetrics {
+	m := &signalingMetrics{methods: make(map[string]*histogram)}
+	for _, method := range append(signalingMethods, "other") {
+		m.methods[method] = &histogram{counts: make([]uint64, len(latencyBuckets))}
+	}
+	return m
+}
+
+// observe records the latency of a request started at start
+func (m *signalingMetrics) observe(method string, start time.Time) {
+	d := time.Since(start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.methods[method]
+	if !ok {
+		h = m.methods["other"]
+	}
+	for i, le := range latencyBuckets {
+		if d <= le {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += d
+}
+
+func (m *signalingMetrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	methods := make([]string, 0, len(m.methods))
+	for method := range m.methods {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	name := "rtc_signaling_duration_seconds"
+	writeHeader(w, name, "histogram", "Time taken to handle json-rpc signaling requests.")
+	for _, method := range methods {
+		h := m.methods[method]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{method=\"%s\",le=\"%s\"} %d\n", name, labelValue(method), formatFloat(le), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{method=\"%s\",le=\"+Inf\"} %d\n", name, labelValue(method), h.count)
+		fmt.Fprintf(w, "%s_sum{method=\"%s\"} %s\n", name, labelValue(method), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{method=\"%s\"} %d\n", name, labelValue(method), h.count)
+	}
+}
+
+// metricsHandler serves the metrics of the sfu in the prometheus text format.
+// Per session gauges are labeled by session id and only written when sessions is set.
+func metricsHandler(s *sfu.SFU, signaling *signalingMetrics, sessions bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m := s.Metrics(sessions)
+
+		var b strings.Builder
+		writeGauge(&b, "rtc_sessions", "Open sessions.", float64(m.Sessions))
+		writeLabeled(&b, "rtc_transports", "gauge", "Open transports by kind.", "kind", intValues(m.Transports))
+		writeLabeled(&b, "rtc_routers", "gauge", "Published tracks by kind.", "kind", intValues(m.Routers))
+		writeLabeled(&b, "rtc_senders", "gauge", "Track senders by kind.", "kind", intValues(m.Senders))
+
+		writeLabeled(&b, "rtc_rtp_packets_total", "counter", "RTP packets received and sent.", "direction",
+			map[string]float64{"in": float64(m.RTPPacketsIn), "out": float64(m.RTPPacketsOut)})
+		writeLabeled(&b, "rtc_rtp_bytes_total", "counter", "RTP bytes received and sent.", "direction",
+			map[string]float64{"in": float64(m.RTPBytesIn), "out": float64(m.RTPBytesOut)})
+		writeLabeled(&b, "rtc_rtcp_packets_total", "counter", "RTCP feedback received from subscribers and sent to publishers.", "direction",
+			map[string]float64{"in": float64(m.RTCPPacketsIn), "out": float64(m.RTCPPacketsOut)})
+		writeLabeled(&b, "rtc_nack_lookups_total", "counter", "Nacked packets looked up in receiver buffers.", "result",
+			map[string]float64{"hit": float64(m.NACKHits), "miss": float64(m.NACKMisses)})
+		writeLabeled(&b, "rtc_dropped_packets_total", "counter", "RTP packets dropped by full queues.", "queue", uintValues(m.Dropped))
+		writeLabeled(&b, "rtc_ice_state_transitions_total", "counter", "ICE connection state transitions of webrtc transports.", "state", uintValues(m.ICEStates))
+
+		signaling.write(&b)
+
+		if sessions {
+			writeSessions(&b, m.SessionMetrics)
+		}
+
+		c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(b.String()))
+	}
+}
+
+func writeSessions(w io.Writer, sessions []sfu.SessionMetrics) {
+	gauges := []struct {
+		name, help string
+		value      func(sfu.SessionMetrics) float64
+	}{
+		{"rtc_session_participants", "Participants of a session.", func(s sfu.SessionMetrics) float64 { return float64(s.Participants) }},
+		{"rtc_session_tracks", "Published tracks of a session.", func(s sfu.SessionMetrics) float64 { return float64(s.Tracks) }},
+		{"rtc_session_senders", "Track senders of a session.", func(s sfu.SessionMetrics) float64 { return float64(s.Senders) }},
+		{"rtc_session_bitrate_in", "Bits per second received by a session.", func(s sfu.SessionMetrics) float64 { return float64(s.BitrateIn) }},
+		{"rtc_session_bitrate_out", "Bits per second sent by a session.", func(s sfu.SessionMetrics) float64 { return float64(s.BitrateOut) }},
+	}
+
+	for _, g := range gauges {
+		writeHeader(w, g.name, "gauge", g.help)
+		for _, s := range sessions {
+			fmt.Fprintf(w, "%s{session=\"%s\"} %s\n", g.name, labelValue(s.ID), formatFloat(g.value(s)))
+		}
+	}
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeHeader(w, name, "gauge", help)
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func writeLabeled(w io.Writer, name, typ, help, label string, values map[string]float64) {
+	writeHeader(w, name, typ, help)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, label, labelValue(k), formatFloat(values[k]))
+	}
+}
+
+func intValues(m map[string]int) map[string]float64 {
+	values := make(map[string]float64, len(m))
+	for k, v := range m {
+		values[k] = float64(v)
+	}
+	return values
+}
+
+func uintValues(m map[string]uint64) map[string]float64 {
+	values := make(map[string]float64, len(m))
+	for k, v := range m {
+		values[k] = float64(v)
+	}
+	return values
+}
+
+// labelEscaper escapes label values as the exposition format specifies, Go
+// quoting escapes more than it allows
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelValue(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
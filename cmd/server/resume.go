@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+	"github.com/sourcegraph/jsonrpc2"
+
+	"github.com/YusukeKishino/rtc/sfu"
+)
+
+var errResumeTokenInvalid = errors.New("resume token invalid")
+
+// resumable is a peer a connection may be reattached to with its resume token
+type resumable struct {
+	peer     *sfu.WebRTCTransport
+	sid      string
+	identity string
+	// owner is the connection the peer is attached to, nil once detached
+	owner *peerContext
+	conn  *jsonrpc2.Conn
+	// timer closes the peer at the end of the grace period once detached
+	timer *time.Timer
+}
+
+// resumeStore keeps peers alive for a grace period after their connection
+// dropped, so clients can reconnect without leaving the session
+type resumeStore struct {
+	mu    sync.Mutex
+	grace time.Duration
+	peers map[string]*resumable
+}
+
+func newResumeStore(grace time.Duration) *resumeStore {
+	return &resumeStore{
+		grace: grace,
+		peers: make(map[string]*resumable),
+	}
+}
+
+func newResumeToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// add makes a joined peer resumable, returning its token
+func (s *resumeStore) add(p *peerContext, conn *jsonrpc2.Conn, sid, identity string) (string, error) {
+	token, err := newResumeToken()
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[token] = &resumable{peer: p.peer, sid: sid, identity: identity, owner: p, conn: conn}
+	return token, nil
+}
+
+// detach starts the grace period of the peer of a closed connection. It
+// returns false when the peer is not resumable and should be closed.
+func (s *resumeStore) detach(p *peerContext) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// tokens change on resume, look the peer up
+	var token string
+	var r *resumable
+	for t, candidate := range s.peers {
+		if candidate.peer == p.peer {
+			token, r = t, candidate
+			break
+		}
+	}
+	if r == nil {
+		return false
+	}
+	if r.owner != p {
+		// another connection resumed the peer
+		return true
+	}
+	if r.peer.Closed() {
+		delete(s.peers, token)
+		return true
+	}
+
+	logrus.Infof("peer %s detached, closing in %s unless resumed", r.peer.ID(), s.grace)
+	r.owner, r.conn = nil, nil
+	r.timer = time.AfterFunc(s.grace, func() {
+		s.mu.Lock()
+		if s.peers[token] != r || r.owner != nil {
+			s.mu.Unlock()
+			return
+		}
+		delete(s.peers, token)
+		s.mu.Unlock()
+
+		logrus.Infof("peer %s not resumed, closing", r.peer.ID())
+		_ = r.peer.Close()
+	})
+	return true
+}
+
+// resume attaches a connection to the peer of a token, it is given a new token.
+// A connection still attached is closed, it may not have noticed it dropped.
+func (s *resumeStore) resume(p *peerContext, conn *jsonrpc2.Conn, token string) (*sfu.WebRTCTransport, string, error) {
+	next, err := newResumeToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	s.mu.Lock()
+	r, ok := s.peers[token]
+	if !ok || r.peer.Closed() {
+		delete(s.peers, token)
+		s.mu.Unlock()
+		return nil, "", errResumeTokenInvalid
+	}
+	if p.claims != nil {
+		if err := p.claims.join(r.sid); err != nil {
+			s.mu.Unlock()
+			return nil, "", err
+		}
+		if p.claims.Identity != r.identity {
+			s.mu.Unlock()
+			return nil, "", errRightNotGranted
+		}
+	}
+
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	old := r.conn
+	r.owner, r.conn = p, conn
+	delete(s.peers, token)
+	s.peers[next] = r
+	s.mu.Unlock()
+
+	if old != nil {
+		go old.Close()
+	}
+	return r.peer, next, nil
+}
+
+// release hands the peer of a closed connection to the resume store for the
+// grace period, or closes it
+func (h *Handler) release(p *peerContext) {
+	if p.peer == nil {
+		return
+	}
+	if h.resume != nil && h.resume.detach(p) {
+		return
+	}
+	logrus.Infoln("Closing peer")
+	p.peer.Close()
+}
+
+// bind sends the notifications of a peer over a connection
+func bind(ctx context.Context, conn *jsonrpc2.Conn, peer *sfu.WebRTCTransport) {
+	// Notify user of trickle candidates
+	peer.OnICECandidate(func(c *webrtc.ICECandidate) {
+		logrus.Debugf("Sending ICE candidate")
+		if c == nil {
+			// Gathering done
+			return
+		}
+
+		if err := conn.Notify(ctx, "trickle", c.ToJSON()); err != nil {
+			logrus.Errorf("error sending trickle %s", err)
+		}
+	})
+
+	peer.OnSessionEvent(func(e sfu.SessionEvent) {
+		if err := conn.Notify(ctx, e.Type, e); err != nil {
+			logrus.Errorf("error sending %s %s", e.Type, err)
+		}
+	})
+
+	peer.OnKick(func(reason string) {
+		if err := conn.Notify(ctx, "kicked", Kicked{Reason: reason}); err != nil {
+			logrus.Errorf("error sending kicked %s", err)
+		}
+		go conn.Close()
+	})
+
+	peer.OnTrackRemoved(func(id string) {
+		if err := conn.Notify(ctx, "trackRemoved", TrackRemoved{Track: id}); err != nil {
+			logrus.Errorf("error sending track removed %s", err)
+		}
+	})
+
+	peer.OnNegotiationNeeded(func() {
+		logrus.Debugf("on negotiation needed called")
+		sendOffer(ctx, conn, peer)
+	})
+}
+
+// sendOffer renegotiates with the peer
+func sendOffer(ctx context.Context, conn *jsonrpc2.Conn, peer *sfu.WebRTCTransport) {
+	offer, err := peer.CreateOffer()
+	if err != nil {
+		logrus.Errorf("CreateOffer error: %v", err)
+		return
+	}
+
+	err = peer.SetLocalDescription(offer)
+	if err != nil {
+		logrus.Errorf("SetLocalDescription error: %v", err)
+		return
+	}
+
+	if err := conn.Notify(ctx, "offer", offer); err != nil {
+		logrus.Errorf("error sending offer %s", err)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/YusukeKishino/rtc/sfu"
+)
+
+// json-rpc error codes of authentication failures
+const (
+	codeTokenMissing     = 4001
+	codeTokenInvalid     = 4002
+	codeTokenExpired     = 4003
+	codeRoomNotGranted   = 4030
+	codeRightNotGranted  = 4031
+	tokenClockSkew       = 30 * time.Second
+	accessTokenQueryName = "access_token"
+)
+
+// authError is an authentication failure with its json-rpc error code
+type authError struct {
+	code    int64
+	message string
+}
+
+func (e *authError) Error() string {
+	return e.message
+}
+
+var (
+	errTokenMissing    = &authError{codeTokenMissing, "access token missing"}
+	errTokenInvalid    = &authError{codeTokenInvalid, "access token invalid"}
+	errTokenExpired    = &authError{codeTokenExpired, "access token expired"}
+	errRoomNotGranted  = &authError{codeRoomNotGranted, "room not granted"}
+	errRightNotGranted = &authError{codeRightNotGranted, "right not granted"}
+)
+
+// Claims of a signed access token
+type Claims struct {
+	// Room is the session id the token grants
+	Room string `json:"room"`
+	// Identity of the participant
+	Identity  string `json:"sub"`
+	ExpiresAt int64  `json:"exp"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	Publish   bool   `json:"publish"`
+	Subscribe bool   `json:"subscribe"`
+	Moderate  bool   `json:"moderate"`
+}
+
+// valid checks the token is in its validity period
+func (c *Claims) valid(now time.Time) error {
+	if c.ExpiresAt == 0 || now.Add(-tokenClockSkew).Unix() >= c.ExpiresAt {
+		return errTokenExpired
+	}
+	if c.NotBefore != 0 && now.Add(tokenClockSkew).Unix() < c.NotBefore {
+		return errTokenInvalid
+	}
+	return nil
+}
+
+// join checks the token is still valid and grants the room
+func (c *Claims) join(room string) error {
+	if err := c.valid(time.Now()); err != nil {
+		return err
+	}
+	if c.Room != room {
+		return errRoomNotGranted
+	}
+	return nil
+}
+
+// role in the session granted by the rights of the token
+func (c *Claims) role() sfu.Role {
+	switch {
+	case c.Moderate:
+		return sfu.RoleModerator
+	case c.Publish:
+		return sfu.RolePresenter
+	}
+	return sfu.RoleViewer
+}
+
+// tokenKeys are the hs256 secrets access tokens are signed with, by key id.
+// Several keys are accepted at once so they can be rotated.
+type tokenKeys map[string][]byte
+
+// loadTokenKeys reads a json object of key ids to secrets
+func loadTokenKeys(file string) (tokenKeys, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets map[string]string
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return nil, fmt.Errorf("token keys %s: %w", file, err)
+	}
+
+	keys := make(tokenKeys, len(secrets))
+	for kid, secret := range secrets {
+		keys[kid] = []byte(secret)
+	}
+	return keys, nil
+}
+
+// verify checks the signature and validity period of a jwt and returns its
+// claims. Tokens without a key id are checked against every key.
+func (k tokenKeys) verify(token string) (*Claims, error) {
+	if token == "" {
+		return nil, errTokenMissing
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenInvalid
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "HS256" {
+		return nil, errTokenInvalid
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	ok := false
+	if secret, found := k[header.Kid]; found {
+		ok = checkSignature(secret, signed, sig)
+	} else if header.Kid == "" {
+		for _, secret := range k {
+			if ok = checkSignature(secret, signed, sig); ok {
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, errTokenInvalid
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errTokenInvalid
+	}
+	if err := claims.valid(time.Now()); err != nil {
+		return nil, err
+	}
+	return &claims, nil
+}
+
+func checkSignature(secret, signed, sig []byte) bool {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(signed)
+	return hmac.Equal(mac.Sum(nil), sig)
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// requestToken returns the access token of a request. Browsers can't set
+// headers on websockets, so it may be given as a query parameter.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.URL.Query().Get(accessTokenQueryName)
+}
+
+// rtspAuthorize accepts the whep token and access tokens granting the session
+// with the subscribe right, nil when neither is configured
+func rtspAuthorize(keys tokenKeys, whepToken string) func(sid, token string) bool {
+	if keys == nil && whepToken == "" {
+		return nil
+	}
+	return func(sid, token string) bool {
+		if whepToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(whepToken)) == 1 {
+			return true
+		}
+		if keys == nil {
+			return false
+		}
+		claims, err := keys.verify(token)
+		return err == nil && claims.join(sid) == nil && claims.Subscribe
+	}
+}
+
+// checkOrigin allows websocket upgrades from the origins, any when none are given
+func checkOrigin(origins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(origins) == 0 || origin == "" {
+			// clients other than browsers send no origin
+			return true
+		}
+		for _, o := range origins {
+			if strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
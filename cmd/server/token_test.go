@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken signs claims into a jwt with the header fields
+func signToken(t *testing.T, header map[string]string, claims interface{}, secret string) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := segment(header) + "." + segment(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// authCode returns the json-rpc error code an error is replied with
+func authCode(t *testing.T, err error) int64 {
+	t.Helper()
+	if err == nil {
+		return 0
+	}
+	e, ok := err.(*authError)
+	if !ok {
+		t.Fatalf("%v is not an authentication error", err)
+	}
+	return e.code
+}
+
+func TestTokenVerify(t *testing.T) {
+	keys := tokenKeys{"a": []byte("secret a"), "b": []byte("secret b")}
+	claims := &Claims{Room: "room", Identity: "alice", ExpiresAt: time.Now().Add(time.Hour).Unix(), Subscribe: true}
+	expired := &Claims{Room: "room", ExpiresAt: time.Now().Add(-time.Hour).Unix()}
+	early := &Claims{Room: "room", ExpiresAt: time.Now().Add(2 * time.Hour).Unix(), NotBefore: time.Now().Add(time.Hour).Unix()}
+	hs256 := func(kid string) map[string]string {
+		header := map[string]string{"alg": "HS256", "typ": "JWT"}
+		if kid != "" {
+			header["kid"] = kid
+		}
+		return header
+	}
+	valid := signToken(t, hs256("a"), claims, "secret a")
+	parts := strings.Split(valid, ".")
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	sig[0] ^= 0xff
+	tampered := parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(sig)
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		code  int64
+	}{
+		{"valid", valid, 0},
+		{"missing", "", codeTokenMissing},
+		{"malformed", "header.claims", codeTokenInvalid},
+		{"bad signature", tampered, codeTokenInvalid},
+		{"signed with another key", signToken(t, hs256("a"), claims, "secret b"), codeTokenInvalid},
+		{"unknown kid", signToken(t, hs256("c"), claims, "secret a"), codeTokenInvalid},
+		{"kid-less first key", signToken(t, hs256(""), claims, "secret a"), 0},
+		{"kid-less second key", signToken(t, hs256(""), claims, "secret b"), 0},
+		{"kid-less unknown key", signToken(t, hs256(""), claims, "secret c"), codeTokenInvalid},
+		{"alg none", signToken(t, map[string]string{"alg": "none", "kid": "a"}, claims, "secret a"), codeTokenInvalid},
+		{"alg hs512", signToken(t, map[string]string{"alg": "HS512", "kid": "a"}, claims, "secret a"), codeTokenInvalid},
+		{"claims not json", signToken(t, hs256("a"), "claims", "secret a"), codeTokenInvalid},
+		{"expired", signToken(t, hs256("a"), expired, "secret a"), codeTokenExpired},
+		{"not yet valid", signToken(t, hs256("a"), early, "secret a"), codeTokenInvalid},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := keys.verify(tc.token)
+			if code := authCode(t, err); code != tc.code {
+				t.Fatalf("code %d, want %d (%v)", code, tc.code, err)
+			}
+			if err == nil && *got != *claims {
+				t.Fatalf("claims %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestClaimsValid(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	skew := int64(tokenClockSkew / time.Second)
+
+	for _, tc := range []struct {
+		name      string
+		expiresAt int64
+		notBefore int64
+		code      int64
+	}{
+		{"valid", now.Unix() + 60, 0, 0},
+		{"no expiry", 0, 0, codeTokenExpired},
+		{"expired within skew", now.Unix() - skew + 1, 0, 0},
+		{"expired at skew", now.Unix() - skew, 0, codeTokenExpired},
+		{"expired past skew", now.Unix() - skew - 1, 0, codeTokenExpired},
+		{"not before now", now.Unix() + 60, now.Unix(), 0},
+		{"not before at skew", now.Unix() + 60, now.Unix() + skew, 0},
+		{"not before past skew", now.Unix() + 60, now.Unix() + skew + 1, codeTokenInvalid},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &Claims{ExpiresAt: tc.expiresAt, NotBefore: tc.notBefore}
+			if code := authCode(t, c.valid(now)); code != tc.code {
+				t.Fatalf("code %d, want %d", code, tc.code)
+			}
+		})
+	}
+}
+
+func TestClaimsGrants(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+
+	for _, tc := range []struct {
+		name   string
+		claims *Claims
+		room   string
+		code   int64
+	}{
+		{"joins", &Claims{Room: "room", ExpiresAt: exp, Subscribe: true}, "room", 0},
+		{"room mismatch", &Claims{Room: "other", ExpiresAt: exp, Subscribe: true}, "room", codeRoomNotGranted},
+		{"expired", &Claims{Room: "room", ExpiresAt: time.Now().Add(-time.Hour).Unix()}, "room", codeTokenExpired},
+		{"subscribe not granted", &Claims{Room: "room", ExpiresAt: exp}, "room", codeRightNotGranted},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.claims.join(tc.room)
+			if err == nil {
+				err = (&peerContext{claims: tc.claims}).grants(canSubscribe)
+			}
+			if code := authCode(t, err); code != tc.code {
+				t.Fatalf("code %d, want %d (%v)", code, tc.code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/sdp/v2"
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+
+	"github.com/YusukeKishino/rtc/sfu"
+)
+
+func registerWHEPRoutes(g *gin.RouterGroup, s *sfu.SFU) {
+	created := newResources()
+
+	g.POST("/:sid", func(c *gin.Context) {
+		offer, ok := readOffer(c)
+		if !ok {
+			return
+		}
+
+		session := s.GetSession(c.Param("sid"))
+		if session == nil {
+			c.Status(http.StatusNotFound)
+			return
+		}
+
+		// whep viewers only receive, offers to send would publish into the session
+		if sendsMedia(offer) {
+			c.String(http.StatusBadRequest, "whep offers must be recvonly")
+			return
+		}
+
+		tracks := toSet(c.QueryArray("track"))
+		participants := toSet(c.QueryArray("participant"))
+		identities := make(map[string]string)
+		for _, p := range session.Roster() {
+			identities[p.ID] = p.Identity
+		}
+
+		// whep has no server initiated renegotiation, so only routers
+		// published before the answer can be subscribed
+		var answered int32
+		peer, err := s.NewWebRTCTransportWithOptions(c.Param("sid"), offer, sfu.WebRTCTransportOptions{
+			Subscribe: func(r *sfu.Router) bool {
+				if atomic.LoadInt32(&answered) == 1 {
+					return false
+				}
+				if len(tracks) == 0 && len(participants) == 0 {
+					return true
+				}
+				return tracks[r.Track().ID()] || participants[identities[r.TransportID()]]
+			},
+			Role: sfu.RoleViewer,
+		})
+		if err != nil {
+			logrus.Errorf("whep: error creating peer: %v", err)
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		logrus.Infof("whep peer %s join session %s", peer.ID(), c.Param("sid"))
+		created.add(peer)
+
+		answer, err := answerOffer(peer, offer)
+		atomic.StoreInt32(&answered, 1)
+		if err != nil {
+			logrus.Errorf("whep: answer error: %v", err)
+			_ = peer.Close()
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		c.Header("Location", c.Request.URL.EscapedPath()+"/"+peer.ID())
+		c.Data(http.StatusCreated, sdpContentType, []byte(answer.SDP))
+	})
+
+	g.PATCH("/:sid/:tid", func(c *gin.Context) {
+		peer := getWebRTCTransport(c, s, created)
+		if peer == nil {
+			return
+		}
+		patchResource(c, peer)
+	})
+
+	g.DELETE("/:sid/:tid", func(c *gin.Context) {
+		peer := getWebRTCTransport(c, s, created)
+		if peer == nil {
+			return
+		}
+
+		logrus.Infof("whep peer %s leave session %s", peer.ID(), c.Param("sid"))
+
+		created.remove(peer.ID())
+		if err := peer.Close(); err != nil {
+			logrus.Errorf("whep: error closing peer: %v", err)
+		}
+		c.Status(http.StatusOK)
+	})
+}
+
+// sendsMedia reports whether an offer has m-lines sending media
+func sendsMedia(offer webrtc.SessionDescription) bool {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return false
+	}
+
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Port.Value == 0 || md.MediaName.Media == "application" {
+			continue
+		}
+		if _, ok := md.Attribute(webrtc.RTPTransceiverDirectionRecvonly.String()); ok {
+			continue
+		}
+		if _, ok := md.Attribute(webrtc.RTPTransceiverDirectionInactive.String()); ok {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
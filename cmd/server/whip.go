@@ -0,0 +1,276 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pion/sdp/v2"
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+
+	"github.com/YusukeKishino/rtc/sfu"
+)
+
+const (
+	sdpContentType     = "application/sdp"
+	sdpFragContentType = "application/trickle-ice-sdpfrag"
+
+	// gatherTimeout bounds how long an answer waits for its candidates
+	gatherTimeout = 5 * time.Second
+)
+
+// resources are the transports created through an endpoint, only they may be
+// patched or deleted through it
+type resources struct {
+	mu  sync.Mutex
+	ids map[string]bool
+}
+
+func newResources() *resources {
+	return &resources{ids: make(map[string]bool)}
+}
+
+// add records a transport, until its peer connection closes
+func (r *resources) add(peer *sfu.WebRTCTransport) {
+	r.mu.Lock()
+	r.ids[peer.ID()] = true
+	r.mu.Unlock()
+
+	peer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateClosed || state == webrtc.PeerConnectionStateFailed {
+			r.remove(peer.ID())
+		}
+	})
+}
+
+func (r *resources) has(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ids[id]
+}
+
+func (r *resources) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.ids, id)
+}
+
+func registerWHIPRoutes(g *gin.RouterGroup, s *sfu.SFU) {
+	created := newResources()
+
+	g.POST("/:sid", func(c *gin.Context) {
+		offer, ok := readOffer(c)
+		if !ok {
+			return
+		}
+
+		// whip peers only publish, they are never renegotiated to receive tracks
+		peer, err := s.NewWebRTCTransportWithOptions(c.Param("sid"), offer, sfu.WebRTCTransportOptions{
+			Subscribe: subscribeNone,
+		})
+		if err != nil {
+			logrus.Errorf("whip: error creating peer: %v", err)
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		logrus.Infof("whip peer %s join session %s", peer.ID(), c.Param("sid"))
+		created.add(peer)
+
+		answer, err := answerOffer(peer, offer)
+		if err != nil {
+			logrus.Errorf("whip: answer error: %v", err)
+			_ = peer.Close()
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		c.Header("Location", c.Request.URL.EscapedPath()+"/"+peer.ID())
+		c.Data(http.StatusCreated, sdpContentType, []byte(answer.SDP))
+	})
+
+	g.PATCH("/:sid/:tid", func(c *gin.Context) {
+		peer := getWebRTCTransport(c, s, created)
+		if peer == nil {
+			return
+		}
+		patchResource(c, peer)
+	})
+
+	g.DELETE("/:sid/:tid", func(c *gin.Context) {
+		peer := getWebRTCTransport(c, s, created)
+		if peer == nil {
+			return
+		}
+
+		logrus.Infof("whip peer %s leave session %s", peer.ID(), c.Param("sid"))
+
+		created.remove(peer.ID())
+		if err := peer.Close(); err != nil {
+			logrus.Errorf("whip: error closing peer: %v", err)
+		}
+		c.Status(http.StatusOK)
+	})
+}
+
+// readOffer reads an sdp offer from the request body
+func readOffer(c *gin.Context) (webrtc.SessionDescription, bool) {
+	if c.ContentType() != sdpContentType {
+		c.Status(http.StatusUnsupportedMediaType)
+		return webrtc.SessionDescription{}, false
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return webrtc.SessionDescription{}, false
+	}
+
+	return webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  string(body),
+	}, true
+}
+
+// answerOffer answers an offer and waits for candidate gathering so clients
+// without trickle ice get a complete answer
+func answerOffer(peer *sfu.WebRTCTransport, offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	if err := peer.SetRemoteDescription(offer); err != nil {
+		return nil, err
+	}
+
+	answer, err := peer.CreateAnswer()
+	if err != nil {
+		return nil, err
+	}
+
+	gathered := make(chan struct{})
+	var once sync.Once
+	peer.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil {
+			once.Do(func() { close(gathered) })
+		}
+	})
+
+	if err := peer.SetLocalDescription(answer); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-gathered:
+	case <-time.After(gatherTimeout):
+		logrus.Warnf("peer %s candidate gathering timed out", peer.ID())
+	}
+
+	return peer.LocalDescription(), nil
+}
+
+// getWebRTCTransport finds the transport of a resource url among the created ones
+func getWebRTCTransport(c *gin.Context, s *sfu.SFU, created *resources) *sfu.WebRTCTransport {
+	if !created.has(c.Param("tid")) {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+
+	session := s.GetSession(c.Param("sid"))
+	if session == nil {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+
+	peer, ok := session.GetTransport(c.Param("tid")).(*sfu.WebRTCTransport)
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return nil
+	}
+	return peer
+}
+
+// patchResource adds trickled candidates of a resource. ICE restarts are
+// rejected as they are not supported by the peer connection.
+func patchResource(c *gin.Context, peer *sfu.WebRTCTransport) {
+	if c.ContentType() != sdpFragContentType {
+		c.Status(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	body, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+
+	frag := parseSDPFrag(string(body))
+	if frag.ufrag != "" && frag.ufrag != remoteUfrag(peer) {
+		c.String(http.StatusUnprocessableEntity, "ice restart not supported")
+		return
+	}
+
+	for _, candidate := range frag.candidates {
+		if err := peer.AddICECandidate(candidate); err != nil {
+			logrus.Errorf("error setting ice candidate %s", err)
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+type sdpFrag struct {
+	ufrag      string
+	candidates []webrtc.ICECandidateInit
+}
+
+// parseSDPFrag parses a trickle ice sdp fragment, RFC 8840
+func parseSDPFrag(body string) sdpFrag {
+	var (
+		frag sdpFrag
+		mid  string
+	)
+
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			frag.ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			sdpMid := mid
+			frag.candidates = append(frag.candidates, webrtc.ICECandidateInit{
+				Candidate: strings.TrimPrefix(line, "a="),
+				SDPMid:    &sdpMid,
+			})
+		}
+	}
+
+	return frag
+}
+
+// remoteUfrag returns the ice ufrag of the remote description
+func remoteUfrag(peer *sfu.WebRTCTransport) string {
+	desc := peer.RemoteDescription()
+	if desc == nil {
+		return ""
+	}
+
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc.SDP)); err != nil {
+		return ""
+	}
+
+	if ufrag, ok := parsed.Attribute("ice-ufrag"); ok {
+		return ufrag
+	}
+	for _, md := range parsed.MediaDescriptions {
+		if ufrag, ok := md.Attribute("ice-ufrag"); ok {
+			return ufrag
+		}
+	}
+	return ""
+}
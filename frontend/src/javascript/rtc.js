@@ -41,6 +41,11 @@ pc.onicecandidate = event => {
 socket.addEventListener('message', async (event) => {
   const resp = JSON.parse(event.data)
 
+  if (!resp.id && resp.method === "connectionQuality") {
+    const { participant, quality } = resp.params
+    log(`Connection quality of ${participant.identity}: ${quality.level}`)
+  }
+
   // Listen for server renegotiation notifications
   if (!resp.id && resp.method === "offer") {
     log(`Got offer notification`)
@@ -97,6 +102,15 @@ const join = async () => {
       }
 
       pc.setRemoteDescription(resp.result)
+
+      // Report the browser's view of the connection to the server
+      setInterval(async () => {
+        const report = await pc.getStats()
+        socket.send(JSON.stringify({
+          method: "stats",
+          params: Array.from(report.values())
+        }))
+      }, 5000)
     }
   })
 }
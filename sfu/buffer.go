@@ -1,8 +1,8 @@
 package sfu
 
 import (
-	"fmt"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
@@ -187,10 +187,14 @@ func (b *Buffer) GetPayloadType() uint8 {
 	return b.payloadType
 }
 
-func (b *Buffer) stats() string {
+func (b *Buffer) stats() *BufferStats {
 	b.mu.RLock()
 	defer b.mu.RUnlock()
-	return fmt.Sprintf("buffer: [%d, %d] | lastNackSN: %d", b.lastClearSN, b.lastPushSN, b.lastNackSN)
+	return &BufferStats{
+		FirstSN:    b.lastClearSN,
+		LastSN:     b.lastPushSN,
+		LastNackSN: b.lastNackSN,
+	}
 }
 
 // GetNackPair calc nackpair
@@ -253,5 +257,11 @@ func (b *Buffer) GetLostRateBandwidth(cycle uint64) (float64, uint64) {
 
 // GetPacket get packet by sequence number
 func (b *Buffer) GetPacket(sn uint16) *rtp.Packet {
-	return b.pktBuffer[sn]
+	pkt := b.pktBuffer[sn]
+	if pkt != nil {
+		atomic.AddUint64(&counters.nackHits, 1)
+	} else {
+		atomic.AddUint64(&counters.nackMisses, 1)
+	}
+	return pkt
 }
@@ -0,0 +1,209 @@
+package sfu
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+const (
+	// maxClientStatsSize in bytes of a getStats() report a client may post
+	maxClientStatsSize = 256 * 1024
+	// minClientStatsInterval between reports of a client
+	minClientStatsInterval = time.Second
+)
+
+// ClientStats is the view a client has of its peer connection, normalized
+// from its getStats() report. Durations are in milliseconds.
+type ClientStats struct {
+	Time     time.Time             `json:"time"`
+	Inbound  []ClientInboundStats  `json:"inbound"`
+	Outbound []ClientOutboundStats `json:"outbound"`
+	// of the selected candidate pair
+	RoundTripTime            float64 `json:"roundTripTime,omitempty"`
+	AvailableOutgoingBitrate uint64  `json:"availableOutgoingBitrate,omitempty"`
+}
+
+// ClientInboundStats of a track a client receives
+type ClientInboundStats struct {
+	TrackID         string  `json:"trackId"`
+	Kind            string  `json:"kind"`
+	PacketsReceived uint64  `json:"packetsReceived"`
+	PacketsLost     int64   `json:"packetsLost"`
+	BytesReceived   uint64  `json:"bytesReceived"`
+	Jitter          float64 `json:"jitter"`
+	// JitterBufferDelay is the average time a sample waits in the jitter buffer
+	JitterBufferDelay float64 `json:"jitterBufferDelay"`
+	NACKCount         uint64  `json:"nackCount"`
+	PLICount          uint64  `json:"pliCount"`
+	// video only
+	FramesDecoded        uint64  `json:"framesDecoded,omitempty"`
+	FramesDropped        uint64  `json:"framesDropped,omitempty"`
+	FramesPerSecond      float64 `json:"framesPerSecond,omitempty"`
+	FreezeCount          uint64  `json:"freezeCount,omitempty"`
+	TotalFreezesDuration float64 `json:"totalFreezesDuration,omitempty"`
+}
+
+// ClientOutboundStats of a track a client publishes
+type ClientOutboundStats struct {
+	TrackID     string `json:"trackId"`
+	Kind        string `json:"kind"`
+	PacketsSent uint64 `json:"packetsSent"`
+	BytesSent   uint64 `json:"bytesSent"`
+	NACKCount   uint64 `json:"nackCount"`
+	PLICount    uint64 `json:"pliCount"`
+	// video only
+	FramesEncoded           uint64  `json:"framesEncoded,omitempty"`
+	FramesPerSecond         float64 `json:"framesPerSecond,omitempty"`
+	QualityLimitationReason string  `json:"qualityLimitationReason,omitempty"`
+}
+
+// rtcStats holds the members of the stats dictionaries used, see
+// https://www.w3.org/TR/webrtc-stats
+type rtcStats struct {
+	ID                       string  `json:"id"`
+	Type                     string  `json:"type"`
+	Kind                     string  `json:"kind"`
+	MediaType                string  `json:"mediaType"`
+	TrackID                  string  `json:"trackId"`
+	TrackIdentifier          string  `json:"trackIdentifier"`
+	MediaSourceID            string  `json:"mediaSourceId"`
+	PacketsReceived          uint64  `json:"packetsReceived"`
+	PacketsLost              int64   `json:"packetsLost"`
+	PacketsSent              uint64  `json:"packetsSent"`
+	BytesReceived            uint64  `json:"bytesReceived"`
+	BytesSent                uint64  `json:"bytesSent"`
+	Jitter                   float64 `json:"jitter"`
+	JitterBufferDelay        float64 `json:"jitterBufferDelay"`
+	JitterBufferEmittedCount uint64  `json:"jitterBufferEmittedCount"`
+	NACKCount                uint64  `json:"nackCount"`
+	PLICount                 uint64  `json:"pliCount"`
+	FramesDecoded            uint64  `json:"framesDecoded"`
+	FramesDropped            uint64  `json:"framesDropped"`
+	FramesEncoded            uint64  `json:"framesEncoded"`
+	FramesPerSecond          float64 `json:"framesPerSecond"`
+	FreezeCount              uint64  `json:"freezeCount"`
+	TotalFreezesDuration     float64 `json:"totalFreezesDuration"`
+	QualityLimitationReason  string  `json:"qualityLimitationReason"`
+	State                    string  `json:"state"`
+	Nominated                bool    `json:"nominated"`
+	CurrentRoundTripTime     float64 `json:"currentRoundTripTime"`
+	AvailableOutgoingBitrate float64 `json:"availableOutgoingBitrate"`
+}
+
+// ParseClientStats normalizes a getStats() report, given either as an array of
+// stats or as an object of stats by id
+func ParseClientStats(data []byte) (ClientStats, error) {
+	if len(data) > maxClientStatsSize {
+		return ClientStats{}, ErrClientStatsInvalid
+	}
+
+	var list []rtcStats
+	if err := json.Unmarshal(data, &list); err != nil {
+		var byID map[string]rtcStats
+		if err := json.Unmarshal(data, &byID); err != nil {
+			return ClientStats{}, ErrClientStatsInvalid
+		}
+		for _, s := range byID {
+			list = append(list, s)
+		}
+	}
+
+	ids := make(map[string]rtcStats, len(list))
+	for _, s := range list {
+		ids[s.ID] = s
+	}
+	// track identifiers are on the stats themselves in recent browsers, on
+	// the referenced track or media source stats in older ones
+	trackID := func(s rtcStats) string {
+		switch {
+		case s.TrackIdentifier != "":
+			return s.TrackIdentifier
+		case s.TrackID != "":
+			return ids[s.TrackID].TrackIdentifier
+		case s.MediaSourceID != "":
+			return ids[s.MediaSourceID].TrackIdentifier
+		}
+		return ""
+	}
+	kind := func(s rtcStats) string {
+		if s.Kind != "" {
+			return s.Kind
+		}
+		return s.MediaType
+	}
+
+	stats := ClientStats{
+		Time:     time.Now(),
+		Inbound:  []ClientInboundStats{},
+		Outbound: []ClientOutboundStats{},
+	}
+	for _, s := range list {
+		switch s.Type {
+		case "inbound-rtp":
+			in := ClientInboundStats{
+				TrackID:              trackID(s),
+				Kind:                 kind(s),
+				PacketsReceived:      s.PacketsReceived,
+				PacketsLost:          s.PacketsLost,
+				BytesReceived:        s.BytesReceived,
+				Jitter:               s.Jitter * 1000,
+				NACKCount:            s.NACKCount,
+				PLICount:             s.PLICount,
+				FramesDecoded:        s.FramesDecoded,
+				FramesDropped:        s.FramesDropped,
+				FramesPerSecond:      s.FramesPerSecond,
+				FreezeCount:          s.FreezeCount,
+				TotalFreezesDuration: s.TotalFreezesDuration * 1000,
+			}
+			if s.JitterBufferEmittedCount > 0 {
+				in.JitterBufferDelay = s.JitterBufferDelay / float64(s.JitterBufferEmittedCount) * 1000
+			}
+			stats.Inbound = append(stats.Inbound, in)
+		case "outbound-rtp":
+			stats.Outbound = append(stats.Outbound, ClientOutboundStats{
+				TrackID:                 trackID(s),
+				Kind:                    kind(s),
+				PacketsSent:             s.PacketsSent,
+				BytesSent:               s.BytesSent,
+				NACKCount:               s.NACKCount,
+				PLICount:                s.PLICount,
+				FramesEncoded:           s.FramesEncoded,
+				FramesPerSecond:         s.FramesPerSecond,
+				QualityLimitationReason: s.QualityLimitationReason,
+			})
+		case "candidate-pair":
+			if s.State == "succeeded" && s.Nominated {
+				stats.RoundTripTime = s.CurrentRoundTripTime * 1000
+				stats.AvailableOutgoingBitrate = uint64(s.AvailableOutgoingBitrate)
+			}
+		}
+	}
+
+	sort.Slice(stats.Inbound, func(i, j int) bool {
+		return stats.Inbound[i].TrackID < stats.Inbound[j].TrackID
+	})
+	sort.Slice(stats.Outbound, func(i, j int) bool {
+		return stats.Outbound[i].TrackID < stats.Outbound[j].TrackID
+	})
+	return stats, nil
+}
+
+// SetClientStats attaches the latest stats reported by the client, reports
+// following the previous one too closely are rejected
+func (p *WebRTCTransport) SetClientStats(stats ClientStats) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.clientStats != nil && stats.Time.Sub(p.clientStats.Time) < minClientStatsInterval {
+		return ErrClientStatsTooFrequent
+	}
+	p.clientStats = &stats
+	return nil
+}
+
+// ClientStats returns the latest stats reported by the client, nil when none were
+func (p *WebRTCTransport) ClientStats() *ClientStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.clientStats
+}
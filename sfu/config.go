@@ -18,10 +18,28 @@ type ReceiverConfig struct {
 	Video WebRTCVideoReceiverConfig `mapstructure:"video"`
 }
 
+// RTMPConfig defines rtmp ingest parameters
+type RTMPConfig struct {
+	// StreamKeys maps the stream keys publishers may use to session ids
+	StreamKeys map[string]string `mapstructure:"streamkeys"`
+}
+
+// DataChannelConfig defines data channel relay parameters
+type DataChannelConfig struct {
+	// MaxMessageSize in bytes, larger messages are dropped
+	MaxMessageSize int `mapstructure:"maxmessagesize"`
+	// MaxBufferedAmount in bytes a receiving channel may buffer before backpressure applies
+	MaxBufferedAmount int `mapstructure:"maxbufferedamount"`
+}
+
 // Config for base SFU
 type Config struct {
-	WebRTC   WebRTCConfig   `mapstructure:"webrtc"`
-	Receiver ReceiverConfig `mapstructure:"receiver"`
+	WebRTC      WebRTCConfig      `mapstructure:"webrtc"`
+	Receiver    ReceiverConfig    `mapstructure:"receiver"`
+	RTMP        RTMPConfig        `mapstructure:"rtmp"`
+	DataChannel DataChannelConfig `mapstructure:"datachannel"`
+	Timeline    TimelineConfig    `mapstructure:"timeline"`
+	Quality     QualityConfig     `mapstructure:"quality"`
 }
 
 var (
@@ -0,0 +1,96 @@
+package sfu
+
+import (
+	"sync"
+
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaxMessageSize    = 16 * 1024
+	defaultMaxBufferedAmount = 1024 * 1024
+)
+
+// dataChannel is a data channel opened by a peer. Messages it receives are
+// relayed to the channels with the same label of the other peers in the session.
+type dataChannel struct {
+	mu       sync.Mutex
+	dc       *webrtc.DataChannel
+	reliable bool
+	queue    []webrtc.DataChannelMessage
+	stop     bool
+}
+
+func newDataChannel(dc *webrtc.DataChannel) *dataChannel {
+	d := &dataChannel{
+		dc: dc,
+		// partial reliability is requested with either limit
+		reliable: dc.MaxRetransmits() == nil && dc.MaxPacketLifeTime() == nil,
+	}
+
+	dc.SetBufferedAmountLowThreshold(uint64(config.DataChannel.MaxBufferedAmount / 2))
+	dc.OnBufferedAmountLow(d.flush)
+
+	return d
+}
+
+// send a message relayed from another peer. Unreliable channels drop messages
+// while the peer falls behind, reliable channels queue them and are closed
+// once the queue overflows so a slow peer can't hold the session back.
+func (d *dataChannel) send(msg webrtc.DataChannelMessage) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stop {
+		return
+	}
+
+	if len(d.queue) == 0 && d.dc.BufferedAmount() < uint64(config.DataChannel.MaxBufferedAmount) {
+		d.write(msg)
+		return
+	}
+
+	if !d.reliable {
+		logrus.Debugf("data channel %s dropping message, peer is behind", d.dc.Label())
+		return
+	}
+
+	if len(d.queue) >= maxSize {
+		logrus.Infof("data channel %s closing, peer is too slow", d.dc.Label())
+		d.stop = true
+		d.queue = nil
+		go d.dc.Close()
+		return
+	}
+	d.queue = append(d.queue, msg)
+}
+
+// flush queued messages once the buffered amount is low again
+func (d *dataChannel) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for len(d.queue) > 0 && !d.stop && d.dc.BufferedAmount() < uint64(config.DataChannel.MaxBufferedAmount) {
+		d.write(d.queue[0])
+		d.queue = d.queue[1:]
+	}
+}
+
+func (d *dataChannel) write(msg webrtc.DataChannelMessage) {
+	var err error
+	if msg.IsString {
+		err = d.dc.SendText(string(msg.Data))
+	} else {
+		err = d.dc.Send(msg.Data)
+	}
+	if err != nil {
+		logrus.Debugf("data channel %s send err: %v", d.dc.Label(), err)
+	}
+}
+
+func (d *dataChannel) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stop = true
+	d.queue = nil
+}
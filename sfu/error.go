@@ -9,4 +9,39 @@ var (
 	errPtNotSupported           = errors.New("payload type not supported")
 	errMethodNotSupported       = errors.New("method not supported")
 	errReceiverClosed           = errors.New("receiver closed")
+	errCodecNotSupported        = errors.New("codec not supported")
+	errTrackNotDeclared         = errors.New("track not declared")
+	errTransportClosed          = errors.New("transport closed")
+	errRTMPHandshake            = errors.New("rtmp handshake failed")
+	errRTMPChunk                = errors.New("rtmp invalid chunk")
+	errRTMPNotPublishing        = errors.New("rtmp client is not publishing")
+	errAMF                      = errors.New("amf invalid value")
+	errStreamKeyInvalid         = errors.New("stream key invalid")
+	errRTSPMalformed            = errors.New("rtsp malformed message")
+	errRTSPScheme               = errors.New("rtsp url scheme must be rtsp")
+	errRTSPTransport            = errors.New("rtsp interleaved transport not accepted")
+	errRTSPNoMedia              = errors.New("rtsp presentation has no supported media")
+	errRelayUnauthenticated     = errors.New("relay requires a remote or a secret")
+
+	// ErrSessionNotFound is returned when a session does not exist
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrRouterNotFound is returned when no router publishes a track
+	ErrRouterNotFound = errors.New("router not found")
+	// ErrParticipantNotFound is returned when no participant joined with a transport
+	ErrParticipantNotFound = errors.New("participant not found")
+	// ErrNotSubscribed is returned when a transport is not subscribed to a track
+	ErrNotSubscribed = errors.New("not subscribed to track")
+	// ErrRoleInvalid is returned when a role is unknown
+	ErrRoleInvalid = errors.New("role invalid")
+	// ErrBanned is returned when a banned identity joins a session
+	ErrBanned = errors.New("banned from session")
+	// ErrTimelineNotFound is returned when no timeline was kept for a session
+	ErrTimelineNotFound = errors.New("timeline not found")
+	// ErrClientStatsInvalid is returned when a client posts a malformed or oversized stats report
+	ErrClientStatsInvalid = errors.New("client stats invalid")
+	// ErrClientStatsTooFrequent is returned when a client posts stats faster than they are accepted
+	ErrClientStatsTooFrequent = errors.New("client stats posted too frequently")
+	// ErrICERestartNotSupported is returned when a peer offers new ice credentials,
+	// the peer connection keeps using the ones first negotiated
+	ErrICERestartNotSupported = errors.New("ice restart not supported")
 )
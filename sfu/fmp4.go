@@ -0,0 +1,207 @@
+package sfu
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// sample flags of fragmented mp4 trun entries, ISO/IEC 14496-12 8.8.3.1
+	sampleFlagsSync    = 0x02000000
+	sampleFlagsNonSync = 0x01010000
+)
+
+// fmp4Sample is a sample of a fragment, the presentation time differs from
+// the decode time when frames are reordered
+type fmp4Sample struct {
+	data     []byte
+	dts      int64
+	pts      int64
+	duration uint32
+	keyframe bool
+}
+
+// mp4Box writes a box with its size prefixed
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// mp4FullBox writes a box with version and flags
+func mp4FullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	vf := make([]byte, 4)
+	binary.BigEndian.PutUint32(vf, flags)
+	vf[0] = version
+	return mp4Box(typ, append([][]byte{vf}, payload...)...)
+}
+
+func be16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func be32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func be64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+var mp4Matrix = [][]byte{
+	be32(0x00010000), be32(0), be32(0),
+	be32(0), be32(0x00010000), be32(0),
+	be32(0), be32(0), be32(0x40000000),
+}
+
+// fmp4AVCSampleEntry describes an h264 track from its parameter sets
+func fmp4AVCSampleEntry(sps, pps []byte, width, height int) []byte {
+	avcC := mp4Box("avcC",
+		[]byte{1, sps[1], sps[2], sps[3], 0xff, 0xe1},
+		be16(uint16(len(sps))), sps,
+		[]byte{1}, be16(uint16(len(pps))), pps,
+	)
+
+	return mp4Box("avc1",
+		make([]byte, 6), be16(1), // reserved, data_reference_index
+		make([]byte, 16), // pre_defined, reserved
+		be16(uint16(width)), be16(uint16(height)),
+		be32(0x00480000), be32(0x00480000), // 72 dpi
+		be32(0), be16(1), // reserved, frame_count
+		make([]byte, 32), // compressorname
+		be16(0x0018), be16(0xffff),
+		avcC,
+	)
+}
+
+// fmp4OpusSampleEntry describes an opus track, Encapsulation of Opus in ISOBMFF
+func fmp4OpusSampleEntry(channels uint16, sampleRate uint32) []byte {
+	dOps := mp4Box("dOps",
+		[]byte{0, uint8(channels)}, be16(312), be32(sampleRate), be16(0), []byte{0},
+	)
+
+	return mp4Box("Opus",
+		make([]byte, 6), be16(1), // reserved, data_reference_index
+		make([]byte, 8), // reserved
+		be16(channels), be16(16),
+		be32(0), be32(sampleRate<<16),
+		dOps,
+	)
+}
+
+// fmp4Init writes an initialization segment of a single track
+func fmp4Init(video bool, timescale uint32, width, height int, sampleEntry []byte) []byte {
+	ftyp := mp4Box("ftyp", []byte("iso6"), be32(0), []byte("iso6mp41"))
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		be32(0), be32(0), be32(1000), be32(0), // times, timescale, duration
+		be32(0x00010000), be16(0x0100), make([]byte, 10), // rate, volume, reserved
+		concat(mp4Matrix...), make([]byte, 24), be32(2),
+	)
+
+	volume, handler, handlerName := uint16(0), "vide", "VideoHandler"
+	mediaHeader := mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	if !video {
+		volume, handler, handlerName = 0x0100, "soun", "SoundHandler"
+		mediaHeader = mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	}
+
+	tkhd := mp4FullBox("tkhd", 0, 3,
+		be32(0), be32(0), be32(1), be32(0), be32(0), // times, track_ID, reserved, duration
+		make([]byte, 8), be16(0), be16(0), be16(volume), be16(0), // reserved, layer, group, volume
+		concat(mp4Matrix...), be32(uint32(width)<<16), be32(uint32(height)<<16),
+	)
+
+	mdhd := mp4FullBox("mdhd", 0, 0, be32(0), be32(0), be32(timescale), be32(0), be16(0x55c4), be16(0))
+	hdlr := mp4FullBox("hdlr", 0, 0, be32(0), []byte(handler), make([]byte, 12), []byte(handlerName+"\x00"))
+
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, be32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, be32(1), sampleEntry),
+		mp4FullBox("stts", 0, 0, be32(0)),
+		mp4FullBox("stsc", 0, 0, be32(0)),
+		mp4FullBox("stsz", 0, 0, be32(0), be32(0)),
+		mp4FullBox("stco", 0, 0, be32(0)),
+	)
+
+	trak := mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mediaHeader, dinf, stbl)))
+	mvex := mp4Box("mvex", mp4FullBox("trex", 0, 0, be32(1), be32(1), be32(0), be32(0), be32(0)))
+
+	return concat(ftyp, mp4Box("moov", mvhd, trak, mvex))
+}
+
+// fmp4Fragment writes a moof and mdat of samples
+func fmp4Fragment(seq uint32, samples []fmp4Sample) []byte {
+	// composition offsets are only written for reordered samples, signed
+	// offsets need a version 1 trun
+	var version uint8
+	trunFlags := uint32(0x000701)
+	for _, s := range samples {
+		if s.pts != s.dts {
+			version = 1
+			trunFlags |= 0x000800
+			break
+		}
+	}
+
+	entries := make([][]byte, 0, len(samples)*4)
+	var size int
+	for _, s := range samples {
+		flags := uint32(sampleFlagsNonSync)
+		if s.keyframe {
+			flags = sampleFlagsSync
+		}
+		entries = append(entries, be32(s.duration), be32(uint32(len(s.data))), be32(flags))
+		if version == 1 {
+			entries = append(entries, be32(uint32(int32(s.pts-s.dts))))
+		}
+		size += len(s.data)
+	}
+
+	moof := func(dataOffset uint32) []byte {
+		trun := mp4FullBox("trun", version, trunFlags,
+			be32(uint32(len(samples))), be32(dataOffset), concat(entries...))
+		traf := mp4Box("traf",
+			mp4FullBox("tfhd", 0, 0x020000, be32(1)),
+			mp4FullBox("tfdt", 1, 0, be64(uint64(samples[0].dts))),
+			trun,
+		)
+		return mp4Box("moof", mp4FullBox("mfhd", 0, 0, be32(seq)), traf)
+	}
+
+	// the data offset points past the moof and the mdat header
+	head := moof(0)
+	head = moof(uint32(len(head) + 8))
+
+	mdat := make([]byte, 0, size)
+	for _, s := range samples {
+		mdat = append(mdat, s.data...)
+	}
+
+	return concat(head, mp4Box("mdat", mdat))
+}
+
+func concat(bufs ...[]byte) []byte {
+	var size int
+	for _, b := range bufs {
+		size += len(b)
+	}
+	out := make([]byte, 0, size)
+	for _, b := range bufs {
+		out = append(out, b...)
+	}
+	return out
+}
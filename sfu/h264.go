@@ -0,0 +1,334 @@
+package sfu
+
+import (
+	"errors"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	naluTypeIDR   = 5
+	naluTypeSPS   = 7
+	naluTypePPS   = 8
+	naluTypeAUD   = 9
+	naluTypeSTAPA = 24
+	naluTypeFUA   = 28
+)
+
+var errSPSTruncated = errors.New("sps truncated")
+
+// h264AccessUnit is a decodable frame of nal units
+type h264AccessUnit struct {
+	nalus     [][]byte
+	timestamp uint32
+	keyframe  bool
+}
+
+// h264Depacketizer assembles access units from rtp packets, RFC 6184
+type h264Depacketizer struct {
+	au      *h264AccessUnit
+	fua     []byte
+	lastSN  uint16
+	started bool
+}
+
+// push a packet, returns the access units completed by it
+func (d *h264Depacketizer) push(pkt *rtp.Packet) []*h264AccessUnit {
+	var done []*h264AccessUnit
+
+	if d.started && pkt.SequenceNumber != d.lastSN+1 {
+		// lost a packet, a fragmented nal unit can't be completed
+		d.fua = nil
+	}
+	d.lastSN = pkt.SequenceNumber
+	d.started = true
+
+	if d.au != nil && d.au.timestamp != pkt.Timestamp {
+		// lost the marker packet of the previous frame
+		done = d.appendDone(done)
+	}
+	if d.au == nil {
+		d.au = &h264AccessUnit{timestamp: pkt.Timestamp}
+	}
+
+	payload := pkt.Payload
+	if len(payload) == 0 {
+		return done
+	}
+
+	switch naluType := payload[0] & 0x1f; {
+	case naluType >= 1 && naluType <= 23:
+		d.addNALU(append([]byte{}, payload...))
+	case naluType == naluTypeSTAPA:
+		buf := payload[1:]
+		for len(buf) > 2 {
+			size := int(buf[0])<<8 | int(buf[1])
+			if size == 0 || len(buf) < size+2 {
+				break
+			}
+			d.addNALU(append([]byte{}, buf[2:size+2]...))
+			buf = buf[size+2:]
+		}
+	case naluType == naluTypeFUA:
+		if len(payload) < 2 {
+			break
+		}
+		start, end := payload[1]&0x80 != 0, payload[1]&0x40 != 0
+		if start {
+			d.fua = []byte{payload[0]&0xe0 | payload[1]&0x1f}
+		}
+		if d.fua == nil {
+			break
+		}
+		d.fua = append(d.fua, payload[2:]...)
+		if end {
+			d.addNALU(d.fua)
+			d.fua = nil
+		}
+	}
+
+	if pkt.Marker {
+		done = d.appendDone(done)
+	}
+
+	return done
+}
+
+func (d *h264Depacketizer) appendDone(done []*h264AccessUnit) []*h264AccessUnit {
+	au := d.au
+	d.au = nil
+	if len(au.nalus) == 0 {
+		return done
+	}
+	return append(done, au)
+}
+
+func (d *h264Depacketizer) addNALU(nalu []byte) {
+	switch nalu[0] & 0x1f {
+	case naluTypeAUD:
+		return
+	case naluTypeIDR:
+		d.au.keyframe = true
+	}
+	d.au.nalus = append(d.au.nalus, nalu)
+}
+
+// bitReader reads exp-golomb coded fields of a rbsp
+type bitReader struct {
+	buf []byte
+	pos int
+}
+
+func (r *bitReader) bit() (uint, error) {
+	if r.pos >= len(r.buf)*8 {
+		return 0, errSPSTruncated
+	}
+	b := uint(r.buf[r.pos/8]>>(7-uint(r.pos%8))) & 1
+	r.pos++
+	return b, nil
+}
+
+func (r *bitReader) bits(n int) (uint, error) {
+	var v uint
+	for i := 0; i < n; i++ {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<1 | b
+	}
+	return v, nil
+}
+
+func (r *bitReader) ue() (uint, error) {
+	zeros := 0
+	for {
+		b, err := r.bit()
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+	}
+	v, err := r.bits(zeros)
+	return (1<<uint(zeros) - 1) + v, err
+}
+
+func (r *bitReader) se() (int, error) {
+	v, err := r.ue()
+	if v%2 == 0 {
+		return -int(v / 2), err
+	}
+	return int(v+1) / 2, err
+}
+
+// h264Resolution parses the picture size of a sequence parameter set
+func h264Resolution(sps []byte) (width, height int, err error) {
+	// strip emulation prevention bytes
+	rbsp := make([]byte, 0, len(sps))
+	for i := 0; i < len(sps); i++ {
+		if i >= 2 && sps[i] == 3 && sps[i-1] == 0 && sps[i-2] == 0 {
+			continue
+		}
+		rbsp = append(rbsp, sps[i])
+	}
+	if len(rbsp) < 4 {
+		return 0, 0, errSPSTruncated
+	}
+
+	r := &bitReader{buf: rbsp[4:]}
+	profile := rbsp[1]
+	if _, err = r.ue(); err != nil { // seq_parameter_set_id
+		return
+	}
+
+	chromaFormat := uint(1)
+	switch profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormat, err = r.ue(); err != nil {
+			return
+		}
+		if chromaFormat == 3 {
+			if _, err = r.bit(); err != nil { // separate_colour_plane_flag
+				return
+			}
+		}
+		if _, err = r.ue(); err != nil { // bit_depth_luma_minus8
+			return
+		}
+		if _, err = r.ue(); err != nil { // bit_depth_chroma_minus8
+			return
+		}
+		if _, err = r.bit(); err != nil { // qpprime_y_zero_transform_bypass_flag
+			return
+		}
+		var scaling uint
+		if scaling, err = r.bit(); err != nil {
+			return
+		}
+		if scaling == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				var present uint
+				if present, err = r.bit(); err != nil {
+					return
+				}
+				if present == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						var delta int
+						if delta, err = r.se(); err != nil {
+							return
+						}
+						next = (last + delta + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	if _, err = r.ue(); err != nil { // log2_max_frame_num_minus4
+		return
+	}
+	var pocType uint
+	if pocType, err = r.ue(); err != nil {
+		return
+	}
+	switch pocType {
+	case 0:
+		if _, err = r.ue(); err != nil {
+			return
+		}
+	case 1:
+		if _, err = r.bit(); err != nil {
+			return
+		}
+		if _, err = r.se(); err != nil {
+			return
+		}
+		if _, err = r.se(); err != nil {
+			return
+		}
+		var cycle uint
+		if cycle, err = r.ue(); err != nil {
+			return
+		}
+		for i := uint(0); i < cycle; i++ {
+			if _, err = r.se(); err != nil {
+				return
+			}
+		}
+	}
+
+	if _, err = r.ue(); err != nil { // max_num_ref_frames
+		return
+	}
+	if _, err = r.bit(); err != nil { // gaps_in_frame_num_value_allowed_flag
+		return
+	}
+
+	var mbWidth, mbHeight, frameMbsOnly uint
+	if mbWidth, err = r.ue(); err != nil {
+		return
+	}
+	if mbHeight, err = r.ue(); err != nil {
+		return
+	}
+	if frameMbsOnly, err = r.bit(); err != nil {
+		return
+	}
+	if frameMbsOnly == 0 {
+		if _, err = r.bit(); err != nil { // mb_adaptive_frame_field_flag
+			return
+		}
+	}
+	if _, err = r.bit(); err != nil { // direct_8x8_inference_flag
+		return
+	}
+
+	width = int(mbWidth+1) * 16
+	height = int(2-frameMbsOnly) * int(mbHeight+1) * 16
+
+	var cropping uint
+	if cropping, err = r.bit(); err != nil {
+		return
+	}
+	if cropping == 1 {
+		var left, right, top, bottom uint
+		if left, err = r.ue(); err != nil {
+			return
+		}
+		if right, err = r.ue(); err != nil {
+			return
+		}
+		if top, err = r.ue(); err != nil {
+			return
+		}
+		if bottom, err = r.ue(); err != nil {
+			return
+		}
+		cropX, cropY := 2, 2*int(2-frameMbsOnly)
+		if chromaFormat == 0 || chromaFormat == 3 {
+			cropX, cropY = 1, int(2-frameMbsOnly)
+		}
+		width -= cropX * int(left+right)
+		height -= cropY * int(top+bottom)
+	}
+
+	return width, height, nil
+}
@@ -0,0 +1,667 @@
+package sfu
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hlsSenderID = "hls"
+
+	defaultHLSSegmentDuration = 2 * time.Second
+	defaultHLSPartDuration    = 500 * time.Millisecond
+	defaultHLSSegments        = 6
+
+	// parts are listed for the segments within three target durations
+	hlsPartSegments = 2
+)
+
+var (
+	// ErrHLSNotFound is returned when a playlist, segment or part does not exist
+	ErrHLSNotFound = errors.New("hls resource not found")
+	// ErrHLSBadRequest is returned when a blocking request is too far in the future
+	ErrHLSBadRequest = errors.New("hls request too far ahead")
+)
+
+// HLSConfig represents options of an hls stream
+type HLSConfig struct {
+	SegmentDuration time.Duration
+	PartDuration    time.Duration
+	// Segments kept in the playlist
+	Segments int
+}
+
+// HLSStream serves the h264 and opus routers of a session over (low latency) hls
+type HLSStream struct {
+	mu      sync.RWMutex
+	session *Session
+	config  HLSConfig
+	stop    bool
+	senders map[string]*HLSSender
+}
+
+// newHLSStream creates a new hls stream of a session, routers are attached by the session
+func newHLSStream(session *Session, cfg HLSConfig) *HLSStream {
+	if cfg.SegmentDuration <= 0 {
+		cfg.SegmentDuration = defaultHLSSegmentDuration
+	}
+	if cfg.PartDuration <= 0 {
+		cfg.PartDuration = defaultHLSPartDuration
+	}
+	if cfg.Segments <= 0 {
+		cfg.Segments = defaultHLSSegments
+	}
+
+	s := &HLSStream{
+		session: session,
+		config:  cfg,
+		senders: make(map[string]*HLSSender),
+	}
+
+	return s
+}
+
+// attach an hls sender to a router if its codec can be muxed
+func (s *HLSStream) attach(router *Router) {
+	codec := router.Track().Codec()
+	if !strings.EqualFold(codec.Name, webrtc.H264) && !strings.EqualFold(codec.Name, webrtc.Opus) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop {
+		return
+	}
+
+	id := router.Track().ID()
+	if _, ok := s.senders[id]; ok {
+		return
+	}
+
+	sender := NewHLSSender(router.Track(), s.config)
+	sender.OnClose(func() {
+		s.mu.Lock()
+		if s.senders[id] == sender {
+			delete(s.senders, id)
+		}
+		s.mu.Unlock()
+	})
+	s.senders[id] = sender
+
+	router.AddSender(hlsSenderID, sender)
+}
+
+// Sender returns the hls sender of a track
+func (s *HLSStream) Sender(trackID string) *HLSSender {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.senders[trackID]
+}
+
+// MasterPlaylist lists a variant for each video track with all audio tracks as alternatives
+func (s *HLSStream) MasterPlaylist() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var (
+		b      strings.Builder
+		audio  []*HLSSender
+		videos []*HLSSender
+	)
+	for _, sender := range s.senders {
+		if !sender.ready() {
+			continue
+		}
+		if sender.video {
+			videos = append(videos, sender)
+		} else {
+			audio = append(audio, sender)
+		}
+	}
+
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	for i, a := range audio {
+		def := "NO"
+		if i == 0 {
+			def = "YES"
+		}
+		fmt.Fprintf(&b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"%s\",DEFAULT=%s,AUTOSELECT=YES,URI=\"%s/playlist.m3u8\"\n",
+			a.track.ID(), def, url.PathEscape(a.track.ID()))
+	}
+
+	for _, v := range videos {
+		codecs, width, height := v.variant()
+		if len(audio) > 0 {
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=%dx%d,CODECS=\"%s,opus\",AUDIO=\"audio\"\n",
+				width, height, codecs)
+		} else {
+			fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=%dx%d,CODECS=\"%s\"\n",
+				width, height, codecs)
+		}
+		fmt.Fprintf(&b, "%s/playlist.m3u8\n", url.PathEscape(v.track.ID()))
+	}
+
+	if len(videos) == 0 && len(audio) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS=\"opus\"\n%s/playlist.m3u8\n", url.PathEscape(audio[0].track.ID()))
+	}
+
+	return b.String()
+}
+
+// Close stops the stream and detaches its senders
+func (s *HLSStream) Close() {
+	s.mu.Lock()
+	s.stop = true
+	senders := s.senders
+	s.senders = make(map[string]*HLSSender)
+	s.mu.Unlock()
+
+	for id := range senders {
+		if router := s.session.GetRouter(id); router != nil {
+			router.RemoveSender(hlsSenderID)
+		}
+	}
+}
+
+type hlsPart struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+type hlsSegment struct {
+	msn      int
+	parts    []*hlsPart
+	duration time.Duration
+	complete bool
+}
+
+// HLSSender represents a Sender which muxes a track into fmp4 hls segments
+type HLSSender struct {
+	mu       sync.RWMutex
+	track    *webrtc.Track
+	config   HLSConfig
+	video    bool
+	stop     bool
+	sendChan chan *rtp.Packet
+	rtcpCh   chan rtcp.Packet
+
+	depacketizer h264Depacketizer
+	sps, pps     []byte
+	codecs       string
+	width        int
+	height       int
+	init         []byte
+	lastPLI      time.Time
+
+	lastTS  uint32
+	pts     int64
+	lastDTS int64
+	started bool
+	// presentation times of the samples without a decode time, sorted
+	times []int64
+	// next waits for its decode time, pending for its duration
+	next     *fmp4Sample
+	pending  *fmp4Sample
+	samples  []fmp4Sample
+	fragSeq  uint32
+	segments []*hlsSegment
+	current  *hlsSegment
+	// updated is closed and replaced whenever a part is added
+	updated        chan struct{}
+	onCloseHandler func()
+	counter        rtpCounter
+}
+
+// NewHLSSender creates a new hls sender of track
+func NewHLSSender(track *webrtc.Track, cfg HLSConfig) *HLSSender {
+	s := &HLSSender{
+		track:    track,
+		config:   cfg,
+		video:    track.Kind() == webrtc.RTPCodecTypeVideo,
+		sendChan: make(chan *rtp.Packet, maxSize),
+		rtcpCh:   make(chan rtcp.Packet, maxSize),
+		updated:  make(chan struct{}),
+	}
+
+	if !s.video {
+		channels := track.Codec().Channels
+		if channels == 0 {
+			channels = 2
+		}
+		s.init = fmp4Init(false, track.Codec().ClockRate, 0, 0, fmp4OpusSampleEntry(channels, track.Codec().ClockRate))
+	}
+
+	go s.mux()
+	if s.video {
+		go s.keyframeLoop()
+	}
+
+	return s
+}
+
+// OnClose handler called when the sender is closed
+func (s *HLSSender) OnClose(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onCloseHandler = f
+}
+
+// ReadRTCP read rtcp packet
+func (s *HLSSender) ReadRTCP() (rtcp.Packet, error) {
+	pkt, ok := <-s.rtcpCh
+	if !ok {
+		return nil, errChanClosed
+	}
+	return pkt, nil
+}
+
+// WriteRTP queues a packet for muxing, packets are dropped when muxing falls behind
+func (s *HLSSender) WriteRTP(pkt *rtp.Packet) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stop {
+		return
+	}
+
+	select {
+	case s.sendChan <- pkt:
+	default:
+		logrus.Debugf("hls sender %s queue full", s.track.ID())
+		countDropped(DropHLS)
+	}
+}
+
+// Close sender
+func (s *HLSSender) Close() {
+	s.mu.Lock()
+	if s.stop {
+		s.mu.Unlock()
+		return
+	}
+	s.stop = true
+	close(s.sendChan)
+	close(s.rtcpCh)
+	close(s.updated)
+	handler := s.onCloseHandler
+	s.mu.Unlock()
+
+	if handler != nil {
+		handler()
+	}
+}
+
+// Init returns the initialization segment once codec parameters are known
+func (s *HLSSender) Init() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.init == nil {
+		return nil, ErrHLSNotFound
+	}
+	return s.init, nil
+}
+
+// Playlist returns the media playlist. When msn is not negative the request blocks
+// until the segment, or its part when part is not negative, is available.
+func (s *HLSSender) Playlist(ctx context.Context, msn, part int) (string, error) {
+	if msn >= 0 {
+		if err := s.wait(ctx, msn, part); err != nil {
+			return "", err
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.segments) == 0 && s.current == nil {
+		return "", ErrHLSNotFound
+	}
+
+	target := s.config.SegmentDuration
+	for _, seg := range s.segments {
+		if seg.duration > target {
+			target = seg.duration
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target.Seconds())))
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*s.config.PartDuration.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", s.config.PartDuration.Seconds())
+
+	first := s.current
+	if len(s.segments) > 0 {
+		first = s.segments[0]
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", first.msn)
+	b.WriteString("#EXT-X-MAP:URI=\"init.mp4\"\n")
+
+	for i, seg := range s.segments {
+		if i >= len(s.segments)-hlsPartSegments {
+			writeParts(&b, seg)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg%d.m4s\n", seg.duration.Seconds(), seg.msn)
+	}
+
+	if s.current != nil {
+		writeParts(&b, s.current)
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.m4s\"\n", s.current.msn, len(s.current.parts))
+	}
+
+	return b.String(), nil
+}
+
+func writeParts(b *strings.Builder, seg *hlsSegment) {
+	for i, p := range seg.parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"part%d.%d.m4s\"", p.duration.Seconds(), seg.msn, i)
+		if p.independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
+
+// Segment returns a complete media segment
+func (s *HLSSender) Segment(msn int) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, seg := range s.segments {
+		if seg.msn == msn {
+			bufs := make([][]byte, 0, len(seg.parts))
+			for _, p := range seg.parts {
+				bufs = append(bufs, p.data)
+			}
+			return concat(bufs...), nil
+		}
+	}
+	return nil, ErrHLSNotFound
+}
+
+// Part returns a partial segment, blocking when it is the next part to be muxed
+func (s *HLSSender) Part(ctx context.Context, msn, part int) ([]byte, error) {
+	if err := s.wait(ctx, msn, part); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	segs := s.segments
+	if s.current != nil {
+		segs = append(segs[:len(segs):len(segs)], s.current)
+	}
+	for _, seg := range segs {
+		if seg.msn == msn && part < len(seg.parts) {
+			return seg.parts[part].data, nil
+		}
+	}
+	return nil, ErrHLSNotFound
+}
+
+// wait blocks until the segment msn, or its part when part is not negative, is available
+func (s *HLSSender) wait(ctx context.Context, msn, part int) error {
+	for {
+		s.mu.RLock()
+		if s.stop {
+			s.mu.RUnlock()
+			return ErrHLSNotFound
+		}
+
+		next := 0
+		if s.current != nil {
+			next = s.current.msn
+		} else if len(s.segments) > 0 {
+			next = s.segments[len(s.segments)-1].msn + 1
+		}
+
+		switch {
+		case msn < next:
+			s.mu.RUnlock()
+			return nil
+		case msn > next+1:
+			s.mu.RUnlock()
+			return ErrHLSBadRequest
+		case msn == next && part >= 0 && s.current != nil && part < len(s.current.parts):
+			s.mu.RUnlock()
+			return nil
+		}
+
+		updated := s.updated
+		s.mu.RUnlock()
+
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (s *HLSSender) ready() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.init != nil && len(s.segments) > 0
+}
+
+// variant returns the rfc 6381 codec string and resolution of an h264 track
+func (s *HLSSender) variant() (string, int, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.codecs, s.width, s.height
+}
+
+// keyframeLoop requests keyframes until the first segment can be started
+func (s *HLSSender) keyframeLoop() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	for {
+		s.mu.RLock()
+		if s.stop || s.current != nil {
+			s.mu.RUnlock()
+			return
+		}
+		s.requestKeyframe()
+		s.mu.RUnlock()
+
+		<-t.C
+	}
+}
+
+// requestKeyframe sends a pli to the publisher, the caller holds the lock
+func (s *HLSSender) requestKeyframe() {
+	select {
+	case s.rtcpCh <- &rtcp.PictureLossIndication{MediaSSRC: s.track.SSRC()}:
+	default:
+	}
+}
+
+func (s *HLSSender) mux() {
+	for pkt := range s.sendChan {
+		s.counter.add(pkt)
+		if !s.video {
+			s.addSample(pkt.Timestamp, append([]byte{}, pkt.Payload...), true)
+			continue
+		}
+
+		for _, au := range s.depacketizer.push(pkt) {
+			s.addAccessUnit(au)
+		}
+	}
+}
+
+func (s *HLSSender) addAccessUnit(au *h264AccessUnit) {
+	var size int
+	for _, nalu := range au.nalus {
+		switch nalu[0] & 0x1f {
+		case naluTypeSPS:
+			s.sps = nalu
+		case naluTypePPS:
+			s.pps = nalu
+		}
+		size += 4 + len(nalu)
+	}
+
+	if s.init == nil {
+		if !au.keyframe || s.sps == nil || s.pps == nil {
+			return
+		}
+
+		width, height, err := h264Resolution(s.sps)
+		if err != nil {
+			logrus.Errorf("hls sender %s sps err: %v", s.track.ID(), err)
+			return
+		}
+
+		s.mu.Lock()
+		s.codecs = fmt.Sprintf("avc1.%02x%02x%02x", s.sps[1], s.sps[2], s.sps[3])
+		s.width, s.height = width, height
+		s.init = fmp4Init(true, s.track.Codec().ClockRate, width, height, fmp4AVCSampleEntry(s.sps, s.pps, width, height))
+		s.mu.Unlock()
+	}
+
+	// length prefixed nal units
+	data := make([]byte, 0, size)
+	for _, nalu := range au.nalus {
+		data = append(data, be32(uint32(len(nalu)))...)
+		data = append(data, nalu...)
+	}
+
+	s.addSample(au.timestamp, data, au.keyframe)
+}
+
+// addSample queues samples until their decode time and duration are known.
+// The rtp timestamp is the presentation time, publishers sending b-frames
+// reorder it, decode times are taken from the presentation times sorted one
+// sample ahead and the difference is written as composition offset
+func (s *HLSSender) addSample(ts uint32, data []byte, keyframe bool) {
+	if !s.started {
+		s.started = true
+		s.lastTS = ts
+		s.lastDTS = -1
+	}
+	s.pts += int64(int32(ts - s.lastTS))
+	s.lastTS = ts
+
+	i := sort.Search(len(s.times), func(i int) bool { return s.times[i] > s.pts })
+	s.times = append(s.times, 0)
+	copy(s.times[i+1:], s.times[i:])
+	s.times[i] = s.pts
+
+	sample := &fmp4Sample{data: data, pts: s.pts, keyframe: keyframe}
+	if s.next != nil {
+		// decode times must increase, even when frames of a b-frame pyramid
+		// are reordered further than one sample
+		dts := s.times[0]
+		s.times = s.times[1:]
+		if dts <= s.lastDTS {
+			dts = s.lastDTS + 1
+		}
+		s.lastDTS = dts
+		s.next.dts = dts
+
+		if s.pending != nil {
+			s.pending.duration = uint32(dts - s.pending.dts)
+			s.segment(*s.pending)
+		}
+		s.pending = s.next
+	}
+	s.next = sample
+}
+
+// segment cuts parts at the part duration and segments at the segment
+// duration, video segments always start with a keyframe
+func (s *HLSSender) segment(sample fmp4Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stop {
+		return
+	}
+
+	if s.current == nil {
+		if s.video && !sample.keyframe {
+			return
+		}
+		s.current = &hlsSegment{}
+		if len(s.segments) > 0 {
+			s.current.msn = s.segments[len(s.segments)-1].msn + 1
+		}
+	}
+
+	clock := time.Duration(s.track.Codec().ClockRate)
+	var pending time.Duration
+	if len(s.samples) > 0 {
+		pending = time.Duration(sample.dts-s.samples[0].dts) * time.Second / clock
+	}
+
+	if s.video && !sample.keyframe && s.current.duration+pending >= 2*s.config.SegmentDuration &&
+		time.Since(s.lastPLI) > s.config.SegmentDuration {
+		// keyframe interval of the publisher is too long for the segment duration
+		s.lastPLI = time.Now()
+		s.requestKeyframe()
+	}
+
+	if s.current.duration+pending >= s.config.SegmentDuration && (!s.video || sample.keyframe) {
+		s.flushPart()
+		s.current.complete = true
+		s.segments = append(s.segments, s.current)
+		if len(s.segments) > s.config.Segments {
+			s.segments = s.segments[len(s.segments)-s.config.Segments:]
+		}
+		s.current = &hlsSegment{msn: s.current.msn + 1}
+	} else if pending >= s.config.PartDuration {
+		s.flushPart()
+	}
+
+	s.samples = append(s.samples, sample)
+}
+
+// flushPart writes the queued samples as a part of the current segment
+func (s *HLSSender) flushPart() {
+	if len(s.samples) == 0 {
+		return
+	}
+
+	var duration int64
+	for _, sample := range s.samples {
+		duration += int64(sample.duration)
+	}
+
+	s.fragSeq++
+	part := &hlsPart{
+		data:        fmp4Fragment(s.fragSeq, s.samples),
+		duration:    time.Duration(duration) * time.Second / time.Duration(s.track.Codec().ClockRate),
+		independent: s.samples[0].keyframe,
+	}
+	s.current.parts = append(s.current.parts, part)
+	s.current.duration += part.duration
+	s.samples = nil
+
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+func (s *HLSSender) stats() SenderStats {
+	stats := senderStats(s.track.PayloadType(), &s.counter, &feedbackCounter{})
+	s.mu.RLock()
+	stats.Segments = len(s.segments)
+	s.mu.RUnlock()
+	return stats
+}
@@ -0,0 +1,60 @@
+package sfu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// TestHLSCompositionOffsets feeds frames of a publisher sending b-frames in
+// decode order, decode times must increase and presentation times be kept
+func TestHLSCompositionOffsets(t *testing.T) {
+	track, err := webrtc.NewTrack(webrtc.DefaultPayloadTypeH264, 1, "video", "video", webrtc.NewRTPH264Codec(webrtc.DefaultPayloadTypeH264, 90000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewHLSSender(track, HLSConfig{SegmentDuration: time.Minute, PartDuration: time.Minute, Segments: 1})
+	defer s.Close()
+
+	// I P B B P B B P B B, presentation order in frames of 3000
+	frames := []int64{0, 3, 1, 2, 6, 4, 5, 9, 7, 8}
+	for i, frame := range frames {
+		s.addSample(uint32(frame*3000), []byte{byte(i)}, i == 0)
+	}
+
+	// the last two frames wait for their decode time and duration
+	if len(s.samples) != len(frames)-2 {
+		t.Fatalf("%d samples queued, want %d", len(s.samples), len(frames)-2)
+	}
+	for i, sample := range s.samples {
+		if want := frames[i] * 3000; sample.pts != want {
+			t.Errorf("sample %d pts %d, want %d", i, sample.pts, want)
+		}
+		if want := int64(i) * 3000; sample.dts != want {
+			t.Errorf("sample %d dts %d, want %d", i, sample.dts, want)
+		}
+		if sample.duration != 3000 {
+			t.Errorf("sample %d duration %d, want 3000", i, sample.duration)
+		}
+	}
+
+	trun := func(frag []byte) (uint8, uint32) {
+		i := bytes.Index(frag, []byte("trun"))
+		if i < 0 {
+			t.Fatal("no trun box")
+		}
+		return frag[i+4], binary.BigEndian.Uint32(frag[i+4:]) & 0xffffff
+	}
+
+	version, flags := trun(fmp4Fragment(1, s.samples))
+	if version != 1 || flags&0x000800 == 0 {
+		t.Fatalf("reordered trun version %d flags %06x, want composition offsets", version, flags)
+	}
+	version, flags = trun(fmp4Fragment(2, s.samples[:1]))
+	if version != 0 || flags != 0x000701 {
+		t.Fatalf("trun version %d flags %06x, want no composition offsets", version, flags)
+	}
+}
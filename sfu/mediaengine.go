@@ -62,6 +62,8 @@ func (e *MediaEngine) PopulateFromSDP(sd webrtc.SessionDescription) error {
 			switch {
 			case strings.EqualFold(payloadCodec.Name, webrtc.Opus):
 				codec = webrtc.NewRTPOpusCodec(payloadType, payloadCodec.ClockRate)
+			case strings.EqualFold(payloadCodec.Name, webrtc.PCMU):
+				codec = webrtc.NewRTPPCMUCodec(payloadType, payloadCodec.ClockRate)
 			case strings.EqualFold(payloadCodec.Name, webrtc.VP8):
 				codec = webrtc.NewRTPVP8CodecExt(payloadType, payloadCodec.ClockRate, rtcpfb, payloadCodec.Fmtp)
 			case strings.EqualFold(payloadCodec.Name, webrtc.VP9):
@@ -83,6 +85,11 @@ func (e *MediaEngine) PopulateFromSDP(sd webrtc.SessionDescription) error {
 		e.RegisterCodec(codec)
 	}
 
+	if len(e.GetCodecsByName(webrtc.PCMU)) == 0 {
+		codec := webrtc.NewRTPPCMUCodec(webrtc.DefaultPayloadTypePCMU, 8000)
+		e.RegisterCodec(codec)
+	}
+
 	if len(e.GetCodecsByName(webrtc.VP8)) == 0 {
 		codec := webrtc.NewRTPVP8CodecExt(webrtc.DefaultPayloadTypeVP8, 90000, rtcpfb, "")
 		e.RegisterCodec(codec)
@@ -100,3 +107,36 @@ func (e *MediaEngine) PopulateFromSDP(sd webrtc.SessionDescription) error {
 
 	return nil
 }
+
+// newRTPCodec creates a codec by name for tracks that are not negotiated over sdp,
+// using the same rtcp feedback as negotiated video tracks.
+func newRTPCodec(name string, payloadType uint8, clockRate uint32, fmtp string) (*webrtc.RTPCodec, error) {
+	switch {
+	case strings.EqualFold(name, webrtc.Opus):
+		if clockRate == 0 {
+			clockRate = 48000
+		}
+		return webrtc.NewRTPOpusCodec(payloadType, clockRate), nil
+	case strings.EqualFold(name, webrtc.PCMU):
+		if clockRate == 0 {
+			clockRate = 8000
+		}
+		return webrtc.NewRTPPCMUCodec(payloadType, clockRate), nil
+	case strings.EqualFold(name, webrtc.VP8):
+		if clockRate == 0 {
+			clockRate = videoClock
+		}
+		return webrtc.NewRTPVP8CodecExt(payloadType, clockRate, rtcpfb, fmtp), nil
+	case strings.EqualFold(name, webrtc.VP9):
+		if clockRate == 0 {
+			clockRate = videoClock
+		}
+		return webrtc.NewRTPVP9CodecExt(payloadType, clockRate, rtcpfb, fmtp), nil
+	case strings.EqualFold(name, webrtc.H264):
+		if clockRate == 0 {
+			clockRate = videoClock
+		}
+		return webrtc.NewRTPH264CodecExt(payloadType, clockRate, rtcpfb, fmtp), nil
+	}
+	return nil, errCodecNotSupported
+}
@@ -0,0 +1,169 @@
+package sfu
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v2"
+)
+
+// Queues packets are dropped from when their consumer falls behind
+const (
+	DropReceiver = "receiver"
+	DropRTSP     = "rtsp"
+	DropRelay    = "relay"
+	DropHLS      = "hls"
+)
+
+// Metrics are the counters and gauges of an sfu instance, counters are
+// totals since the process started
+type Metrics struct {
+	Sessions int `json:"sessions"`
+	// gauges by transport kind, track kind and sender kind
+	Transports map[string]int `json:"transports"`
+	Routers    map[string]int `json:"routers"`
+	Senders    map[string]int `json:"senders"`
+
+	RTPPacketsIn   uint64 `json:"rtpPacketsIn"`
+	RTPBytesIn     uint64 `json:"rtpBytesIn"`
+	RTPPacketsOut  uint64 `json:"rtpPacketsOut"`
+	RTPBytesOut    uint64 `json:"rtpBytesOut"`
+	RTCPPacketsIn  uint64 `json:"rtcpPacketsIn"`
+	RTCPPacketsOut uint64 `json:"rtcpPacketsOut"`
+	// NACKHits and NACKMisses are lookups of nacked packets in receiver buffers
+	NACKHits   uint64 `json:"nackHits"`
+	NACKMisses uint64 `json:"nackMisses"`
+	// Dropped packets by queue
+	Dropped map[string]uint64 `json:"dropped"`
+	// ICEStates counts the transitions of webrtc transports to each ice state
+	ICEStates map[string]uint64 `json:"iceStates"`
+	// SessionMetrics are only filled in when asked for
+	SessionMetrics []SessionMetrics `json:"sessionMetrics,omitempty"`
+}
+
+// SessionMetrics are the gauges of a session, bitrates in bits per second
+type SessionMetrics struct {
+	ID           string `json:"id"`
+	Participants int    `json:"participants"`
+	Tracks       int    `json:"tracks"`
+	Senders      int    `json:"senders"`
+	BitrateIn    uint64 `json:"bitrateIn"`
+	BitrateOut   uint64 `json:"bitrateOut"`
+}
+
+// counters of the process, accessed atomically
+var counters struct {
+	rtpPacketsIn, rtpBytesIn   uint64
+	rtpPacketsOut, rtpBytesOut uint64
+	rtcpIn, rtcpOut            uint64
+	nackHits, nackMisses       uint64
+
+	mu        sync.Mutex
+	dropped   map[string]uint64
+	iceStates map[webrtc.ICEConnectionState]uint64
+}
+
+func countDropped(queue string) {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+	if counters.dropped == nil {
+		counters.dropped = make(map[string]uint64)
+	}
+	counters.dropped[queue]++
+}
+
+func countICEState(state webrtc.ICEConnectionState) {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+	if counters.iceStates == nil {
+		counters.iceStates = make(map[webrtc.ICEConnectionState]uint64)
+	}
+	counters.iceStates[state]++
+}
+
+// Metrics of the sfu, per session gauges are included when sessions is set
+func (s *SFU) Metrics(sessions bool) Metrics {
+	m := Metrics{
+		Transports:     make(map[string]int),
+		Routers:        make(map[string]int),
+		Senders:        make(map[string]int),
+		RTPPacketsIn:   atomic.LoadUint64(&counters.rtpPacketsIn),
+		RTPBytesIn:     atomic.LoadUint64(&counters.rtpBytesIn),
+		RTPPacketsOut:  atomic.LoadUint64(&counters.rtpPacketsOut),
+		RTPBytesOut:    atomic.LoadUint64(&counters.rtpBytesOut),
+		RTCPPacketsIn:  atomic.LoadUint64(&counters.rtcpIn),
+		RTCPPacketsOut: atomic.LoadUint64(&counters.rtcpOut),
+		NACKHits:       atomic.LoadUint64(&counters.nackHits),
+		NACKMisses:     atomic.LoadUint64(&counters.nackMisses),
+		Dropped:        make(map[string]uint64),
+		ICEStates:      make(map[string]uint64),
+	}
+
+	counters.mu.Lock()
+	for queue, n := range counters.dropped {
+		m.Dropped[queue] = n
+	}
+	for state, n := range counters.iceStates {
+		m.ICEStates[state.String()] = n
+	}
+	counters.mu.Unlock()
+
+	s.mu.RLock()
+	all := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		all = append(all, session)
+	}
+	s.mu.RUnlock()
+
+	m.Sessions = len(all)
+	for _, session := range all {
+		session.mu.RLock()
+		transports := make([]Transport, 0, len(session.transports))
+		for _, t := range session.transports {
+			transports = append(transports, t)
+		}
+		participants := len(session.participants)
+		session.mu.RUnlock()
+
+		sm := SessionMetrics{ID: session.id, Participants: participants}
+		for _, t := range transports {
+			m.Transports[transportKind(t)]++
+			for _, router := range t.Routers() {
+				m.Routers[router.Track().Kind().String()]++
+				sm.Tracks++
+				for _, kind := range router.senderKinds() {
+					m.Senders[kind]++
+					sm.Senders++
+				}
+			}
+		}
+
+		if sessions {
+			for _, t := range session.Stats().Transports {
+				for _, router := range t.Routers {
+					sm.BitrateIn += router.Receiver.Bitrate
+					for _, sender := range router.Senders {
+						sm.BitrateOut += sender.Bitrate
+					}
+				}
+			}
+			m.SessionMetrics = append(m.SessionMetrics, sm)
+		}
+	}
+	sort.Slice(m.SessionMetrics, func(i, j int) bool {
+		return m.SessionMetrics[i].ID < m.SessionMetrics[j].ID
+	})
+	return m
+}
+
+// senderKinds lists the kind of each sender of the router
+func (r *Router) senderKinds() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	kinds := make([]string, 0, len(r.senders))
+	for _, sender := range r.senders {
+		kinds = append(kinds, senderKind(sender))
+	}
+	return kinds
+}
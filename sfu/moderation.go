@@ -0,0 +1,109 @@
+package sfu
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kick closes a transport of the session, webrtc peers are told the reason first
+func (r *Session) Kick(tid, reason string) error {
+	t := r.GetTransport(tid)
+	if t == nil {
+		return ErrParticipantNotFound
+	}
+
+	logrus.Infof("kick %s from session %s: %s", tid, r.id, reason)
+	return kick(t, reason)
+}
+
+// End closes every transport of the session and the session itself
+func (r *Session) End(reason string) {
+	logrus.Infof("end session %s: %s", r.id, reason)
+
+	r.StopHLS()
+
+	r.mu.RLock()
+	transports := make([]Transport, 0, len(r.transports))
+	for _, t := range r.transports {
+		transports = append(transports, t)
+	}
+	r.mu.RUnlock()
+
+	for _, t := range transports {
+		if err := kick(t, reason); err != nil {
+			logrus.Errorf("Error closing transport %s: %v", t.ID(), err)
+		}
+	}
+
+	// sessions without transports are not closed by the last one leaving
+	r.close()
+}
+
+// kickIdentity closes the transports of a participant identity
+func (r *Session) kickIdentity(identity, reason string) {
+	r.mu.RLock()
+	var transports []Transport
+	for tid, p := range r.participants {
+		if p.Identity == identity {
+			transports = append(transports, r.transports[tid])
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, t := range transports {
+		if err := kick(t, reason); err != nil {
+			logrus.Errorf("Error closing transport %s: %v", t.ID(), err)
+		}
+	}
+}
+
+func kick(t Transport, reason string) error {
+	if p, ok := t.(*WebRTCTransport); ok {
+		p.kicked(reason)
+	}
+	return t.Close()
+}
+
+// Ban kicks an identity from a session and rejects it joining again until the
+// ban expires. Bans outlive the session being closed when it empties.
+func (s *SFU) Ban(sid, identity string, d time.Duration, reason string) {
+	s.mu.Lock()
+	bans, ok := s.bans[sid]
+	if !ok {
+		bans = make(map[string]time.Time)
+		s.bans[sid] = bans
+	}
+	bans[identity] = time.Now().Add(d)
+	s.pruneBans(sid)
+	session := s.sessions[sid]
+	s.mu.Unlock()
+
+	logrus.Infof("ban %s from session %s for %s: %s", identity, sid, d, reason)
+
+	if session != nil {
+		session.kickIdentity(identity, reason)
+	}
+}
+
+// banned reports whether an identity is banned from a session
+func (s *SFU) banned(sid, identity string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneBans(sid)
+	_, ok := s.bans[sid][identity]
+	return ok
+}
+
+// pruneBans removes expired bans of a session, the caller holds the lock
+func (s *SFU) pruneBans(sid string) {
+	now := time.Now()
+	for identity, until := range s.bans[sid] {
+		if now.After(until) {
+			delete(s.bans[sid], identity)
+		}
+	}
+	if len(s.bans[sid]) == 0 {
+		delete(s.bans, sid)
+	}
+}
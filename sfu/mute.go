@@ -0,0 +1,163 @@
+package sfu
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+)
+
+// rtpMuter drops packets while muted and resumes video on a keyframe. Dropped
+// packets are removed from the sequence numbers so receivers don't take them
+// as lost. It is guarded by the lock of its owner.
+type rtpMuter struct {
+	codec        string
+	video        bool
+	muted        bool
+	waitKeyframe bool
+	dropping     bool
+	started      bool
+	offset       uint16
+	lastSN       uint16
+}
+
+func newRTPMuter(track *webrtc.Track) rtpMuter {
+	return rtpMuter{
+		codec: track.Codec().Name,
+		video: track.Kind() == webrtc.RTPCodecTypeVideo,
+	}
+}
+
+// setMuted reports whether the state changed and a keyframe is needed to resume
+func (m *rtpMuter) setMuted(muted bool) (changed, keyframe bool) {
+	if m.muted == muted {
+		return false, false
+	}
+	m.muted = muted
+	m.waitKeyframe = !muted && m.video
+	return true, m.waitKeyframe
+}
+
+// forward returns the packet to send, with its sequence number rewritten, or
+// false when it is dropped
+func (m *rtpMuter) forward(pkt *rtp.Packet) (*rtp.Packet, bool) {
+	if m.muted || m.waitKeyframe && !isKeyframe(m.codec, pkt.Payload) {
+		m.dropping = true
+		return nil, false
+	}
+	m.waitKeyframe = false
+
+	if m.dropping && m.started {
+		m.offset = pkt.SequenceNumber - m.lastSN - 1
+	}
+	m.dropping = false
+
+	sn := pkt.SequenceNumber - m.offset
+	if !m.started || sn-m.lastSN < 0x8000 {
+		m.lastSN = sn
+		m.started = true
+	}
+	if m.offset == 0 {
+		return pkt, true
+	}
+
+	out := *pkt
+	out.SequenceNumber = sn
+	return &out, true
+}
+
+// original returns the sequence number a forwarded packet was received with
+func (m *rtpMuter) original(sn uint16) uint16 {
+	return sn + m.offset
+}
+
+// isKeyframe reports whether a packet starts a keyframe, packets of codecs
+// that can't be inspected are taken as keyframes
+func isKeyframe(codec string, payload []byte) bool {
+	switch codec {
+	case webrtc.H264:
+		return h264Keyframe(payload)
+	case webrtc.VP8:
+		return vp8Keyframe(payload)
+	case webrtc.VP9:
+		return vp9Keyframe(payload)
+	}
+	return true
+}
+
+// h264Keyframe looks for an idr or sps nal unit, RFC 6184
+func h264Keyframe(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	switch naluType := payload[0] & 0x1f; naluType {
+	case naluTypeIDR, naluTypeSPS:
+		return true
+	case naluTypeSTAPA:
+		buf := payload[1:]
+		for len(buf) > 2 {
+			size := int(buf[0])<<8 | int(buf[1])
+			if size == 0 || len(buf) < size+2 {
+				return false
+			}
+			if t := buf[2] & 0x1f; t == naluTypeIDR || t == naluTypeSPS {
+				return true
+			}
+			buf = buf[size+2:]
+		}
+	case naluTypeFUA:
+		if len(payload) < 2 {
+			return false
+		}
+		start := payload[1]&0x80 != 0
+		return start && payload[1]&0x1f == naluTypeIDR
+	}
+	return false
+}
+
+// vp8Keyframe checks the first partition of a frame, RFC 7741
+func vp8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+
+	// start of partition 0
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return false
+		}
+		x := payload[1]
+		i++
+		if x&0x80 != 0 {
+			// picture id, 7 or 15 bits
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i++
+			}
+			i++
+		}
+		if x&0x40 != 0 {
+			i++
+		}
+		if x&0x30 != 0 {
+			i++
+		}
+	}
+
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+// vp9Keyframe checks for the start of a frame not predicted from others
+func vp9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	interPicture, start := payload[0]&0x40 != 0, payload[0]&0x08 != 0
+	return !interPicture && start
+}
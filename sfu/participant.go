@@ -0,0 +1,220 @@
+package sfu
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Session event types
+const (
+	EventParticipantJoined = "participantJoined"
+	EventParticipantLeft   = "participantLeft"
+	EventTrackPublished    = "trackPublished"
+	EventTrackUnpublished  = "trackUnpublished"
+	EventMetadataUpdated   = "metadataUpdated"
+	EventTrackMuted        = "trackMuted"
+	EventTrackUnmuted      = "trackUnmuted"
+	EventRoleChanged       = "roleChanged"
+	EventConnectionQuality = "connectionQuality"
+)
+
+// Role of a participant in a session
+type Role string
+
+// Participant roles
+const (
+	// RoleViewer may only subscribe, the tracks it offers are held
+	RoleViewer Role = "viewer"
+	// RolePresenter may subscribe and publish
+	RolePresenter Role = "presenter"
+	// RoleModerator may also act on the other participants
+	RoleModerator Role = "moderator"
+)
+
+// Valid reports whether the role is known
+func (r Role) Valid() bool {
+	return r == RoleViewer || r == RolePresenter || r == RoleModerator
+}
+
+// CanPublish reports whether tracks of the role are routed
+func (r Role) CanPublish() bool {
+	return r == RolePresenter || r == RoleModerator
+}
+
+// CanModerate reports whether the role may act on other participants
+func (r Role) CanModerate() bool {
+	return r == RoleModerator
+}
+
+// Participant is a member of a session, one per transport
+type Participant struct {
+	ID       string          `json:"id"`
+	Identity string          `json:"identity"`
+	Role     Role            `json:"role"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+	Tracks   []string        `json:"tracks"`
+	Muted    []string        `json:"muted,omitempty"`
+	// Quality of its connection, nil until first scored
+	Quality *ConnectionQuality `json:"quality,omitempty"`
+}
+
+// SessionEvent notifies the other participants of a session of a change
+type SessionEvent struct {
+	Type        string      `json:"-"`
+	Participant Participant `json:"participant"`
+	Track       string      `json:"track,omitempty"`
+	// Quality of connectionQuality events
+	Quality *ConnectionQuality `json:"quality,omitempty"`
+}
+
+// Roster returns the participants of the session
+func (r *Session) Roster() []Participant {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	roster := make([]Participant, 0, len(r.participants))
+	for _, p := range r.participants {
+		roster = append(roster, p.copy())
+	}
+	sort.Slice(roster, func(i, j int) bool {
+		return roster[i].ID < roster[j].ID
+	})
+	return roster
+}
+
+// UpdateMetadata replaces the metadata of the participant of a transport
+func (r *Session) UpdateMetadata(tid string, metadata json.RawMessage) error {
+	r.mu.Lock()
+	p, ok := r.participants[tid]
+	if !ok {
+		r.mu.Unlock()
+		return ErrParticipantNotFound
+	}
+	p.Metadata = metadata
+	event := SessionEvent{Type: EventMetadataUpdated, Participant: p.copy()}
+	r.mu.Unlock()
+
+	r.emit(tid, event)
+	return nil
+}
+
+// SetRole changes the role of a participant, promoting a viewer publishes the
+// tracks it offered and renegotiates
+func (r *Session) SetRole(tid string, role Role) error {
+	if !role.Valid() {
+		return ErrRoleInvalid
+	}
+
+	p, ok := r.GetTransport(tid).(*WebRTCTransport)
+	if !ok {
+		return ErrParticipantNotFound
+	}
+
+	r.mu.Lock()
+	participant, ok := r.participants[tid]
+	if !ok {
+		r.mu.Unlock()
+		return ErrParticipantNotFound
+	}
+	if participant.Role == role {
+		r.mu.Unlock()
+		return nil
+	}
+	participant.Role = role
+	event := SessionEvent{Type: EventRoleChanged, Participant: participant.copy()}
+	r.mu.Unlock()
+
+	p.setRole(role)
+	r.emit("", event)
+	return nil
+}
+
+// SetTrackMuted stops or resumes forwarding a track to all its subscribers,
+// the participants of the session are notified of the change
+func (r *Session) SetTrackMuted(trackID string, muted bool) error {
+	router := r.GetRouter(trackID)
+	if router == nil {
+		return ErrRouterNotFound
+	}
+	if !router.SetMuted(muted) {
+		return nil
+	}
+
+	typ := EventTrackUnmuted
+	r.mu.Lock()
+	participant, ok := r.participants[router.tid]
+	if ok {
+		participant.Muted = removeString(participant.Muted, trackID)
+		if muted {
+			typ = EventTrackMuted
+			participant.Muted = append(participant.Muted, trackID)
+		}
+	}
+	event := SessionEvent{Type: typ, Track: trackID}
+	if ok {
+		event.Participant = participant.copy()
+	}
+	r.mu.Unlock()
+
+	r.emit("", event)
+	return nil
+}
+
+// MuteParticipant stops or resumes forwarding all tracks of a participant
+func (r *Session) MuteParticipant(tid string, muted bool) error {
+	t := r.GetTransport(tid)
+	if t == nil {
+		return ErrParticipantNotFound
+	}
+
+	for _, router := range t.Routers() {
+		if err := r.SetTrackMuted(router.Track().ID(), muted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emit sends an event to the webrtc transports of the session except the
+// transport it originates from
+func (r *Session) emit(from string, event SessionEvent) {
+	r.timeline.event(r.id, event)
+
+	r.mu.RLock()
+	var peers []*WebRTCTransport
+	for tid, t := range r.transports {
+		if p, ok := t.(*WebRTCTransport); ok && tid != from {
+			peers = append(peers, p)
+		}
+	}
+	r.mu.RUnlock()
+
+	for _, p := range peers {
+		p.sessionEvent(event)
+	}
+}
+
+func (p *Participant) copy() Participant {
+	c := *p
+	c.Tracks = append([]string{}, p.Tracks...)
+	if p.Muted != nil {
+		c.Muted = append([]string{}, p.Muted...)
+	}
+	return c
+}
+
+func (p *Participant) removeTrack(id string) bool {
+	n := len(p.Tracks)
+	p.Tracks = removeString(p.Tracks, id)
+	p.Muted = removeString(p.Muted, id)
+	return len(p.Tracks) != n
+}
+
+func removeString(values []string, v string) []string {
+	for i, value := range values {
+		if value == v {
+			return append(values[:i], values[i+1:]...)
+		}
+	}
+	return values
+}
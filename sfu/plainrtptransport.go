@@ -0,0 +1,331 @@
+package sfu
+
+import (
+	"net"
+	"sync"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// udp receive buffer for a single rtp/rtcp datagram
+	receiveMTU = 1500
+)
+
+// PlainRTPTrack declares a track sent to a PlainRTPTransport
+type PlainRTPTrack struct {
+	ID          string
+	Label       string
+	Codec       string
+	PayloadType uint8
+	ClockRate   uint32
+	Fmtp        string
+	SSRC        uint32
+}
+
+// PlainRTPTransportConfig represents configuration options of a plain rtp transport
+type PlainRTPTransportConfig struct {
+	// IP to listen on, all interfaces when empty
+	IP string
+	// Port to listen on for rtp, an ephemeral port is used when 0
+	Port int
+	// RTCPMux receives rtcp on the rtp port instead of Port+1
+	RTCPMux bool
+	Tracks  []PlainRTPTrack
+}
+
+// PlainRTPTransport receives unencrypted rtp/rtcp over udp, e.g. from ffmpeg or gstreamer,
+// and publishes the declared tracks to its session
+type PlainRTPTransport struct {
+	id         string
+	mu         sync.RWMutex
+	stop       bool
+	session    *Session
+	conn       *net.UDPConn
+	rtcpConn   *net.UDPConn
+	remote     *net.UDPAddr
+	remoteRTCP *net.UDPAddr
+	tracks     map[uint32]*webrtc.Track
+	routers    map[uint32]*Router
+}
+
+// NewPlainRTPTransport creates a new PlainRTPTransport listening for the declared tracks
+func NewPlainRTPTransport(session *Session, cfg PlainRTPTransportConfig) (*PlainRTPTransport, error) {
+	tracks := make(map[uint32]*webrtc.Track)
+	for _, t := range cfg.Tracks {
+		if t.SSRC == 0 {
+			return nil, errTrackNotDeclared
+		}
+
+		codec, err := newRTPCodec(t.Codec, t.PayloadType, t.ClockRate, t.Fmtp)
+		if err != nil {
+			return nil, err
+		}
+
+		id, label := t.ID, t.Label
+		if id == "" {
+			id = cuid.New()
+		}
+		if label == "" {
+			label = id
+		}
+
+		track, err := webrtc.NewTrack(t.PayloadType, t.SSRC, id, label, codec)
+		if err != nil {
+			return nil, err
+		}
+		tracks[t.SSRC] = track
+	}
+
+	ip := net.ParseIP(cfg.IP)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: cfg.Port})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &PlainRTPTransport{
+		id:      cuid.New(),
+		session: session,
+		conn:    conn,
+		tracks:  tracks,
+		routers: make(map[uint32]*Router),
+	}
+
+	if !cfg.RTCPMux {
+		rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip, Port: p.Port() + 1})
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		p.rtcpConn = rtcpConn
+		go p.readLoop(rtcpConn)
+	}
+
+	session.AddTransport(p)
+
+	go p.readLoop(conn)
+
+	return p, nil
+}
+
+// ID of transport
+func (p *PlainRTPTransport) ID() string {
+	return p.id
+}
+
+// Port the transport receives rtp on
+func (p *PlainRTPTransport) Port() int {
+	return p.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// RTCPPort the transport receives rtcp on
+func (p *PlainRTPTransport) RTCPPort() int {
+	if p.rtcpConn == nil {
+		return p.Port()
+	}
+	return p.rtcpConn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Routers returns routers for this transport
+func (p *PlainRTPTransport) Routers() map[uint32]*Router {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	// routers are created as their first packet arrives
+	routers := make(map[uint32]*Router, len(p.routers))
+	for ssrc, router := range p.routers {
+		routers[ssrc] = router
+	}
+	return routers
+}
+
+// GetRouter returns router with ssrc
+func (p *PlainRTPTransport) GetRouter(ssrc uint32) *Router {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.routers[ssrc]
+}
+
+// NewSender is not supported, plain rtp transports only ingest tracks
+func (p *PlainRTPTransport) NewSender(track *webrtc.Track) (Sender, error) {
+	return nil, errMethodNotSupported
+}
+
+// Close transport
+func (p *PlainRTPTransport) Close() error {
+	p.mu.Lock()
+	if p.stop {
+		p.mu.Unlock()
+		return nil
+	}
+	p.stop = true
+	routers := make([]*Router, 0, len(p.routers))
+	for _, router := range p.routers {
+		routers = append(routers, router)
+	}
+	p.mu.Unlock()
+
+	// routers remove their tracks from the session when closed, which locks it
+	for _, router := range routers {
+		router.Close()
+	}
+
+	p.session.RemoveTransport(p.id)
+
+	if p.rtcpConn != nil {
+		_ = p.rtcpConn.Close()
+	}
+	return p.conn.Close()
+}
+
+func (p *PlainRTPTransport) readLoop(conn *net.UDPConn) {
+	buf := make([]byte, receiveMTU)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			p.mu.RLock()
+			stop := p.stop
+			p.mu.RUnlock()
+			if !stop {
+				logrus.Errorf("plain rtp read err: %v", err)
+				_ = p.Close()
+			}
+			return
+		}
+
+		if n < 2 {
+			continue
+		}
+
+		// rtcp packet types are 192-223 when muxed with rtp, RFC 5761
+		if pt := buf[1]; pt >= 192 && pt <= 223 {
+			p.mu.Lock()
+			p.remoteRTCP = addr
+			p.mu.Unlock()
+			p.handleRTCP(buf[:n])
+			continue
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(append([]byte{}, buf[:n]...)); err != nil {
+			logrus.Debugf("plain rtp unmarshal err: %v", err)
+			continue
+		}
+
+		p.mu.Lock()
+		p.remote = addr
+		if p.rtcpConn == nil {
+			p.remoteRTCP = addr
+		} else if p.remoteRTCP == nil {
+			p.remoteRTCP = &net.UDPAddr{IP: addr.IP, Port: addr.Port + 1, Zone: addr.Zone}
+		}
+		p.mu.Unlock()
+
+		router := p.router(pkt.SSRC)
+		if router == nil {
+			continue
+		}
+		router.receiver.(*PlainRTPReceiver).push(pkt)
+	}
+}
+
+// router returns the router of a declared track, creating it on the first packet
+func (p *PlainRTPTransport) router(ssrc uint32) *Router {
+	p.mu.Lock()
+	if p.stop {
+		p.mu.Unlock()
+		return nil
+	}
+
+	if router, ok := p.routers[ssrc]; ok {
+		p.mu.Unlock()
+		return router
+	}
+
+	track, ok := p.tracks[ssrc]
+	if !ok {
+		p.mu.Unlock()
+		logrus.Debugf("plain rtp transport %s got undeclared ssrc %d", p.id, ssrc)
+		return nil
+	}
+
+	recv := NewPlainRTPReceiver(track)
+	router := NewRouter(p.id, recv)
+	p.routers[ssrc] = router
+	p.mu.Unlock()
+
+	logrus.Debugf("Created router %s %d", p.id, ssrc)
+
+	go p.sendRTCP(recv)
+	p.session.AddRouter(router)
+
+	return router
+}
+
+func (p *PlainRTPTransport) handleRTCP(buf []byte) {
+	pkts, err := rtcp.Unmarshal(buf)
+	if err != nil {
+		logrus.Debugf("plain rtcp unmarshal err: %v", err)
+		return
+	}
+
+	for _, pkt := range pkts {
+		bye, ok := pkt.(*rtcp.Goodbye)
+		if !ok {
+			continue
+		}
+
+		for _, ssrc := range bye.Sources {
+			p.mu.Lock()
+			router := p.routers[ssrc]
+			delete(p.routers, ssrc)
+			p.mu.Unlock()
+
+			if router != nil {
+				logrus.Debugf("plain rtp transport %s got bye for ssrc %d", p.id, ssrc)
+				router.Close()
+			}
+		}
+	}
+}
+
+func (p *PlainRTPTransport) sendRTCP(recv Receiver) {
+	for {
+		pkt, err := recv.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		p.mu.RLock()
+		addr := p.remoteRTCP
+		conn := p.rtcpConn
+		p.mu.RUnlock()
+
+		if addr == nil {
+			continue
+		}
+		if conn == nil {
+			conn = p.conn
+		}
+
+		buf, err := pkt.Marshal()
+		if err != nil {
+			logrus.Errorf("Error marshaling RTCP %s", err)
+			continue
+		}
+
+		logrus.Tracef("sendRTCP %v", pkt)
+		if _, err := conn.WriteToUDP(buf, addr); err != nil {
+			logrus.Errorf("Error writing RTCP %s", err)
+		}
+	}
+}
+
+func (p *PlainRTPTransport) stats() TransportStats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return TransportStats{ID: p.id, Kind: transportKind(p), Port: p.Port(), Routers: routerStats(p.routers)}
+}
@@ -0,0 +1,263 @@
+package sfu
+
+import "time"
+
+// Connection quality levels
+const (
+	QualityExcellent = "excellent"
+	QualityGood      = "good"
+	QualityFair      = "fair"
+	QualityPoor      = "poor"
+)
+
+// rttPenalty in milliseconds above which a link loses a point
+const rttPenalty = 400
+
+// QualityConfig defines how often connection quality is computed
+type QualityConfig struct {
+	// Cycle in seconds quality is computed at, not computed when 0
+	Cycle int `mapstructure:"cycle"`
+}
+
+// ConnectionQuality of a participant, scored from 1 (worst) to 5 (best)
+type ConnectionQuality struct {
+	Score int    `json:"score"`
+	Level string `json:"level"`
+	// Uplink from the participant, nil when it publishes nothing
+	Uplink *LinkQuality `json:"uplink,omitempty"`
+	// Downlink to the participant, nil when it receives nothing
+	Downlink *LinkQuality `json:"downlink,omitempty"`
+}
+
+// LinkQuality is the quality of one direction of a connection, loss is over
+// the last cycle, bitrates are in bits per second and round trip time in ms
+type LinkQuality struct {
+	Score     int     `json:"score"`
+	Loss      float64 `json:"loss"`
+	Bitrate   uint64  `json:"bitrate"`
+	Bandwidth uint64  `json:"bandwidth,omitempty"`
+	// RoundTripTime as reported by the client
+	RoundTripTime float64 `json:"roundTripTime,omitempty"`
+}
+
+// qualityState keeps the counts of the previous cycle to compute loss over a cycle
+type qualityState struct {
+	tracks         map[string]lossCount
+	client         lossCount
+	clientLoss     float64
+	clientReported time.Time
+}
+
+type lossCount struct {
+	packets, lost uint64
+}
+
+// delta returns the loss since the previous count
+func (c lossCount) delta(prev lossCount) (packets, lost uint64) {
+	if c.packets >= prev.packets {
+		packets = c.packets - prev.packets
+	}
+	if c.lost >= prev.lost {
+		lost = c.lost - prev.lost
+	}
+	return
+}
+
+// qualityLoop updates the connection quality of every session each cycle
+func (s *SFU) qualityLoop(cycle time.Duration) {
+	t := time.NewTicker(cycle)
+	defer t.Stop()
+	for range t.C {
+		s.mu.RLock()
+		sessions := make([]*Session, 0, len(s.sessions))
+		for _, session := range s.sessions {
+			sessions = append(sessions, session)
+		}
+		s.mu.RUnlock()
+
+		for _, session := range sessions {
+			session.updateQuality()
+		}
+	}
+}
+
+// updateQuality scores the participants of the session and notifies every
+// participant of the scores that changed
+func (r *Session) updateQuality() {
+	stats := r.Stats()
+
+	// what each subscriber is sent and estimates it can receive
+	downlinks := make(map[string]*LinkQuality)
+	for _, t := range stats.Transports {
+		for _, router := range t.Routers {
+			for _, sender := range router.Senders {
+				d, ok := downlinks[sender.ID]
+				if !ok {
+					d = &LinkQuality{}
+					downlinks[sender.ID] = d
+				}
+				d.Bitrate += sender.Bitrate
+				if sender.REMBTarget > d.Bandwidth {
+					d.Bandwidth = sender.REMBTarget
+				}
+			}
+		}
+	}
+
+	var events []SessionEvent
+	r.mu.Lock()
+	if r.quality == nil {
+		r.quality = make(map[string]*qualityState)
+	}
+	for _, t := range stats.Transports {
+		participant, ok := r.participants[t.ID]
+		if !ok {
+			continue
+		}
+		state, ok := r.quality[t.ID]
+		if !ok {
+			state = &qualityState{tracks: make(map[string]lossCount)}
+			r.quality[t.ID] = state
+		}
+
+		q := ConnectionQuality{
+			Uplink:   state.uplink(t),
+			Downlink: state.downlink(t.Client, downlinks[t.ID]),
+		}
+		if q.Uplink == nil && q.Downlink == nil {
+			continue
+		}
+		q.Score = 5
+		for _, l := range []*LinkQuality{q.Uplink, q.Downlink} {
+			if l != nil && l.Score < q.Score {
+				q.Score = l.Score
+			}
+		}
+		q.Level = qualityLevel(q.Score)
+
+		if participant.Quality != nil && participant.Quality.Score == q.Score {
+			continue
+		}
+		participant.Quality = &q
+		events = append(events, SessionEvent{Type: EventConnectionQuality, Participant: participant.copy(), Quality: &q})
+	}
+	r.mu.Unlock()
+
+	for _, event := range events {
+		r.emit("", event)
+	}
+}
+
+// uplink scores the tracks received from a transport
+func (s *qualityState) uplink(t TransportStats) *LinkQuality {
+	if len(t.Routers) == 0 {
+		return nil
+	}
+
+	l := &LinkQuality{}
+	tracks := make(map[string]lossCount, len(t.Routers))
+	for _, router := range t.Routers {
+		recv := router.Receiver
+		c := lossCount{packets: recv.Packets, lost: recv.PacketsLost}
+		tracks[router.TrackID] = c
+
+		// video receivers compute loss each remb cycle, other tracks
+		// since the previous quality cycle
+		loss := recv.RecentLoss
+		if recv.Bandwidth == 0 {
+			loss = 0
+			if packets, lost := c.delta(s.tracks[router.TrackID]); packets+lost > 0 {
+				loss = float64(lost) / float64(packets+lost)
+			}
+		}
+		if loss > l.Loss {
+			l.Loss = loss
+		}
+
+		l.Bitrate += recv.Bitrate
+		l.Bandwidth += recv.REMBTarget
+	}
+	s.tracks = tracks
+
+	if t.Client != nil {
+		l.RoundTripTime = t.Client.RoundTripTime
+		if t.Client.AvailableOutgoingBitrate > 0 {
+			l.Bandwidth = t.Client.AvailableOutgoingBitrate
+		}
+	}
+	l.Score = linkScore(l)
+	return l
+}
+
+// downlink scores what is sent to a transport, with the loss its client
+// reported when it did since the previous cycle
+func (s *qualityState) downlink(client *ClientStats, sent *LinkQuality) *LinkQuality {
+	if sent == nil && client == nil {
+		return nil
+	}
+
+	l := &LinkQuality{}
+	if sent != nil {
+		*l = *sent
+	}
+	if client != nil {
+		l.RoundTripTime = client.RoundTripTime
+		if client.Time.After(s.clientReported) {
+			var c lossCount
+			for _, in := range client.Inbound {
+				c.packets += in.PacketsReceived
+				if in.PacketsLost > 0 {
+					c.lost += uint64(in.PacketsLost)
+				}
+			}
+			if !s.clientReported.IsZero() {
+				s.clientLoss = 0
+				if packets, lost := c.delta(s.client); packets+lost > 0 {
+					s.clientLoss = float64(lost) / float64(packets+lost)
+				}
+			}
+			s.client, s.clientReported = c, client.Time
+		}
+		l.Loss = s.clientLoss
+	}
+	l.Score = linkScore(l)
+	return l
+}
+
+// linkScore drops points for loss, for sending more than the estimated
+// bandwidth and for a long round trip
+func linkScore(l *LinkQuality) int {
+	score := 5
+	switch {
+	case l.Loss > 0.2:
+		score = 1
+	case l.Loss > 0.1:
+		score = 2
+	case l.Loss > 0.05:
+		score = 3
+	case l.Loss > 0.02:
+		score = 4
+	}
+	if l.Bandwidth > 0 && l.Bandwidth*10 < l.Bitrate*8 {
+		score--
+	}
+	if l.RoundTripTime > rttPenalty {
+		score--
+	}
+	if score < 1 {
+		score = 1
+	}
+	return score
+}
+
+func qualityLevel(score int) string {
+	switch {
+	case score >= 5:
+		return QualityExcellent
+	case score == 4:
+		return QualityGood
+	case score == 3:
+		return QualityFair
+	}
+	return QualityPoor
+}
@@ -1,13 +1,13 @@
 package sfu
 
 import (
-	"fmt"
 	"io"
 	"sync"
 	"time"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v2"
 	"github.com/sirupsen/logrus"
 )
@@ -16,6 +16,8 @@ const (
 	// bandwidth range(kbps)
 	minBandwidth = 200
 	maxSize      = 100
+	// mutedBandwidth(kbps) publishers are capped to while their track is muted
+	mutedBandwidth = 30
 
 	// tcc stuff
 	tccExtMapID = 3
@@ -39,19 +41,21 @@ type Receiver interface {
 	ReadRTCP() (rtcp.Packet, error)
 	WriteRTCP(bitmap rtcp.Packet) error
 	Close()
-	stats() string
+	stats() ReceiverStats
 }
 
 // WebRTCAudioReceiver receives a audio track
 type WebRTCAudioReceiver struct {
-	track *webrtc.Track
-	stop  bool
+	track   *webrtc.Track
+	stop    bool
+	counter receiveCounter
 }
 
 // NewWebRTCAudioReceiver creates a new audio track receiver
 func NewWebRTCAudioReceiver(track *webrtc.Track) *WebRTCAudioReceiver {
 	return &WebRTCAudioReceiver{
-		track: track,
+		track:   track,
+		counter: receiveCounter{clockRate: track.Codec().ClockRate},
 	}
 }
 
@@ -67,7 +71,11 @@ func (r *WebRTCAudioReceiver) ReadRTP() (*rtp.Packet, error) {
 	if r.stop {
 		return nil, errReceiverClosed
 	}
-	return r.track.ReadRTP()
+	pkt, err := r.track.ReadRTP()
+	if err == nil {
+		r.counter.push(pkt)
+	}
+	return pkt, err
 }
 
 func (r *WebRTCAudioReceiver) ReadRTCP() (rtcp.Packet, error) {
@@ -82,8 +90,8 @@ func (r *WebRTCAudioReceiver) Close() {
 	r.stop = true
 }
 
-func (r *WebRTCAudioReceiver) stats() string {
-	return fmt.Sprintf("payload: %d", r.track.PayloadType())
+func (r *WebRTCAudioReceiver) stats() ReceiverStats {
+	return r.counter.stats(r.track.PayloadType(), &feedbackCounter{})
 }
 
 // WebRTCVideoReceiver receives a video track
@@ -93,10 +101,13 @@ type WebRTCVideoReceiver struct {
 	bandwidth      uint64
 	lostRate       float64
 	stop           bool
+	muted          bool
 	rtpCh          chan *rtp.Packet
 	rtcpCh         chan rtcp.Packet
 	mu             sync.RWMutex
 	rtpExtInfoChan chan rtpExtInfo
+	counter        receiveCounter
+	rtcpCounter    feedbackCounter
 
 	pliCycle     int
 	rembCycle    int
@@ -124,6 +135,8 @@ func NewWebRTCVideoReceiver(config WebRTCVideoReceiverConfig, track *webrtc.Trac
 		rtpCh:          make(chan *rtp.Packet, maxSize),
 		rtcpCh:         make(chan rtcp.Packet, maxSize),
 		rtpExtInfoChan: make(chan rtpExtInfo, maxSize),
+		counter:        receiveCounter{clockRate: track.Codec().ClockRate},
+		rtcpCounter:    feedbackCounter{out: true},
 		rembCycle:      config.REMBCycle,
 		pliCycle:       config.PLICycle,
 		tccCycle:       config.TCCCycle,
@@ -165,6 +178,7 @@ func (v *WebRTCVideoReceiver) ReadRTCP() (rtcp.Packet, error) {
 	if !ok {
 		return nil, errChanClosed
 	}
+	v.rtcpCounter.add(rtcp)
 	return rtcp, nil
 }
 
@@ -174,6 +188,35 @@ func (v *WebRTCVideoReceiver) WriteRTCP(pkt rtcp.Packet) error {
 	return nil
 }
 
+// setMuted caps the bitrate of the publisher while nothing it sends is
+// forwarded, and lifts the cap right away once unmuted
+func (v *WebRTCVideoReceiver) setMuted(muted bool) {
+	v.mu.Lock()
+	if v.stop || v.muted == muted {
+		v.mu.Unlock()
+		return
+	}
+	v.muted = muted
+	v.mu.Unlock()
+
+	bw := uint64(v.maxBandwidth)
+	if muted {
+		bw = mutedBandwidth
+	}
+	if bw == 0 {
+		// no configured maximum, the next estimate lifts the cap
+		return
+	}
+	select {
+	case v.rtcpCh <- &rtcp.ReceiverEstimatedMaximumBitrate{
+		SenderSSRC: v.buffer.GetSSRC(),
+		Bitrate:    bw * 1000,
+		SSRCs:      []uint32{v.buffer.GetSSRC()},
+	}:
+	default:
+	}
+}
+
 // Track returns receiver track
 func (v *WebRTCVideoReceiver) Track() *webrtc.Track {
 	return v.track
@@ -213,6 +256,7 @@ func (v *WebRTCVideoReceiver) receiveRTP() {
 		}
 
 		v.buffer.Push(pkt)
+		v.counter.push(pkt)
 
 		if v.feedback == webrtc.TypeRTCPFBTransportCC {
 			// store arrival time
@@ -282,14 +326,17 @@ func (v *WebRTCVideoReceiver) rembLoop() {
 
 		time.Sleep(time.Duration(v.rembCycle) * time.Second)
 		// only calc video recently
-		v.lostRate, v.bandwidth = v.buffer.GetLostRateBandwidth(uint64(v.rembCycle))
+		lostRate, bandwidth := v.buffer.GetLostRateBandwidth(uint64(v.rembCycle))
+		v.mu.Lock()
+		v.lostRate, v.bandwidth = lostRate, bandwidth
+		v.mu.Unlock()
 		var bw uint64
-		if v.lostRate == 0 && v.bandwidth == 0 {
+		if lostRate == 0 && bandwidth == 0 {
 			bw = uint64(v.maxBandwidth)
-		} else if v.lostRate >= 0 && v.lostRate < 0.1 {
-			bw = uint64(v.bandwidth * 2)
+		} else if lostRate >= 0 && lostRate < 0.1 {
+			bw = uint64(bandwidth * 2)
 		} else {
-			bw = uint64(float64(v.bandwidth) * (1 - v.lostRate))
+			bw = uint64(float64(bandwidth) * (1 - lostRate))
 		}
 
 		if bw < minBandwidth {
@@ -300,6 +347,12 @@ func (v *WebRTCVideoReceiver) rembLoop() {
 			bw = uint64(v.maxBandwidth)
 		}
 
+		v.mu.RLock()
+		if v.muted {
+			bw = mutedBandwidth
+		}
+		v.mu.RUnlock()
+
 		remb := &rtcp.ReceiverEstimatedMaximumBitrate{
 			SenderSSRC: v.buffer.GetSSRC(),
 			Bitrate:    bw * 1000,
@@ -426,6 +479,195 @@ func (v *WebRTCVideoReceiver) tccLoop() {
 }
 
 // Stats get stats for video receiver
-func (v *WebRTCVideoReceiver) stats() string {
-	return fmt.Sprintf("payload: %d | lostRate: %.2f | bandwidth: %dkbps | %s", v.buffer.GetPayloadType(), v.lostRate, v.bandwidth, v.buffer.stats())
+func (v *WebRTCVideoReceiver) stats() ReceiverStats {
+	stats := v.counter.stats(v.buffer.GetPayloadType(), &v.rtcpCounter)
+	stats.Buffer = v.buffer.stats()
+	v.mu.RLock()
+	stats.RecentLoss, stats.Bandwidth = v.lostRate, v.bandwidth*1000
+	v.mu.RUnlock()
+	return stats
+}
+
+// PlainRTPReceiver receives a track from rtp packets pushed by a non-WebRTC transport
+type PlainRTPReceiver struct {
+	mu          sync.RWMutex
+	track       *webrtc.Track
+	buffer      *Buffer
+	stop        bool
+	rtpCh       chan *rtp.Packet
+	rtcpCh      chan rtcp.Packet
+	counter     receiveCounter
+	rtcpCounter feedbackCounter
+}
+
+// NewPlainRTPReceiver creates a new plain rtp track receiver, video packets are
+// buffered so nacks from subscribers can be served locally
+func NewPlainRTPReceiver(track *webrtc.Track) *PlainRTPReceiver {
+	r := &PlainRTPReceiver{
+		track:       track,
+		rtpCh:       make(chan *rtp.Packet, maxSize),
+		rtcpCh:      make(chan rtcp.Packet, maxSize),
+		counter:     receiveCounter{clockRate: track.Codec().ClockRate},
+		rtcpCounter: feedbackCounter{out: true},
+	}
+
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		r.buffer = NewBuffer(track.SSRC(), track.PayloadType(), BufferOptions{
+			BufferTime: config.Receiver.Video.MaxBufferTime,
+		})
+		go r.bufferRtcpLoop()
+	}
+
+	return r
+}
+
+// Track returns receiver track
+func (r *PlainRTPReceiver) Track() *webrtc.Track {
+	return r.track
+}
+
+// GetPacket get a buffered packet if we have one
+func (r *PlainRTPReceiver) GetPacket(sn uint16) *rtp.Packet {
+	if r.buffer == nil {
+		return nil
+	}
+	return r.buffer.GetPacket(sn)
+}
+
+// ReadRTP read rtp packets
+func (r *PlainRTPReceiver) ReadRTP() (*rtp.Packet, error) {
+	pkt, ok := <-r.rtpCh
+	if !ok {
+		return nil, errChanClosed
+	}
+	return pkt, nil
+}
+
+// ReadRTCP read rtcp packets to be sent to the source
+func (r *PlainRTPReceiver) ReadRTCP() (rtcp.Packet, error) {
+	pkt, ok := <-r.rtcpCh
+	if !ok {
+		return nil, errChanClosed
+	}
+	r.rtcpCounter.add(pkt)
+	return pkt, nil
+}
+
+// WriteRTCP write rtcp packet
+func (r *PlainRTPReceiver) WriteRTCP(pkt rtcp.Packet) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.stop {
+		return errReceiverClosed
+	}
+
+	select {
+	case r.rtcpCh <- pkt:
+	default:
+		logrus.Debugf("plain rtp receiver %d rtcp queue full", r.track.SSRC())
+	}
+	return nil
+}
+
+// Close track
+func (r *PlainRTPReceiver) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stop {
+		return
+	}
+	r.stop = true
+	if r.buffer != nil {
+		r.buffer.Stop()
+	}
+	close(r.rtpCh)
+	close(r.rtcpCh)
+}
+
+// push a packet received by the transport, packets are dropped when the router
+// falls behind as the source has no way to slow down
+func (r *PlainRTPReceiver) push(pkt *rtp.Packet) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.stop {
+		return
+	}
+
+	if r.buffer != nil {
+		r.buffer.Push(pkt)
+	}
+	r.counter.push(pkt)
+
+	select {
+	case r.rtpCh <- pkt:
+	default:
+		logrus.Debugf("plain rtp receiver %d rtp queue full", r.track.SSRC())
+		countDropped(DropReceiver)
+	}
+}
+
+func (r *PlainRTPReceiver) bufferRtcpLoop() {
+	for pkt := range r.buffer.GetRTCPChan() {
+		_ = r.WriteRTCP(pkt)
+	}
+}
+
+func (r *PlainRTPReceiver) stats() ReceiverStats {
+	stats := r.counter.stats(r.track.PayloadType(), &r.rtcpCounter)
+	if r.buffer != nil {
+		stats.Buffer = r.buffer.stats()
+	}
+	return stats
+}
+
+// RTMPReceiver receives an h264 track repacketized from the flv video of an rtmp publisher
+type RTMPReceiver struct {
+	*PlainRTPReceiver
+	payloader codecs.H264Payloader
+	sequencer rtp.Sequencer
+}
+
+// NewRTMPReceiver creates a new rtmp track receiver
+func NewRTMPReceiver(track *webrtc.Track) *RTMPReceiver {
+	return &RTMPReceiver{
+		PlainRTPReceiver: NewPlainRTPReceiver(track),
+		sequencer:        rtp.NewRandomSequencer(),
+	}
+}
+
+// WriteRTCP drops rtcp, rtmp has no way to carry feedback to the publisher
+func (r *RTMPReceiver) WriteRTCP(pkt rtcp.Packet) error {
+	return nil
+}
+
+// writeFrame packetizes the nal units of a frame, RFC 6184
+func (r *RTMPReceiver) writeFrame(timestamp uint32, nalus [][]byte) {
+	var payloads [][]byte
+	for _, nalu := range nalus {
+		payloads = append(payloads, r.payloader.Payload(rtmpPacketMTU, nalu)...)
+	}
+
+	for i, payload := range payloads {
+		r.push(&rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         i == len(payloads)-1,
+				PayloadType:    r.track.PayloadType(),
+				SequenceNumber: r.sequencer.NextSequenceNumber(),
+				Timestamp:      timestamp,
+				SSRC:           r.track.SSRC(),
+			},
+			Payload: payload,
+		})
+	}
+}
+
+// RelayReceiver receives a track forwarded by another sfu instance over a relay link
+type RelayReceiver struct {
+	*PlainRTPReceiver
+}
+
+// NewRelayReceiver creates a new relay track receiver
+func NewRelayReceiver(track *webrtc.Track) *RelayReceiver {
+	return &RelayReceiver{PlainRTPReceiver: NewPlainRTPReceiver(track)}
 }
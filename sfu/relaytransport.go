@@ -0,0 +1,492 @@
+package sfu
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// frames of the relay link, a type byte followed by its payload
+	relayFrameHello  = 0
+	relayFrameTrack  = 1
+	relayFrameRemove = 2
+	relayFrameRTP    = 3
+	relayFrameRTCP   = 4
+
+	// tracks are announced again each cycle, which also keeps the link alive
+	relayAnnounceCycle = time.Second
+	// remote tracks are closed when the link is silent for this long
+	relayTimeout = 10 * time.Second
+)
+
+// relayTrack describes a track forwarded over a relay link
+type relayTrack struct {
+	SSRC        uint32 `json:"ssrc"`
+	ID          string `json:"id"`
+	Label       string `json:"label"`
+	Codec       string `json:"codec"`
+	PayloadType uint8  `json:"payloadType"`
+	ClockRate   uint32 `json:"clockRate"`
+	Fmtp        string `json:"fmtp"`
+}
+
+// RelayTransportConfig represents configuration options of a relay between sfu instances
+type RelayTransportConfig struct {
+	// IP to listen on, all interfaces when empty
+	IP string
+	// Port to listen on, an ephemeral port is used when 0
+	Port int
+	// Remote relay address, the first instance that says hello with the
+	// secret when empty
+	Remote string
+	// Secret both instances say hello with, frames are only accepted once the
+	// remote said it. Either Remote or Secret is required.
+	Secret string
+	// Tracks forwarded to the remote instance, when empty every track that
+	// was not itself received from a relay
+	Tracks []string
+}
+
+// RelayTransport links a session with the session of the same id on another sfu
+// instance over a framed udp link. Routers of the session are forwarded to the
+// remote instance, and routers of the remote instance are published locally,
+// with rtcp feedback carried back to their source.
+type RelayTransport struct {
+	id       string
+	mu       sync.RWMutex
+	stop     bool
+	session  *Session
+	conn     *net.UDPConn
+	remote   *net.UDPAddr
+	secret   []byte
+	verified bool
+	tracks   map[string]bool
+	routers  map[uint32]*Router
+	senders  map[uint32]*RelaySender
+	lastSeen time.Time
+	closed   chan struct{}
+}
+
+// NewRelayTransport creates a new RelayTransport forwarding routers of session
+func NewRelayTransport(session *Session, cfg RelayTransportConfig) (*RelayTransport, error) {
+	if cfg.Remote == "" && cfg.Secret == "" {
+		return nil, errRelayUnauthenticated
+	}
+
+	var remote *net.UDPAddr
+	if cfg.Remote != "" {
+		addr, err := net.ResolveUDPAddr("udp", cfg.Remote)
+		if err != nil {
+			return nil, err
+		}
+		remote = addr
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(cfg.IP), Port: cfg.Port})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &RelayTransport{
+		id:      cuid.New(),
+		session: session,
+		conn:    conn,
+		remote:  remote,
+		secret:  []byte(cfg.Secret),
+		tracks:  make(map[string]bool),
+		routers: make(map[uint32]*Router),
+		senders: make(map[uint32]*RelaySender),
+		closed:  make(chan struct{}),
+	}
+	for _, id := range cfg.Tracks {
+		t.tracks[id] = true
+	}
+
+	session.AddTransport(t)
+
+	// forward the routers published before the relay
+	for _, pub := range session.Transports() {
+		if pub.ID() == t.id {
+			continue
+		}
+		for _, router := range pub.Routers() {
+			if !t.subscribes(router) {
+				continue
+			}
+			sender, err := t.NewSender(router.Track())
+			if err != nil {
+				logrus.Errorf("relay transport %s sender err: %v", t.id, err)
+				continue
+			}
+			router.AddSender(t.id, sender)
+		}
+	}
+
+	go t.readLoop()
+	go t.announceLoop()
+
+	// let a listening remote learn the link right away
+	_ = t.send(relayFrameHello, t.secret)
+
+	return t, nil
+}
+
+// ID of transport
+func (t *RelayTransport) ID() string {
+	return t.id
+}
+
+// Port the transport receives frames on
+func (t *RelayTransport) Port() int {
+	return t.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Routers returns routers received from the remote instance
+func (t *RelayTransport) Routers() map[uint32]*Router {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	// the link adds routers as the remote announces them
+	routers := make(map[uint32]*Router, len(t.routers))
+	for ssrc, router := range t.routers {
+		routers[ssrc] = router
+	}
+	return routers
+}
+
+// GetRouter returns router with ssrc
+func (t *RelayTransport) GetRouter(ssrc uint32) *Router {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.routers[ssrc]
+}
+
+// subscribes reports whether a router is forwarded to the remote instance,
+// routers of other relays are not to avoid loops between instances
+func (t *RelayTransport) subscribes(router *Router) bool {
+	if len(t.tracks) > 0 {
+		return t.tracks[router.Track().ID()]
+	}
+	_, relayed := router.receiver.(*RelayReceiver)
+	return !relayed
+}
+
+// NewSender forwards a track to the remote instance
+func (t *RelayTransport) NewSender(track *webrtc.Track) (Sender, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop {
+		return nil, errTransportClosed
+	}
+
+	ssrc := track.SSRC()
+	sender := NewRelaySender(track, func(pkt *rtp.Packet) error {
+		buf, err := pkt.Marshal()
+		if err != nil {
+			return err
+		}
+		return t.send(relayFrameRTP, buf)
+	})
+	sender.OnClose(func() {
+		t.mu.Lock()
+		if t.senders[ssrc] == sender {
+			delete(t.senders, ssrc)
+		}
+		t.mu.Unlock()
+		_ = t.send(relayFrameRemove, be32(ssrc))
+	})
+	t.senders[ssrc] = sender
+
+	go t.announce(track)
+
+	return sender, nil
+}
+
+// Close transport
+func (t *RelayTransport) Close() error {
+	t.mu.Lock()
+	if t.stop {
+		t.mu.Unlock()
+		return nil
+	}
+	t.stop = true
+	close(t.closed)
+
+	routers := make([]*Router, 0, len(t.routers))
+	for _, router := range t.routers {
+		routers = append(routers, router)
+	}
+	senders := t.senders
+	t.senders = make(map[uint32]*RelaySender)
+	t.mu.Unlock()
+
+	// routers remove their tracks from the session when closed, which locks it
+	for _, router := range routers {
+		router.Close()
+	}
+
+	t.session.RemoveTransport(t.id)
+
+	// the remote closes its routers on remove
+	for _, sender := range senders {
+		sender.Close()
+	}
+
+	return t.conn.Close()
+}
+
+// send writes a frame to the remote instance once its address is known
+func (t *RelayTransport) send(typ byte, payload []byte) error {
+	t.mu.RLock()
+	remote := t.remote
+	t.mu.RUnlock()
+	if remote == nil {
+		return nil
+	}
+
+	_, err := t.conn.WriteToUDP(append([]byte{typ}, payload...), remote)
+	return err
+}
+
+func (t *RelayTransport) announce(track *webrtc.Track) {
+	codec := track.Codec()
+	buf, err := json.Marshal(relayTrack{
+		SSRC:        track.SSRC(),
+		ID:          track.ID(),
+		Label:       track.Label(),
+		Codec:       codec.Name,
+		PayloadType: track.PayloadType(),
+		ClockRate:   codec.ClockRate,
+		Fmtp:        codec.SDPFmtpLine,
+	})
+	if err != nil {
+		logrus.Errorf("relay transport %s announce err: %v", t.id, err)
+		return
+	}
+	if err := t.send(relayFrameTrack, buf); err != nil {
+		logrus.Debugf("relay transport %s announce err: %v", t.id, err)
+	}
+}
+
+// announceLoop announces forwarded tracks and expires remote tracks of a silent link
+func (t *RelayTransport) announceLoop() {
+	ticker := time.NewTicker(relayAnnounceCycle)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.closed:
+			return
+		case <-ticker.C:
+		}
+
+		t.mu.Lock()
+		var expired []*Router
+		if !t.lastSeen.IsZero() && time.Since(t.lastSeen) > relayTimeout {
+			for ssrc, router := range t.routers {
+				expired = append(expired, router)
+				delete(t.routers, ssrc)
+			}
+		}
+		t.mu.Unlock()
+
+		for _, router := range expired {
+			logrus.Infof("relay transport %s link timed out, closing router %d", t.id, router.Track().SSRC())
+			router.Close()
+		}
+
+		_ = t.send(relayFrameHello, t.secret)
+		t.announceAll()
+	}
+}
+
+func (t *RelayTransport) announceAll() {
+	t.mu.RLock()
+	tracks := make([]*webrtc.Track, 0, len(t.senders))
+	for _, sender := range t.senders {
+		tracks = append(tracks, sender.track)
+	}
+	t.mu.RUnlock()
+
+	for _, track := range tracks {
+		t.announce(track)
+	}
+}
+
+func (t *RelayTransport) readLoop() {
+	// frames carry a datagram after their type byte
+	buf := make([]byte, receiveMTU+1)
+	for {
+		n, addr, err := t.conn.ReadFromUDP(buf)
+		if err != nil {
+			t.mu.RLock()
+			stop := t.stop
+			t.mu.RUnlock()
+			if !stop {
+				logrus.Errorf("relay read err: %v", err)
+				_ = t.Close()
+			}
+			return
+		}
+		if n == 0 {
+			continue
+		}
+
+		hello := buf[0] == relayFrameHello && len(t.secret) > 0 &&
+			subtle.ConstantTimeCompare(buf[1:n], t.secret) == 1
+
+		t.mu.Lock()
+		if t.remote == nil && hello {
+			// the first instance to say hello with the secret owns the link
+			t.remote = addr
+			logrus.Infof("relay transport %s linked with %s", t.id, addr)
+			go func() {
+				// the remote accepts frames once it heard the secret back
+				_ = t.send(relayFrameHello, t.secret)
+				t.announceAll()
+			}()
+		}
+		ok := t.remote != nil && t.remote.IP.Equal(addr.IP) && t.remote.Port == addr.Port
+		if ok && hello {
+			t.verified = true
+		}
+		// with a secret, a configured remote must say it too
+		ok = ok && (len(t.secret) == 0 || t.verified)
+		if ok {
+			t.lastSeen = time.Now()
+		}
+		t.mu.Unlock()
+		if !ok {
+			logrus.Debugf("relay transport %s dropping frame of %s", t.id, addr)
+			continue
+		}
+
+		payload := append([]byte{}, buf[1:n]...)
+		switch buf[0] {
+		case relayFrameTrack:
+			t.handleTrack(payload)
+		case relayFrameRemove:
+			if len(payload) >= 4 {
+				t.removeRouter(binary.BigEndian.Uint32(payload))
+			}
+		case relayFrameRTP:
+			pkt := &rtp.Packet{}
+			if err := pkt.Unmarshal(payload); err != nil {
+				continue
+			}
+			if router := t.GetRouter(pkt.SSRC); router != nil {
+				router.receiver.(*RelayReceiver).push(pkt)
+			}
+		case relayFrameRTCP:
+			t.handleRTCP(payload)
+		}
+	}
+}
+
+// handleTrack publishes a track announced by the remote instance
+func (t *RelayTransport) handleTrack(payload []byte) {
+	var rt relayTrack
+	if err := json.Unmarshal(payload, &rt); err != nil {
+		logrus.Debugf("relay transport %s bad track: %v", t.id, err)
+		return
+	}
+
+	t.mu.Lock()
+	if _, ok := t.routers[rt.SSRC]; ok || t.stop {
+		t.mu.Unlock()
+		return
+	}
+
+	codec, err := newRTPCodec(rt.Codec, rt.PayloadType, rt.ClockRate, rt.Fmtp)
+	if err != nil {
+		t.mu.Unlock()
+		logrus.Errorf("relay transport %s track %s: %v", t.id, rt.ID, err)
+		return
+	}
+	track, err := webrtc.NewTrack(rt.PayloadType, rt.SSRC, rt.ID, rt.Label, codec)
+	if err != nil {
+		t.mu.Unlock()
+		logrus.Errorf("relay transport %s track %s: %v", t.id, rt.ID, err)
+		return
+	}
+
+	recv := NewRelayReceiver(track)
+	router := NewRouter(t.id, recv)
+	t.routers[rt.SSRC] = router
+	t.mu.Unlock()
+
+	logrus.Debugf("Created router %s %d", t.id, rt.SSRC)
+
+	go t.sendRTCP(recv)
+	t.session.AddRouter(router)
+}
+
+func (t *RelayTransport) removeRouter(ssrc uint32) {
+	t.mu.Lock()
+	router := t.routers[ssrc]
+	delete(t.routers, ssrc)
+	t.mu.Unlock()
+
+	if router != nil {
+		logrus.Debugf("relay transport %s remote removed track %d", t.id, ssrc)
+		router.Close()
+	}
+}
+
+// handleRTCP hands feedback of remote subscribers to the forwarded routers
+func (t *RelayTransport) handleRTCP(payload []byte) {
+	pkts, err := rtcp.Unmarshal(payload)
+	if err != nil {
+		return
+	}
+
+	for _, pkt := range pkts {
+		for _, ssrc := range pkt.DestinationSSRC() {
+			t.mu.RLock()
+			sender := t.senders[ssrc]
+			t.mu.RUnlock()
+			if sender != nil {
+				sender.writeRTCP(pkt)
+			}
+		}
+	}
+}
+
+// sendRTCP forwards feedback of local subscribers to the remote source
+func (t *RelayTransport) sendRTCP(recv Receiver) {
+	for {
+		pkt, err := recv.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		buf, err := pkt.Marshal()
+		if err != nil {
+			logrus.Errorf("Error marshaling RTCP %s", err)
+			continue
+		}
+		if err := t.send(relayFrameRTCP, buf); err != nil {
+			logrus.Debugf("relay transport %s rtcp err: %v", t.id, err)
+		}
+	}
+}
+
+func (t *RelayTransport) stats() TransportStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	stats := TransportStats{ID: t.id, Kind: transportKind(t), Routers: routerStats(t.routers)}
+	if t.remote != nil {
+		stats.Remote = t.remote.String()
+	}
+	return stats
+}
@@ -0,0 +1,191 @@
+package sfu
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const relayTestSSRC = 1111
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) bool {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func loopback(port int) string {
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+}
+
+// TestRelayLoopback links a session of two sfu instances, a track published
+// on one is received on the other and feedback of its subscribers goes back
+// to the publisher
+func TestRelayLoopback(t *testing.T) {
+	a, b := NewSFU(Config{}), NewSFU(Config{})
+
+	ingest, err := a.NewPlainRTPTransport("relay", PlainRTPTransportConfig{
+		IP:      "127.0.0.1",
+		RTCPMux: true,
+		Tracks:  []PlainRTPTrack{{ID: "video", Codec: "VP8", PayloadType: 96, SSRC: relayTestSSRC}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ingest.Close()
+
+	listener, err := b.NewRelayTransport("relay", RelayTransportConfig{IP: "127.0.0.1", Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialer, err := a.NewRelayTransport("relay", RelayTransportConfig{
+		IP:     "127.0.0.1",
+		Remote: loopback(listener.Port()),
+		Secret: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialer.Close()
+
+	publisher := listenLoopback(t)
+	defer publisher.Close()
+	ingestAddr, _ := net.ResolveUDPAddr("udp", loopback(ingest.Port()))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		var seq uint16
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			seq++
+			pkt := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: seq, Timestamp: uint32(seq) * 3000, SSRC: relayTestSSRC},
+				Payload: []byte{0x10, 0x00, 0x00, 0x00},
+			}
+			buf, _ := pkt.Marshal()
+			_, _ = publisher.WriteToUDP(buf, ingestAddr)
+		}
+	}()
+
+	if !waitFor(t, 5*time.Second, func() bool {
+		session := b.GetSession("relay")
+		return session != nil && session.GetRouter("video") != nil
+	}) {
+		t.Fatal("track not relayed")
+	}
+
+	subscriber := listenLoopback(t)
+	defer subscriber.Close()
+	egress, err := b.NewPlainRTPEgress("relay", "video", PlainRTPSenderConfig{
+		Host: "127.0.0.1",
+		Port: subscriber.LocalAddr().(*net.UDPAddr).Port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer egress.Close()
+
+	buf := make([]byte, receiveMTU)
+	_ = subscriber.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var source *net.UDPAddr
+	for source == nil {
+		n, addr, err := subscriber.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("no rtp received: %v", err)
+		}
+		pkt := &rtp.Packet{}
+		if pkt.Unmarshal(buf[:n]) == nil && pkt.SSRC == relayTestSSRC {
+			source = addr
+		}
+	}
+
+	// the keyframe request of the subscriber crosses the link back
+	pli, _ := (&rtcp.PictureLossIndication{SenderSSRC: 1, MediaSSRC: relayTestSSRC}).Marshal()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := subscriber.WriteToUDP(pli, source); err != nil {
+			t.Fatal(err)
+		}
+
+		_ = publisher.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := publisher.ReadFromUDP(buf)
+		if err != nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("no rtcp received: %v", err)
+			}
+			continue
+		}
+		pkts, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		for _, pkt := range pkts {
+			if pkt, ok := pkt.(*rtcp.PictureLossIndication); ok && pkt.MediaSSRC == relayTestSSRC {
+				return
+			}
+		}
+	}
+}
+
+// TestRelayRejectsUnauthenticated checks frames of a source that did not say
+// hello with the secret are dropped
+func TestRelayRejectsUnauthenticated(t *testing.T) {
+	s := NewSFU(Config{})
+
+	if _, err := s.NewRelayTransport("open", RelayTransportConfig{IP: "127.0.0.1"}); err != errRelayUnauthenticated {
+		t.Fatalf("relay without remote nor secret: got %v", err)
+	}
+
+	relay, err := s.NewRelayTransport("guarded", RelayTransportConfig{IP: "127.0.0.1", Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+
+	intruder := listenLoopback(t)
+	defer intruder.Close()
+	addr, _ := net.ResolveUDPAddr("udp", loopback(relay.Port()))
+
+	track := []byte(`{"ssrc":2222,"id":"intruder","label":"intruder","codec":"VP8","payloadType":96}`)
+	for _, frame := range [][]byte{
+		append([]byte{relayFrameHello}, "wrong"...),
+		append([]byte{relayFrameTrack}, track...),
+	} {
+		if _, err := intruder.WriteToUDP(frame, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if waitFor(t, 500*time.Millisecond, func() bool {
+		return s.GetSession("guarded").GetRouter("intruder") != nil
+	}) {
+		t.Fatal("track of an unauthenticated source published")
+	}
+}
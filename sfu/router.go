@@ -1,10 +1,11 @@
 package sfu
 
 import (
-	"fmt"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/webrtc/v2"
@@ -18,6 +19,11 @@ type Router struct {
 	mu       sync.RWMutex
 	receiver Receiver
 	senders  map[string]Sender
+	muter    rtpMuter
+	// nacksServed counts packets resent from the receiver buffer, accessed atomically
+	nacksServed uint64
+
+	onCloseHandler func()
 }
 
 func NewRouter(tid string, receiver Receiver) *Router {
@@ -25,6 +31,7 @@ func NewRouter(tid string, receiver Receiver) *Router {
 		tid:      tid,
 		receiver: receiver,
 		senders:  make(map[string]Sender),
+		muter:    newRTPMuter(receiver.Track()),
 	}
 
 	go r.start()
@@ -32,6 +39,11 @@ func NewRouter(tid string, receiver Receiver) *Router {
 	return r
 }
 
+// TransportID returns the id of the transport publishing the track
+func (r *Router) TransportID() string {
+	return r.tid
+}
+
 func (r *Router) Track() *webrtc.Track {
 	return r.receiver.Track()
 }
@@ -50,10 +62,67 @@ func (r *Router) DelSub(pid string) {
 	r.mu.Unlock()
 }
 
+// sender returns the sender attached for pid
+func (r *Router) sender(pid string) Sender {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.senders[pid]
+}
+
+// SetMuted stops or resumes forwarding the track, reports whether the state changed.
+// Webrtc video publishers are capped with remb while muted so they stop
+// spending their uplink. Video resumes on a keyframe requested from the publisher.
+func (r *Router) SetMuted(muted bool) bool {
+	r.mu.Lock()
+	changed, keyframe := r.muter.setMuted(muted)
+	r.mu.Unlock()
+
+	if v, ok := r.receiver.(*WebRTCVideoReceiver); ok && changed {
+		v.setMuted(muted)
+	}
+
+	if keyframe {
+		err := r.receiver.WriteRTCP(&rtcp.PictureLossIndication{MediaSSRC: r.Track().SSRC()})
+		if err != nil {
+			logrus.Errorf("Error writing pli RTCP %s", err)
+		}
+	}
+	return changed
+}
+
+// Muted reports whether the track is muted
+func (r *Router) Muted() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.muter.muted
+}
+
+// RemoveSender detaches and closes a sender
+func (r *Router) RemoveSender(pid string) {
+	r.mu.Lock()
+	sub := r.senders[pid]
+	delete(r.senders, pid)
+	r.mu.Unlock()
+
+	if sub != nil {
+		sub.Close()
+	}
+}
+
+// OnClose is called once the router is closed
+func (r *Router) OnClose(f func()) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.onCloseHandler = f
+}
+
 func (r *Router) Close() {
 	logrus.Debugln("Router close")
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	if r.stop {
+		r.mu.Unlock()
+		return
+	}
 	r.stop = true
 
 	for pid, sub := range r.senders {
@@ -61,6 +130,12 @@ func (r *Router) Close() {
 		delete(r.senders, pid)
 	}
 	r.receiver.Close()
+	f := r.onCloseHandler
+	r.mu.Unlock()
+
+	if f != nil {
+		f()
+	}
 }
 
 func (r *Router) start() {
@@ -91,6 +166,13 @@ func (r *Router) start() {
 			continue
 		}
 
+		r.mu.Lock()
+		pkt, ok := r.muter.forward(pkt)
+		r.mu.Unlock()
+		if !ok {
+			continue
+		}
+
 		r.mu.RLock()
 		for _, sub := range r.senders {
 			sub.WriteRTP(pkt)
@@ -117,14 +199,26 @@ func (r *Router) subFeedbackLoop(sub Sender) {
 			return
 		}
 
+		r.mu.RLock()
+		muted, muter := r.muter.muted, r.muter
+		r.mu.RUnlock()
+		if muted {
+			// nothing is forwarded, keyframe requests and nacks are moot
+			continue
+		}
+
 		switch pkt := pkt.(type) {
 		case *rtcp.TransportLayerNack:
 			//log.Tracef("Router got nack: %+v", pkt)
 			for _, pair := range pkt.Nacks {
-				bufferpkt := r.receiver.GetPacket(pair.PacketID)
+				sn := muter.original(pair.PacketID)
+				bufferpkt := r.receiver.GetPacket(sn)
 				if bufferpkt != nil {
 					// We found the packet in the buffer, resend to sub
-					sub.WriteRTP(bufferpkt)
+					resend := *bufferpkt
+					resend.SequenceNumber = pair.PacketID
+					sub.WriteRTP(&resend)
+					atomic.AddUint64(&r.nacksServed, 1)
 					continue
 				}
 
@@ -133,7 +227,7 @@ func (r *Router) subFeedbackLoop(sub Sender) {
 					//origin ssrc
 					SenderSSRC: pkt.SenderSSRC,
 					MediaSSRC:  pkt.MediaSSRC,
-					Nacks:      []rtcp.NackPair{{PacketID: pair.PacketID}},
+					Nacks:      []rtcp.NackPair{{PacketID: sn}},
 				}
 				err = r.receiver.WriteRTCP(nack)
 				if err != nil {
@@ -149,17 +243,32 @@ func (r *Router) subFeedbackLoop(sub Sender) {
 	}
 }
 
-func (r *Router) stats() string {
-	info := fmt.Sprintf("    track router id: %s ssrc: %d | %s\n", r.receiver.Track().ID(), r.receiver.Track().SSRC(), r.receiver.stats())
+func (r *Router) stats() RouterStats {
+	track := r.Track()
+	stats := RouterStats{
+		TrackID:     track.ID(),
+		Kind:        track.Kind().String(),
+		SSRC:        track.SSRC(),
+		NACKsServed: atomic.LoadUint64(&r.nacksServed),
+		Receiver:    r.receiver.stats(),
+		Senders:     []SenderStats{},
+	}
 
-	if len(r.senders) < 6 {
-		for pid, sub := range r.senders {
-			info += fmt.Sprintf("      sender: %s | %s\n", pid, sub.stats())
-		}
-		info += "\n"
-	} else {
-		info += fmt.Sprintf("      senders: %d\n\n", len(r.senders))
+	r.mu.RLock()
+	stats.Muted = r.muter.muted
+	senders := make(map[string]Sender, len(r.senders))
+	for pid, sender := range r.senders {
+		senders[pid] = sender
 	}
+	r.mu.RUnlock()
 
-	return info
+	for pid, sender := range senders {
+		s := sender.stats()
+		s.ID, s.Kind = pid, senderKind(sender)
+		stats.Senders = append(stats.Senders, s)
+	}
+	sort.Slice(stats.Senders, func(i, j int) bool {
+		return stats.Senders[i].ID < stats.Senders[j].ID
+	})
+	return stats
 }
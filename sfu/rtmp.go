@@ -0,0 +1,588 @@
+package sfu
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rtmpVersion       = 3
+	rtmpHandshakeSize = 1536
+	rtmpDefaultChunk  = 128
+	rtmpServerChunk   = 4096
+	rtmpWindowAckSize = 2500000
+
+	rtmpMsgSetChunkSize     = 1
+	rtmpMsgAbort            = 2
+	rtmpMsgAck              = 3
+	rtmpMsgUserControl      = 4
+	rtmpMsgWindowAckSize    = 5
+	rtmpMsgSetPeerBandwidth = 6
+	rtmpMsgAudio            = 8
+	rtmpMsgVideo            = 9
+	rtmpMsgDataAMF3         = 15
+	rtmpMsgCommandAMF3      = 17
+	rtmpMsgDataAMF0         = 18
+	rtmpMsgCommandAMF0      = 20
+
+	rtmpControlCSID = 2
+	rtmpCommandCSID = 3
+	rtmpStatusCSID  = 5
+
+	// commands are a few hundred bytes, larger payloads are not decoded
+	amfMaxPayload = 64 * 1024
+	// objects and arrays nest no deeper than this
+	amfMaxDepth = 16
+)
+
+type rtmpMessage struct {
+	typeID    uint8
+	timestamp uint32
+	streamID  uint32
+	payload   []byte
+}
+
+type rtmpChunkStream struct {
+	timestamp uint32
+	tsField   uint32
+	length    uint32
+	typeID    uint8
+	streamID  uint32
+	extended  bool
+	buf       []byte
+}
+
+// countingReader counts the bytes read for acknowledgements
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// rtmpConn is the server side of an rtmp connection
+type rtmpConn struct {
+	conn       net.Conn
+	counter    *countingReader
+	r          *bufio.Reader
+	w          *bufio.Writer
+	chunkSize  uint32
+	windowSize uint32
+	lastAck    uint64
+	streams    map[uint32]*rtmpChunkStream
+}
+
+func newRTMPConn(conn net.Conn) *rtmpConn {
+	counter := &countingReader{r: conn}
+	return &rtmpConn{
+		conn:      conn,
+		counter:   counter,
+		r:         bufio.NewReader(counter),
+		w:         bufio.NewWriter(conn),
+		chunkSize: rtmpDefaultChunk,
+		streams:   make(map[uint32]*rtmpChunkStream),
+	}
+}
+
+// handshake performs the simple (non digest) handshake
+func (c *rtmpConn) handshake() error {
+	c0c1 := make([]byte, 1+rtmpHandshakeSize)
+	if _, err := io.ReadFull(c.r, c0c1); err != nil {
+		return err
+	}
+	if c0c1[0] != rtmpVersion {
+		return errRTMPHandshake
+	}
+
+	s1 := make([]byte, rtmpHandshakeSize)
+	if _, err := rand.Read(s1[8:]); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(s1[0:4], 0)
+	binary.BigEndian.PutUint32(s1[4:8], 0)
+
+	if err := c.w.WriteByte(rtmpVersion); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(s1); err != nil {
+		return err
+	}
+	// s2 echoes c1
+	if _, err := c.w.Write(c0c1[1:]); err != nil {
+		return err
+	}
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, rtmpHandshakeSize)
+	_, err := io.ReadFull(c.r, c2)
+	return err
+}
+
+// readMessage reads chunks until a message is complete, protocol control
+// messages are handled here
+func (c *rtmpConn) readMessage() (*rtmpMessage, error) {
+	for {
+		msg, err := c.readChunk()
+		if err != nil {
+			return nil, err
+		}
+
+		if c.windowSize > 0 && c.counter.n-c.lastAck >= uint64(c.windowSize) {
+			c.lastAck = c.counter.n
+			if err := c.writeControl(rtmpMsgAck, be32(uint32(c.counter.n))); err != nil {
+				return nil, err
+			}
+		}
+
+		if msg == nil {
+			continue
+		}
+
+		switch msg.typeID {
+		case rtmpMsgSetChunkSize:
+			if len(msg.payload) < 4 {
+				return nil, errRTMPChunk
+			}
+			c.chunkSize = binary.BigEndian.Uint32(msg.payload) & 0x7fffffff
+			if c.chunkSize == 0 {
+				return nil, errRTMPChunk
+			}
+		case rtmpMsgAbort:
+			if len(msg.payload) >= 4 {
+				if cs, ok := c.streams[binary.BigEndian.Uint32(msg.payload)]; ok {
+					cs.buf = nil
+				}
+			}
+		case rtmpMsgWindowAckSize:
+			if len(msg.payload) >= 4 {
+				c.windowSize = binary.BigEndian.Uint32(msg.payload)
+			}
+		case rtmpMsgAck, rtmpMsgUserControl, rtmpMsgSetPeerBandwidth:
+		default:
+			return msg, nil
+		}
+	}
+}
+
+// readChunk reads a single chunk, returning the message it completes if any
+func (c *rtmpConn) readChunk() (*rtmpMessage, error) {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	format := b >> 6
+	csid := uint32(b & 0x3f)
+	switch csid {
+	case 0:
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		csid = uint32(b) + 64
+	case 1:
+		var buf [2]byte
+		if _, err := io.ReadFull(c.r, buf[:]); err != nil {
+			return nil, err
+		}
+		csid = uint32(buf[1])<<8 + uint32(buf[0]) + 64
+	}
+
+	cs, ok := c.streams[csid]
+	if !ok {
+		if format != 0 {
+			return nil, errRTMPChunk
+		}
+		cs = &rtmpChunkStream{}
+		c.streams[csid] = cs
+	}
+
+	headerSize := [4]int{11, 7, 3, 0}[format]
+	var header [11]byte
+	if _, err := io.ReadFull(c.r, header[:headerSize]); err != nil {
+		return nil, err
+	}
+
+	newMessage := len(cs.buf) == 0
+	if format <= 2 {
+		cs.tsField = uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+		cs.extended = cs.tsField == 0xffffff
+	}
+	if format <= 1 {
+		cs.length = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+		cs.typeID = header[6]
+	}
+	if format == 0 {
+		cs.streamID = binary.LittleEndian.Uint32(header[7:11])
+	}
+
+	if cs.extended {
+		var ext [4]byte
+		if _, err := io.ReadFull(c.r, ext[:]); err != nil {
+			return nil, err
+		}
+		if format <= 2 {
+			cs.tsField = binary.BigEndian.Uint32(ext[:])
+		}
+	}
+
+	if newMessage {
+		if format == 0 {
+			cs.timestamp = cs.tsField
+		} else {
+			cs.timestamp += cs.tsField
+		}
+	}
+
+	remaining := cs.length - uint32(len(cs.buf))
+	size := remaining
+	if size > c.chunkSize {
+		size = c.chunkSize
+	}
+
+	start := len(cs.buf)
+	cs.buf = append(cs.buf, make([]byte, size)...)
+	if _, err := io.ReadFull(c.r, cs.buf[start:]); err != nil {
+		return nil, err
+	}
+
+	if uint32(len(cs.buf)) < cs.length {
+		return nil, nil
+	}
+
+	msg := &rtmpMessage{
+		typeID:    cs.typeID,
+		timestamp: cs.timestamp,
+		streamID:  cs.streamID,
+		payload:   cs.buf,
+	}
+	cs.buf = nil
+	return msg, nil
+}
+
+// writeMessage writes a message split in chunks of the server chunk size
+func (c *rtmpConn) writeMessage(csid uint32, msg *rtmpMessage) error {
+	header := make([]byte, 12)
+	header[0] = byte(csid & 0x3f)
+	ts := msg.timestamp
+	if ts >= 0xffffff {
+		ts = 0xffffff
+	}
+	header[1], header[2], header[3] = byte(ts>>16), byte(ts>>8), byte(ts)
+	l := len(msg.payload)
+	header[4], header[5], header[6] = byte(l>>16), byte(l>>8), byte(l)
+	header[7] = msg.typeID
+	binary.LittleEndian.PutUint32(header[8:], msg.streamID)
+
+	if _, err := c.w.Write(header); err != nil {
+		return err
+	}
+	if ts == 0xffffff {
+		if _, err := c.w.Write(be32(msg.timestamp)); err != nil {
+			return err
+		}
+	}
+
+	payload := msg.payload
+	for {
+		n := len(payload)
+		if n > rtmpServerChunk {
+			n = rtmpServerChunk
+		}
+		if _, err := c.w.Write(payload[:n]); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if len(payload) == 0 {
+			break
+		}
+		if err := c.w.WriteByte(0xc0 | byte(csid&0x3f)); err != nil {
+			return err
+		}
+		if ts == 0xffffff {
+			if _, err := c.w.Write(be32(msg.timestamp)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.w.Flush()
+}
+
+func (c *rtmpConn) writeControl(typeID uint8, payload []byte) error {
+	return c.writeMessage(rtmpControlCSID, &rtmpMessage{typeID: typeID, payload: payload})
+}
+
+func (c *rtmpConn) writeCommand(csid, streamID uint32, values ...interface{}) error {
+	payload, err := amfEncode(values...)
+	if err != nil {
+		return err
+	}
+	return c.writeMessage(csid, &rtmpMessage{typeID: rtmpMsgCommandAMF0, streamID: streamID, payload: payload})
+}
+
+// amfObject is an amf0 object or ecma array
+type amfObject map[string]interface{}
+
+// amfDecode decodes all amf0 values of a payload
+func amfDecode(b []byte) ([]interface{}, error) {
+	if len(b) > amfMaxPayload {
+		return nil, errAMF
+	}
+
+	var values []interface{}
+	for len(b) > 0 {
+		v, n, err := amfDecodeValue(b, 0)
+		if err != nil {
+			return values, err
+		}
+		values = append(values, v)
+		b = b[n:]
+	}
+	return values, nil
+}
+
+func amfDecodeValue(b []byte, depth int) (interface{}, int, error) {
+	if len(b) == 0 || depth > amfMaxDepth {
+		return nil, 0, errAMF
+	}
+
+	switch b[0] {
+	case 0x00: // number
+		if len(b) < 9 {
+			return nil, 0, errAMF
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b[1:9])), 9, nil
+	case 0x01: // boolean
+		if len(b) < 2 {
+			return nil, 0, errAMF
+		}
+		return b[1] != 0, 2, nil
+	case 0x02: // string
+		s, n, err := amfDecodeString(b[1:], 2)
+		return s, n + 1, err
+	case 0x0c: // long string
+		s, n, err := amfDecodeString(b[1:], 4)
+		return s, n + 1, err
+	case 0x03: // object
+		obj, n, err := amfDecodeObject(b[1:], depth+1)
+		return obj, n + 1, err
+	case 0x08: // ecma array
+		if len(b) < 5 {
+			return nil, 0, errAMF
+		}
+		obj, n, err := amfDecodeObject(b[5:], depth+1)
+		return obj, n + 5, err
+	case 0x0a: // strict array
+		if len(b) < 5 {
+			return nil, 0, errAMF
+		}
+		count := int(binary.BigEndian.Uint32(b[1:5]))
+		// every value takes at least a byte, larger counts are bogus
+		if count > len(b[5:]) {
+			return nil, 0, errAMF
+		}
+		values := make([]interface{}, 0, count)
+		pos := 5
+		for i := 0; i < count; i++ {
+			v, n, err := amfDecodeValue(b[pos:], depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			values = append(values, v)
+			pos += n
+		}
+		return values, pos, nil
+	case 0x05, 0x06: // null, undefined
+		return nil, 1, nil
+	}
+
+	return nil, 0, fmt.Errorf("%w: marker %d", errAMF, b[0])
+}
+
+func amfDecodeString(b []byte, lenSize int) (string, int, error) {
+	if len(b) < lenSize {
+		return "", 0, errAMF
+	}
+	var l int
+	if lenSize == 2 {
+		l = int(binary.BigEndian.Uint16(b))
+	} else {
+		l = int(binary.BigEndian.Uint32(b))
+	}
+	if len(b) < lenSize+l {
+		return "", 0, errAMF
+	}
+	return string(b[lenSize : lenSize+l]), lenSize + l, nil
+}
+
+func amfDecodeObject(b []byte, depth int) (amfObject, int, error) {
+	obj := make(amfObject)
+	pos := 0
+	for {
+		if len(b) >= pos+3 && b[pos] == 0 && b[pos+1] == 0 && b[pos+2] == 0x09 {
+			return obj, pos + 3, nil
+		}
+		key, n, err := amfDecodeString(b[pos:], 2)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += n
+		v, n, err := amfDecodeValue(b[pos:], depth)
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += n
+		obj[key] = v
+	}
+}
+
+// amfEncode encodes values as amf0
+func amfEncode(values ...interface{}) ([]byte, error) {
+	var b []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			b = append(b, 0x05)
+		case float64:
+			b = append(b, 0x00)
+			b = append(b, be64(math.Float64bits(v))...)
+		case int:
+			b = append(b, 0x00)
+			b = append(b, be64(math.Float64bits(float64(v)))...)
+		case bool:
+			if v {
+				b = append(b, 0x01, 1)
+			} else {
+				b = append(b, 0x01, 0)
+			}
+		case string:
+			b = append(b, 0x02)
+			b = append(b, be16(uint16(len(v)))...)
+			b = append(b, v...)
+		case amfObject:
+			b = append(b, 0x03)
+			// sorted for a deterministic encoding
+			keys := make([]string, 0, len(v))
+			for k := range v {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				b = append(b, be16(uint16(len(k)))...)
+				b = append(b, k...)
+				enc, err := amfEncode(v[k])
+				if err != nil {
+					return nil, err
+				}
+				b = append(b, enc...)
+			}
+			b = append(b, 0, 0, 0x09)
+		default:
+			return nil, fmt.Errorf("%w: type %T", errAMF, v)
+		}
+	}
+	return b, nil
+}
+
+// acceptPublish answers the commands of a client up to its publish command,
+// returning once its stream key is authorized
+func (c *rtmpConn) acceptPublish(authorize func(key string) bool) error {
+	for {
+		msg, err := c.readMessage()
+		if err != nil {
+			return err
+		}
+
+		payload := msg.payload
+		switch msg.typeID {
+		case rtmpMsgCommandAMF3:
+			// amf3 commands are amf0 encoded after a format byte
+			if len(payload) == 0 {
+				continue
+			}
+			payload = payload[1:]
+		case rtmpMsgCommandAMF0:
+		default:
+			continue
+		}
+
+		values, err := amfDecode(payload)
+		if err != nil || len(values) < 2 {
+			return errAMF
+		}
+		name, _ := values[0].(string)
+		txID, _ := values[1].(float64)
+
+		switch name {
+		case "connect":
+			if err := c.writeControl(rtmpMsgWindowAckSize, be32(rtmpWindowAckSize)); err != nil {
+				return err
+			}
+			// dynamic limit type
+			if err := c.writeControl(rtmpMsgSetPeerBandwidth, append(be32(rtmpWindowAckSize), 2)); err != nil {
+				return err
+			}
+			if err := c.writeControl(rtmpMsgSetChunkSize, be32(rtmpServerChunk)); err != nil {
+				return err
+			}
+			if err := c.writeCommand(rtmpCommandCSID, 0, "_result", txID,
+				amfObject{"fmsVer": "FMS/3,0,1,123", "capabilities": 31.0},
+				amfObject{
+					"level":          "status",
+					"code":           "NetConnection.Connect.Success",
+					"description":    "Connection succeeded.",
+					"objectEncoding": 0.0,
+				},
+			); err != nil {
+				return err
+			}
+		case "createStream":
+			if err := c.writeCommand(rtmpCommandCSID, 0, "_result", txID, nil, 1.0); err != nil {
+				return err
+			}
+		case "publish":
+			var key string
+			if len(values) > 3 {
+				key, _ = values[3].(string)
+			}
+
+			if !authorize(key) {
+				_ = c.writeCommand(rtmpStatusCSID, msg.streamID, "onStatus", 0.0, nil, amfObject{
+					"level":       "error",
+					"code":        "NetStream.Publish.BadName",
+					"description": "Invalid stream key.",
+				})
+				return errStreamKeyInvalid
+			}
+
+			if err := c.writeCommand(rtmpStatusCSID, msg.streamID, "onStatus", 0.0, nil, amfObject{
+				"level":       "status",
+				"code":        "NetStream.Publish.Start",
+				"description": "Publishing.",
+			}); err != nil {
+				return err
+			}
+			return nil
+		case "play", "deleteStream", "closeStream":
+			return errRTMPNotPublishing
+		default:
+			// releaseStream, FCPublish and the like need no answer
+			logrus.Debugf("rtmp ignoring command %s", name)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package sfu
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// amfNested encodes objects nested depth times, each holding the next under
+// an empty key
+func amfNested(depth int) []byte {
+	b := bytes.Repeat([]byte{0x03, 0x00, 0x00}, depth)
+	b = append(b, 0x05)
+	return append(b, bytes.Repeat([]byte{0x00, 0x00, 0x09}, depth)...)
+}
+
+func TestAMFDecodeLimits(t *testing.T) {
+	connect, err := amfEncode("connect", 1, amfObject{"app": "live", "tcUrl": "rtmp://localhost/live"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		err     error
+	}{
+		{"connect", connect, nil},
+		{"nested", amfNested(amfMaxDepth), nil},
+		{"too deep", amfNested(amfMaxDepth + 1), errAMF},
+		// stays within the payload limit, would exhaust the stack unbounded
+		{"deeply nested", amfNested(amfMaxPayload/6 - 1), errAMF},
+		{"strict arrays", append(bytes.Repeat([]byte{0x0a, 0x00, 0x00, 0x00, 0x01}, 10000), 0x05), errAMF},
+		{"oversized", append(connect, bytes.Repeat([]byte{0x05}, amfMaxPayload)...), errAMF},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			values, err := amfDecode(tc.payload)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("got %v, want %v", err, tc.err)
+			}
+			if err == nil && len(values) == 0 {
+				t.Fatal("no values decoded")
+			}
+		})
+	}
+}
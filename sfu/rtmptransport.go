@@ -0,0 +1,377 @@
+package sfu
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// rtp payload size of repacketized rtmp video
+	rtmpPacketMTU = 1200
+	// publishers send at least a frame each few seconds
+	rtmpReadTimeout = 30 * time.Second
+
+	flvCodecAVC        = 7
+	flvFrameKey        = 1
+	flvAVCSequence     = 0
+	flvAVCNALU         = 1
+	flvSoundFormatAAC  = 10
+	flvSoundFormatBits = 4
+)
+
+// RTMPTransport receives a flv stream from an rtmp publisher and publishes its
+// h264 video to the session. Audio is dropped until transcoding to opus exists.
+type RTMPTransport struct {
+	id         string
+	mu         sync.RWMutex
+	stop       bool
+	session    *Session
+	conn       *rtmpConn
+	routers    map[uint32]*Router
+	video      *RTMPReceiver
+	sps        []byte
+	pps        []byte
+	lengthSize int
+	dropped    map[string]bool
+}
+
+// newRTMPTransport creates a new RTMPTransport of a connection that started publishing
+func newRTMPTransport(session *Session, conn *rtmpConn) *RTMPTransport {
+	t := &RTMPTransport{
+		id:      cuid.New(),
+		session: session,
+		conn:    conn,
+		routers: make(map[uint32]*Router),
+		dropped: make(map[string]bool),
+	}
+
+	session.AddTransport(t)
+
+	go t.readLoop()
+
+	return t
+}
+
+// ID of transport
+func (t *RTMPTransport) ID() string {
+	return t.id
+}
+
+// Routers returns routers for this transport
+func (t *RTMPTransport) Routers() map[uint32]*Router {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	// routers are created as their first frame arrives
+	routers := make(map[uint32]*Router, len(t.routers))
+	for ssrc, router := range t.routers {
+		routers[ssrc] = router
+	}
+	return routers
+}
+
+// GetRouter returns router with ssrc
+func (t *RTMPTransport) GetRouter(ssrc uint32) *Router {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.routers[ssrc]
+}
+
+// NewSender is not supported, rtmp transports only ingest tracks
+func (t *RTMPTransport) NewSender(track *webrtc.Track) (Sender, error) {
+	return nil, errMethodNotSupported
+}
+
+// Close transport
+func (t *RTMPTransport) Close() error {
+	t.mu.Lock()
+	if t.stop {
+		t.mu.Unlock()
+		return nil
+	}
+	t.stop = true
+	routers := make([]*Router, 0, len(t.routers))
+	for _, router := range t.routers {
+		routers = append(routers, router)
+	}
+	t.mu.Unlock()
+
+	// routers remove their tracks from the session when closed, which locks it
+	for _, router := range routers {
+		router.Close()
+	}
+
+	t.session.RemoveTransport(t.id)
+
+	return t.conn.conn.Close()
+}
+
+func (t *RTMPTransport) readLoop() {
+	for {
+		_ = t.conn.conn.SetReadDeadline(time.Now().Add(rtmpReadTimeout))
+		msg, err := t.conn.readMessage()
+		if err != nil {
+			t.mu.RLock()
+			stop := t.stop
+			t.mu.RUnlock()
+			if !stop {
+				logrus.Infof("rtmp transport %s closed: %v", t.id, err)
+				_ = t.Close()
+			}
+			return
+		}
+
+		switch msg.typeID {
+		case rtmpMsgVideo:
+			t.handleVideo(msg)
+		case rtmpMsgAudio:
+			t.handleAudio(msg)
+		case rtmpMsgCommandAMF0:
+			values, err := amfDecode(msg.payload)
+			if err != nil || len(values) == 0 {
+				continue
+			}
+			switch values[0] {
+			case "FCUnpublish", "deleteStream", "closeStream":
+				logrus.Infof("rtmp transport %s unpublished", t.id)
+				_ = t.Close()
+				return
+			}
+		}
+	}
+}
+
+func (t *RTMPTransport) handleVideo(msg *rtmpMessage) {
+	if len(msg.payload) < 5 {
+		return
+	}
+
+	if codec := msg.payload[0] & 0x0f; codec != flvCodecAVC {
+		t.dropOnce(fmt.Sprintf("flv video codec %d", codec))
+		return
+	}
+
+	keyframe := msg.payload[0]>>4 == flvFrameKey
+	// composition time is a signed 24 bit offset
+	cts := int32(uint32(msg.payload[2])<<16|uint32(msg.payload[3])<<8|uint32(msg.payload[4])) << 8 >> 8
+	data := msg.payload[5:]
+
+	switch msg.payload[1] {
+	case flvAVCSequence:
+		if err := t.setDecoderConfig(data); err != nil {
+			logrus.Errorf("rtmp transport %s bad avc decoder config: %v", t.id, err)
+		}
+	case flvAVCNALU:
+		recv := t.receiver()
+		if recv == nil {
+			return
+		}
+
+		t.mu.RLock()
+		lengthSize, sps, pps := t.lengthSize, t.sps, t.pps
+		t.mu.RUnlock()
+
+		var nalus [][]byte
+		hasParams := false
+		for len(data) >= lengthSize {
+			var size int
+			for _, b := range data[:lengthSize] {
+				size = size<<8 | int(b)
+			}
+			data = data[lengthSize:]
+			if size == 0 || size > len(data) {
+				break
+			}
+
+			nalu := data[:size]
+			data = data[size:]
+			switch nalu[0] & 0x1f {
+			case naluTypeSPS, naluTypePPS:
+				hasParams = true
+			case naluTypeIDR:
+				keyframe = true
+			}
+			nalus = append(nalus, nalu)
+		}
+		if len(nalus) == 0 {
+			return
+		}
+
+		// parameter sets only come in the sequence header, decoders joining
+		// later need them in band before each keyframe
+		if keyframe && !hasParams {
+			nalus = append([][]byte{sps, pps}, nalus...)
+		}
+
+		pts := (int64(msg.timestamp) + int64(cts)) * int64(videoClock) / 1000
+		recv.writeFrame(uint32(pts), nalus)
+	}
+}
+
+// setDecoderConfig parses an AVCDecoderConfigurationRecord, ISO/IEC 14496-15 5.2.4.1
+func (t *RTMPTransport) setDecoderConfig(b []byte) error {
+	if len(b) < 7 {
+		return errSPSTruncated
+	}
+	lengthSize := int(b[4]&0x03) + 1
+
+	var sps, pps []byte
+	pos := 5
+	for n, set := range []*[]byte{&sps, &pps} {
+		if pos >= len(b) {
+			return errSPSTruncated
+		}
+		count := int(b[pos])
+		if n == 0 {
+			count &= 0x1f
+		}
+		pos++
+		for i := 0; i < count; i++ {
+			if pos+2 > len(b) {
+				return errSPSTruncated
+			}
+			size := int(binary.BigEndian.Uint16(b[pos:]))
+			pos += 2
+			if pos+size > len(b) || size == 0 {
+				return errSPSTruncated
+			}
+			// only the first parameter set of each kind is used
+			if *set == nil {
+				*set = append([]byte{}, b[pos:pos+size]...)
+			}
+			pos += size
+		}
+	}
+	if sps == nil || pps == nil || len(sps) < 4 {
+		return errSPSTruncated
+	}
+
+	t.mu.Lock()
+	t.lengthSize, t.sps, t.pps = lengthSize, sps, pps
+	t.mu.Unlock()
+	return nil
+}
+
+// receiver returns the video receiver, creating its router once the decoder
+// config is known
+func (t *RTMPTransport) receiver() *RTMPReceiver {
+	t.mu.Lock()
+	if t.stop || t.sps == nil {
+		t.mu.Unlock()
+		return nil
+	}
+
+	if t.video != nil {
+		t.mu.Unlock()
+		return t.video
+	}
+
+	fmtp := fmt.Sprintf("level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=%02x%02x%02x",
+		t.sps[1], t.sps[2], t.sps[3])
+	codec, err := newRTPCodec(webrtc.H264, webrtc.DefaultPayloadTypeH264, videoClock, fmtp)
+	if err != nil {
+		t.mu.Unlock()
+		logrus.Errorf("rtmp transport %s codec err: %v", t.id, err)
+		return nil
+	}
+
+	track, err := webrtc.NewTrack(webrtc.DefaultPayloadTypeH264, randomSSRC(), cuid.New(), t.id, codec)
+	if err != nil {
+		t.mu.Unlock()
+		logrus.Errorf("rtmp transport %s track err: %v", t.id, err)
+		return nil
+	}
+
+	t.video = NewRTMPReceiver(track)
+	router := NewRouter(t.id, t.video)
+	t.routers[track.SSRC()] = router
+	t.mu.Unlock()
+
+	logrus.Debugf("Created router %s %d", t.id, track.SSRC())
+
+	t.session.AddRouter(router)
+
+	return t.video
+}
+
+func (t *RTMPTransport) handleAudio(msg *rtmpMessage) {
+	if len(msg.payload) == 0 {
+		return
+	}
+
+	if format := msg.payload[0] >> flvSoundFormatBits; format == flvSoundFormatAAC {
+		t.dropOnce("aac audio")
+	} else {
+		t.dropOnce(fmt.Sprintf("flv audio format %d", format))
+	}
+}
+
+// dropOnce logs media the transport can't publish the first time it is seen
+func (t *RTMPTransport) dropOnce(what string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dropped[what] {
+		return
+	}
+	t.dropped[what] = true
+	logrus.Infof("rtmp transport %s dropping %s, not supported", t.id, what)
+}
+
+func (t *RTMPTransport) stats() TransportStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return TransportStats{ID: t.id, Kind: transportKind(t), Remote: t.conn.conn.RemoteAddr().String(), Routers: routerStats(t.routers)}
+}
+
+// serveRTMP handles a connection until its publisher leaves
+func (s *SFU) serveRTMP(nc net.Conn) {
+	c := newRTMPConn(nc)
+	_ = nc.SetDeadline(time.Now().Add(rtmpReadTimeout))
+
+	if err := c.handshake(); err != nil {
+		logrus.Debugf("rtmp %s handshake err: %v", nc.RemoteAddr(), err)
+		_ = nc.Close()
+		return
+	}
+
+	var sid string
+	err := c.acceptPublish(func(key string) bool {
+		var ok bool
+		sid, ok = config.RTMP.StreamKeys[key]
+		return ok && key != ""
+	})
+	if err != nil {
+		logrus.Infof("rtmp %s publish rejected: %v", nc.RemoteAddr(), err)
+		_ = nc.Close()
+		return
+	}
+	_ = nc.SetDeadline(time.Time{})
+
+	session := s.GetSession(sid)
+	if session == nil {
+		session = s.newSession(sid)
+	}
+
+	t := newRTMPTransport(session, c)
+	logrus.Infof("rtmp transport %s publishing to session %s", t.ID(), sid)
+}
+
+// randomSSRC returns a random non zero ssrc, RFC 3550 8.1
+func randomSSRC() uint32 {
+	var b [4]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		if ssrc := binary.BigEndian.Uint32(b[:]); ssrc != 0 {
+			return ssrc
+		}
+	}
+}
@@ -0,0 +1,433 @@
+package sfu
+
+import (
+	"bufio"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rtspProto       = "RTSP/1.0"
+	rtspDefaultPort = "554"
+	rtspUserAgent   = "rtc-sfu"
+	// rtsp sessions time out after 60s unless the server says otherwise
+	rtspDefaultTimeout = 60 * time.Second
+	rtspDialTimeout    = 10 * time.Second
+)
+
+// rtspRequest is an rtsp request, RFC 2326 6
+type rtspRequest struct {
+	method string
+	url    string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// rtspResponse is an rtsp response, RFC 2326 7
+type rtspResponse struct {
+	status int
+	reason string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func (r *rtspRequest) write(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s %s %s\r\n", r.method, r.url, rtspProto)
+	writeRTSPHeader(b, r.header, len(r.body))
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+	_, err := w.Write(r.body)
+	return err
+}
+
+func (r *rtspResponse) write(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "%s %d %s\r\n", rtspProto, r.status, r.reason)
+	writeRTSPHeader(b, r.header, len(r.body))
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+	_, err := w.Write(r.body)
+	return err
+}
+
+// writeRTSPHeader writes CSeq first, some servers expect it there
+func writeRTSPHeader(b *strings.Builder, header textproto.MIMEHeader, bodyLen int) {
+	if v := header.Get("CSeq"); v != "" {
+		fmt.Fprintf(b, "CSeq: %s\r\n", v)
+	}
+
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		if k != "Cseq" && k != "Content-Length" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			fmt.Fprintf(b, "%s: %s\r\n", k, v)
+		}
+	}
+
+	if bodyLen > 0 {
+		fmt.Fprintf(b, "Content-Length: %d\r\n", bodyLen)
+	}
+	b.WriteString("\r\n")
+}
+
+func readRTSPHeader(r *bufio.Reader) (textproto.MIMEHeader, []byte, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var body []byte
+	if l := header.Get("Content-Length"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 {
+			return nil, nil, errRTSPMalformed
+		}
+		body = make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, nil, err
+		}
+	}
+	return header, body, nil
+}
+
+// readRTSPResponse reads a response whose first byte has not been consumed
+func readRTSPResponse(r *bufio.Reader) (*rtspResponse, error) {
+	line, err := textproto.NewReader(r).ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 || parts[0] != rtspProto {
+		return nil, errRTSPMalformed
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, errRTSPMalformed
+	}
+
+	res := &rtspResponse{status: status}
+	if len(parts) == 3 {
+		res.reason = parts[2]
+	}
+	res.header, res.body, err = readRTSPHeader(r)
+	return res, err
+}
+
+// readRTSPRequest reads a request whose first byte has not been consumed
+func readRTSPRequest(r *bufio.Reader) (*rtspRequest, error) {
+	line, err := textproto.NewReader(r).ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || parts[2] != rtspProto {
+		return nil, errRTSPMalformed
+	}
+
+	req := &rtspRequest{method: parts[0], url: parts[1]}
+	req.header, req.body, err = readRTSPHeader(r)
+	return req, err
+}
+
+// readInterleaved reads a frame interleaved in the rtsp connection, RFC 2326 10.12
+func readInterleaved(r *bufio.Reader) (byte, []byte, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	if head[0] != '$' {
+		return 0, nil, errRTSPMalformed
+	}
+
+	data := make([]byte, int(head[2])<<8|int(head[3]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return head[1], data, nil
+}
+
+func writeInterleaved(w io.Writer, channel byte, data []byte) error {
+	if len(data) > 0xffff {
+		return errRTSPMalformed
+	}
+	frame := make([]byte, 4, 4+len(data))
+	frame[0], frame[1] = '$', channel
+	frame[2], frame[3] = byte(len(data)>>8), byte(len(data))
+	_, err := w.Write(append(frame, data...))
+	return err
+}
+
+// parseRTSPSession splits the session header in its id and timeout
+func parseRTSPSession(v string) (string, time.Duration) {
+	timeout := rtspDefaultTimeout
+	parts := strings.Split(v, ";")
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "timeout=") {
+			if s, err := strconv.Atoi(strings.TrimPrefix(p, "timeout=")); err == nil && s > 0 {
+				timeout = time.Duration(s) * time.Second
+			}
+		}
+	}
+	return strings.TrimSpace(parts[0]), timeout
+}
+
+// parseInterleaved returns the rtp channel of a tcp transport header
+func parseInterleaved(transport string) (byte, bool) {
+	for _, p := range strings.Split(transport, ";") {
+		p = strings.TrimSpace(p)
+		if !strings.HasPrefix(p, "interleaved=") {
+			continue
+		}
+		channels := strings.Split(strings.TrimPrefix(p, "interleaved="), "-")
+		ch, err := strconv.ParseUint(channels[0], 10, 8)
+		if err != nil {
+			return 0, false
+		}
+		return byte(ch), true
+	}
+	return 0, false
+}
+
+// rtspClient is a client of a single rtsp presentation using interleaved tcp
+type rtspClient struct {
+	url     *url.URL
+	user    *url.Userinfo
+	conn    net.Conn
+	r       *bufio.Reader
+	mu      sync.Mutex
+	cseq    int
+	session string
+	timeout time.Duration
+	// digest challenge, basic auth when nonce is empty
+	realm string
+	nonce string
+	authz bool
+}
+
+func dialRTSP(rawurl string) (*rtspClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "rtsp" {
+		return nil, errRTSPScheme
+	}
+
+	user := u.User
+	u.User = nil
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), rtspDefaultPort)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, rtspDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rtspClient{
+		url:     u,
+		user:    user,
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		timeout: rtspDefaultTimeout,
+	}, nil
+}
+
+// request writes a request, its response must be read by the caller
+func (c *rtspClient) request(method, uri string, header textproto.MIMEHeader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if header == nil {
+		header = make(textproto.MIMEHeader)
+	}
+	c.cseq++
+	header.Set("CSeq", strconv.Itoa(c.cseq))
+	header.Set("User-Agent", rtspUserAgent)
+	if c.session != "" {
+		header.Set("Session", c.session)
+	}
+	if c.authz {
+		header.Set("Authorization", c.authorization(method, uri))
+	}
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(rtspDialTimeout))
+	return (&rtspRequest{method: method, url: uri, header: header}).write(c.conn)
+}
+
+// do sends a request and waits its response, authenticating once when challenged
+func (c *rtspClient) do(method, uri string, header textproto.MIMEHeader) (*rtspResponse, error) {
+	for {
+		if err := c.request(method, uri, header); err != nil {
+			return nil, err
+		}
+
+		_ = c.conn.SetReadDeadline(time.Now().Add(rtspDialTimeout))
+		res, err := readRTSPResponse(c.r)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.status == 401 && !c.authz && c.user != nil {
+			c.challenge(res.header["Www-Authenticate"])
+			c.authz = true
+			continue
+		}
+		if res.status != 200 {
+			return res, fmt.Errorf("rtsp %s %s: %d %s", method, uri, res.status, res.reason)
+		}
+		return res, nil
+	}
+}
+
+// challenge picks digest over basic authentication, RFC 2617
+func (c *rtspClient) challenge(values []string) {
+	for _, v := range values {
+		if !strings.HasPrefix(v, "Digest ") {
+			continue
+		}
+		for _, p := range strings.Split(strings.TrimPrefix(v, "Digest "), ",") {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "realm":
+				c.realm = strings.Trim(kv[1], `"`)
+			case "nonce":
+				c.nonce = strings.Trim(kv[1], `"`)
+			}
+		}
+		return
+	}
+}
+
+func (c *rtspClient) authorization(method, uri string) string {
+	pass, _ := c.user.Password()
+	if c.nonce == "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.user.Username()+":"+pass))
+	}
+
+	ha1 := md5Hex(c.user.Username() + ":" + c.realm + ":" + pass)
+	ha2 := md5Hex(method + ":" + uri)
+	return fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		c.user.Username(), c.realm, c.nonce, uri, md5Hex(ha1+":"+c.nonce+":"+ha2))
+}
+
+// setup requests a media over interleaved tcp, returning the rtp channel
+func (c *rtspClient) setup(uri string, channel byte) (byte, error) {
+	header := make(textproto.MIMEHeader)
+	header.Set("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1))
+
+	res, err := c.do("SETUP", uri, header)
+	if err != nil {
+		return 0, err
+	}
+
+	if v := res.header.Get("Session"); v != "" {
+		c.mu.Lock()
+		c.session, c.timeout = parseRTSPSession(v)
+		c.mu.Unlock()
+	}
+
+	if ch, ok := parseInterleaved(res.header.Get("Transport")); ok {
+		return ch, nil
+	}
+	return 0, errRTSPTransport
+}
+
+// keepalive refreshes the session until the connection is closed
+func (c *rtspClient) keepalive(done <-chan struct{}) {
+	c.mu.Lock()
+	timeout := c.timeout
+	c.mu.Unlock()
+
+	t := time.NewTicker(timeout / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			// the response is read and dropped with the interleaved media
+			if err := c.request("OPTIONS", c.url.String(), nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeInterleaved sends a frame to the server, e.g. rtcp feedback
+func (c *rtspClient) writeInterleaved(channel byte, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(rtspDialTimeout))
+	return writeInterleaved(c.conn, channel, data)
+}
+
+// read returns the next interleaved frame, skipping responses to keepalives
+func (c *rtspClient) read() (byte, []byte, error) {
+	for {
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if b[0] == '$' {
+			return readInterleaved(c.r)
+		}
+		if _, err := readRTSPResponse(c.r); err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+// Close the session and the connection
+func (c *rtspClient) Close() error {
+	c.mu.Lock()
+	session := c.session
+	c.mu.Unlock()
+	if session != "" {
+		_ = c.request("TEARDOWN", c.url.String(), nil)
+	}
+	return c.conn.Close()
+}
+
+// mediaURL resolves the control attribute of a media against the base url
+func mediaURL(base, control string) string {
+	switch {
+	case control == "" || control == "*":
+		return base
+	case strings.HasPrefix(control, "rtsp://"):
+		return control
+	}
+	return strings.TrimSuffix(base, "/") + "/" + control
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,372 @@
+package sfu
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// clients keep the session alive with rtcp or GET_PARAMETER
+	rtspSessionTimeout = 60
+	rtspWriteTimeout   = 5 * time.Second
+	rtspMethods        = "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"
+	rtspRealm          = "rtc"
+)
+
+// rtspSetup is a track set up by a client and its sender once playing
+type rtspSetup struct {
+	router  *Router
+	channel byte
+	sender  *RTSPSender
+}
+
+// rtspServerConn serves the tracks of a participant or a single track at
+// rtsp://host/:sid/:participant or rtsp://host/:sid/:track over interleaved tcp
+type rtspServerConn struct {
+	sfu       *SFU
+	conn      net.Conn
+	r         *bufio.Reader
+	wmu       sync.Mutex
+	mu        sync.Mutex
+	session   string
+	setups    map[string]*rtspSetup
+	authorize func(sid, token string) bool
+	// granted sessions, players may drop the query of later requests
+	granted map[string]bool
+}
+
+// serveRTSP handles the requests of a connection until it is closed
+func (s *SFU) serveRTSP(nc net.Conn, authorize func(sid, token string) bool) {
+	c := &rtspServerConn{
+		sfu:       s,
+		conn:      nc,
+		r:         bufio.NewReader(nc),
+		setups:    make(map[string]*rtspSetup),
+		authorize: authorize,
+		granted:   make(map[string]bool),
+	}
+	defer c.close()
+
+	for {
+		_ = nc.SetReadDeadline(time.Now().Add(2 * rtspSessionTimeout * time.Second))
+		b, err := c.r.Peek(1)
+		if err != nil {
+			return
+		}
+
+		if b[0] == '$' {
+			channel, data, err := readInterleaved(c.r)
+			if err != nil {
+				return
+			}
+			c.handleRTCP(channel, data)
+			continue
+		}
+
+		req, err := readRTSPRequest(c.r)
+		if err != nil {
+			logrus.Debugf("rtsp %s read err: %v", nc.RemoteAddr(), err)
+			return
+		}
+
+		res := c.handle(req)
+		res.header.Set("CSeq", req.header.Get("CSeq"))
+		if err := c.writeResponse(res); err != nil {
+			return
+		}
+	}
+}
+
+func (c *rtspServerConn) handle(req *rtspRequest) *rtspResponse {
+	res := &rtspResponse{status: 200, reason: "OK", header: make(textproto.MIMEHeader)}
+
+	switch req.method {
+	case "OPTIONS":
+		res.header.Set("Public", rtspMethods)
+		return res
+	case "GET_PARAMETER":
+		return res
+	}
+
+	u, err := url.Parse(req.url)
+	if err != nil {
+		return rtspError(400, "Bad Request")
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 {
+		return rtspError(404, "Not Found")
+	}
+	sid, id := parts[0], parts[1]
+
+	switch req.method {
+	case "DESCRIBE", "SETUP":
+		if !c.authorized(sid, req, u) {
+			res := rtspError(401, "Unauthorized")
+			res.header.Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", rtspRealm))
+			return res
+		}
+	}
+
+	switch req.method {
+	case "DESCRIBE":
+		routers := c.sfu.rtspRouters(sid, id)
+		if len(routers) == 0 {
+			return rtspError(404, "Not Found")
+		}
+		// the token stays out of the urls of the tracks
+		base := *u
+		base.RawQuery = ""
+		res.header.Set("Content-Type", "application/sdp")
+		res.header.Set("Content-Base", strings.TrimSuffix(base.String(), "/")+"/")
+		res.body = []byte(rtspSDP(id, routers))
+		return res
+
+	case "SETUP":
+		transport := req.header.Get("Transport")
+		if !strings.Contains(transport, "RTP/AVP/TCP") {
+			// players such as vlc and ffmpeg retry over tcp
+			return rtspError(461, "Unsupported Transport")
+		}
+
+		routers := c.sfu.rtspRouters(sid, id)
+		var router *Router
+		for _, r := range routers {
+			if len(parts) > 2 && r.Track().ID() == parts[2] || len(parts) == 2 && len(routers) == 1 {
+				router = r
+			}
+		}
+		if router == nil {
+			return rtspError(404, "Not Found")
+		}
+
+		c.mu.Lock()
+		if c.session == "" {
+			c.session = cuid.New()
+		}
+		channel, ok := parseInterleaved(transport)
+		if !ok {
+			channel = byte(len(c.setups) * 2)
+		}
+		c.setups[router.Track().ID()] = &rtspSetup{router: router, channel: channel}
+		session := c.session
+		c.mu.Unlock()
+
+		res.header.Set("Session", fmt.Sprintf("%s;timeout=%d", session, rtspSessionTimeout))
+		res.header.Set("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;ssrc=%08X",
+			channel, channel+1, router.Track().SSRC()))
+		return res
+
+	case "PLAY":
+		if !c.checkSession(req) {
+			return rtspError(454, "Session Not Found")
+		}
+		c.play()
+		res.header.Set("Session", c.session)
+		res.header.Set("Range", "npt=0.000-")
+		return res
+
+	case "TEARDOWN":
+		if !c.checkSession(req) {
+			return rtspError(454, "Session Not Found")
+		}
+		c.teardown()
+		return res
+	}
+
+	return rtspError(405, "Method Not Allowed")
+}
+
+// authorized checks the token of a request, given as the access_token query
+// or as basic credentials, once per session of the connection
+func (c *rtspServerConn) authorized(sid string, req *rtspRequest, u *url.URL) bool {
+	if c.authorize == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	granted := c.granted[sid]
+	c.mu.Unlock()
+	if granted {
+		return true
+	}
+
+	token := u.Query().Get("access_token")
+	if user, password, ok := parseBasicAuth(req.header.Get("Authorization")); ok {
+		// players put credentials of urls such as rtsp://token@host/... in the user
+		token = password
+		if token == "" {
+			token = user
+		}
+	}
+	if token == "" || !c.authorize(sid, token) {
+		logrus.Infof("rtsp %s unauthorized for session %s", c.conn.RemoteAddr(), sid)
+		return false
+	}
+
+	c.mu.Lock()
+	c.granted[sid] = true
+	c.mu.Unlock()
+	return true
+}
+
+// parseBasicAuth returns the credentials of a basic authorization header
+func parseBasicAuth(auth string) (user, password string, ok bool) {
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", "", false
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return "", "", false
+	}
+	parts := strings.SplitN(string(b), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (c *rtspServerConn) checkSession(req *rtspRequest) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	session, _ := parseRTSPSession(req.header.Get("Session"))
+	return c.session != "" && session == c.session
+}
+
+// play attaches a sender to the router of each set up track
+func (c *rtspServerConn) play() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, setup := range c.setups {
+		if setup.sender != nil {
+			continue
+		}
+		setup.sender = NewRTSPSender(setup.router.Track(), setup.channel, c.writeInterleaved)
+		setup.router.AddSender(c.session, setup.sender)
+		logrus.Debugf("rtsp %s playing track %s", c.conn.RemoteAddr(), setup.router.Track().ID())
+	}
+}
+
+// teardown detaches the senders of the session
+func (c *rtspServerConn) teardown() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for id, setup := range c.setups {
+		if setup.sender != nil {
+			setup.router.RemoveSender(c.session)
+		}
+		delete(c.setups, id)
+	}
+	c.session = ""
+}
+
+func (c *rtspServerConn) close() {
+	c.teardown()
+	_ = c.conn.Close()
+}
+
+// handleRTCP forwards feedback of the client, sent on the odd channels
+func (c *rtspServerConn) handleRTCP(channel byte, data []byte) {
+	pkts, err := rtcp.Unmarshal(data)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, setup := range c.setups {
+		if setup.channel+1 != channel || setup.sender == nil {
+			continue
+		}
+		for _, pkt := range pkts {
+			setup.sender.writeRTCP(pkt)
+		}
+	}
+}
+
+func (c *rtspServerConn) writeResponse(res *rtspResponse) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	return res.write(c.conn)
+}
+
+func (c *rtspServerConn) writeInterleaved(channel byte, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	return writeInterleaved(c.conn, channel, data)
+}
+
+func rtspError(status int, reason string) *rtspResponse {
+	return &rtspResponse{status: status, reason: reason, header: make(textproto.MIMEHeader)}
+}
+
+// rtspRouters returns the routers of a participant, or of a track, in a session
+func (s *SFU) rtspRouters(sid, id string) []*Router {
+	session := s.GetSession(sid)
+	if session == nil {
+		return nil
+	}
+
+	var routers []*Router
+	if t := session.GetTransport(id); t != nil {
+		for _, r := range t.Routers() {
+			routers = append(routers, r)
+		}
+	} else if r := session.GetRouter(id); r != nil {
+		routers = append(routers, r)
+	}
+
+	// video first, then stable by track id
+	sort.Slice(routers, func(i, j int) bool {
+		ki, kj := routers[i].Track().Kind(), routers[j].Track().Kind()
+		if ki != kj {
+			return ki == webrtc.RTPCodecTypeVideo
+		}
+		return routers[i].Track().ID() < routers[j].Track().ID()
+	})
+	return routers
+}
+
+// rtspSDP describes routers for DESCRIBE, one media controlled by track id each
+func rtspSDP(name string, routers []*Router) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\n")
+	fmt.Fprintf(&b, "o=- 0 0 IN IP4 0.0.0.0\r\n")
+	fmt.Fprintf(&b, "s=%s\r\n", name)
+	fmt.Fprintf(&b, "c=IN IP4 0.0.0.0\r\n")
+	fmt.Fprintf(&b, "t=0 0\r\n")
+	fmt.Fprintf(&b, "a=control:*\r\n")
+	for _, r := range routers {
+		track := r.Track()
+		codec := track.Codec()
+		pt := strconv.Itoa(int(track.PayloadType()))
+		fmt.Fprintf(&b, "m=%s 0 RTP/AVP %s\r\n", track.Kind(), pt)
+		if codec.Channels > 1 {
+			fmt.Fprintf(&b, "a=rtpmap:%s %s/%d/%d\r\n", pt, codec.Name, codec.ClockRate, codec.Channels)
+		} else {
+			fmt.Fprintf(&b, "a=rtpmap:%s %s/%d\r\n", pt, codec.Name, codec.ClockRate)
+		}
+		if codec.SDPFmtpLine != "" {
+			fmt.Fprintf(&b, "a=fmtp:%s %s\r\n", pt, codec.SDPFmtpLine)
+		}
+		fmt.Fprintf(&b, "a=control:%s\r\n", track.ID())
+	}
+	return b.String()
+}
@@ -0,0 +1,62 @@
+package sfu
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"testing"
+)
+
+func TestRTSPServerAuthorization(t *testing.T) {
+	s := NewSFU(Config{})
+	authorize := func(sid, token string) bool { return sid == "room" && token == "secret" }
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { _ = s.ServeRTSP(l, authorize) }()
+
+	for _, tc := range []struct {
+		name   string
+		url    string
+		auth   string
+		status int
+	}{
+		{"missing", "rtsp://host/room/track", "", 401},
+		{"wrong token", "rtsp://host/room/track?access_token=wrong", "", 401},
+		{"other session", "rtsp://host/other/track?access_token=secret", "", 401},
+		// no such track, but authorized
+		{"query", "rtsp://host/room/track?access_token=secret", "", 404},
+		{"basic password", "rtsp://host/room/track", "viewer:secret", 404},
+		{"basic user", "rtsp://host/room/track", "secret:", 404},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			header := textproto.MIMEHeader{"Cseq": {"1"}}
+			if tc.auth != "" {
+				header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(tc.auth)))
+			}
+			if err := (&rtspRequest{method: "DESCRIBE", url: tc.url, header: header}).write(client); err != nil {
+				t.Fatal(err)
+			}
+			res, err := readRTSPResponse(bufio.NewReader(client))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.status != tc.status {
+				t.Fatalf("status %d, want %d", res.status, tc.status)
+			}
+			if res.status == 401 && res.header.Get("WWW-Authenticate") == "" {
+				t.Fatal("no authentication challenge")
+			}
+		})
+	}
+}
@@ -0,0 +1,521 @@
+package sfu
+
+import (
+	"encoding/base64"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lucsky/cuid"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v2"
+	"github.com/pion/webrtc/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	rtspMinBackoff = time.Second
+	rtspMaxBackoff = 30 * time.Second
+	// a camera sending nothing for this long is considered gone
+	rtspReadTimeout = 10 * time.Second
+)
+
+// RTSPTransportConfig represents configuration options of a rtsp pull transport
+type RTSPTransportConfig struct {
+	// URL of the camera, credentials may be given as user info
+	URL string
+}
+
+// rtspTrack is a media pulled from the camera. Tracks outlive connections so
+// subscribers keep their senders when the camera reconnects.
+type rtspTrack struct {
+	key      string
+	channel  byte
+	receiver *PlainRTPReceiver
+	router   *Router
+	// sequence numbers are rewritten to stay continuous across connections
+	offset    uint16
+	lastSN    uint16
+	resync    bool
+	published bool
+	// h264 parameter sets of the sdp, sent ahead of keyframes that come
+	// without them in band
+	params       [][]byte
+	inbandParams bool
+}
+
+// RTSPTransport pulls h264, opus or pcmu media from an rtsp camera over
+// interleaved tcp and publishes it to its session, reconnecting with backoff
+type RTSPTransport struct {
+	id      string
+	mu      sync.RWMutex
+	stop    bool
+	session *Session
+	url     string
+	client  *rtspClient
+	tracks  map[string]*rtspTrack
+	routers map[uint32]*Router
+	closed  chan struct{}
+}
+
+// NewRTSPTransport creates a new RTSPTransport pulling from the configured url
+func NewRTSPTransport(session *Session, cfg RTSPTransportConfig) (*RTSPTransport, error) {
+	if !strings.HasPrefix(cfg.URL, "rtsp://") {
+		return nil, errRTSPScheme
+	}
+
+	t := &RTSPTransport{
+		id:      cuid.New(),
+		session: session,
+		url:     cfg.URL,
+		tracks:  make(map[string]*rtspTrack),
+		routers: make(map[uint32]*Router),
+		closed:  make(chan struct{}),
+	}
+
+	session.AddTransport(t)
+
+	go t.run()
+
+	return t, nil
+}
+
+// ID of transport
+func (t *RTSPTransport) ID() string {
+	return t.id
+}
+
+// Routers returns routers for this transport
+func (t *RTSPTransport) Routers() map[uint32]*Router {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	// routers are created and retained as the camera reconnects
+	routers := make(map[uint32]*Router, len(t.routers))
+	for ssrc, router := range t.routers {
+		routers[ssrc] = router
+	}
+	return routers
+}
+
+// GetRouter returns router with ssrc
+func (t *RTSPTransport) GetRouter(ssrc uint32) *Router {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.routers[ssrc]
+}
+
+// NewSender is not supported, rtsp transports only ingest tracks
+func (t *RTSPTransport) NewSender(track *webrtc.Track) (Sender, error) {
+	return nil, errMethodNotSupported
+}
+
+// Close transport
+func (t *RTSPTransport) Close() error {
+	t.mu.Lock()
+	if t.stop {
+		t.mu.Unlock()
+		return nil
+	}
+	t.stop = true
+	close(t.closed)
+	routers := make([]*Router, 0, len(t.routers))
+	for _, router := range t.routers {
+		routers = append(routers, router)
+	}
+	client := t.client
+	t.mu.Unlock()
+
+	// routers remove their tracks from the session when closed, which locks it
+	for _, router := range routers {
+		router.Close()
+	}
+
+	t.session.RemoveTransport(t.id)
+
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
+
+// run pulls from the camera until the transport is closed
+func (t *RTSPTransport) run() {
+	backoff := rtspMinBackoff
+	for {
+		start := time.Now()
+		err := t.pull()
+
+		select {
+		case <-t.closed:
+			return
+		default:
+		}
+
+		// a connection that played for a while resets the backoff
+		if time.Since(start) > rtspMaxBackoff {
+			backoff = rtspMinBackoff
+		}
+		logrus.Infof("rtsp transport %s disconnected: %v, retry in %s", t.id, err, backoff)
+
+		select {
+		case <-t.closed:
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > rtspMaxBackoff {
+			backoff = rtspMaxBackoff
+		}
+	}
+}
+
+// pull connects to the camera and reads its media until the connection fails
+func (t *RTSPTransport) pull() error {
+	client, err := dialRTSP(t.url)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	if t.stop {
+		t.mu.Unlock()
+		_ = client.Close()
+		return errTransportClosed
+	}
+	t.client = client
+	t.mu.Unlock()
+
+	defer func() {
+		t.mu.Lock()
+		t.client = nil
+		t.mu.Unlock()
+		_ = client.Close()
+	}()
+
+	res, err := client.do("DESCRIBE", client.url.String(), textproto.MIMEHeader{
+		"Accept": {"application/sdp"},
+	})
+	if err != nil {
+		return err
+	}
+
+	desc := sdp.SessionDescription{}
+	if err := desc.Unmarshal(res.body); err != nil {
+		return err
+	}
+
+	base := res.header.Get("Content-Base")
+	if base == "" {
+		base = res.header.Get("Content-Location")
+	}
+	if base == "" {
+		base = client.url.String()
+	}
+
+	channels := make(map[byte]*rtspTrack)
+	for i, md := range desc.MediaDescriptions {
+		codec, ok := rtspCodec(md)
+		if !ok {
+			logrus.Debugf("rtsp transport %s skipping media %s", t.id, md.MediaName.Media)
+			continue
+		}
+
+		control, _ := md.Attribute("control")
+		ch, err := client.setup(mediaURL(base, control), byte(i*2))
+		if err != nil {
+			return err
+		}
+
+		track, err := t.track(md.MediaName.Media+"/"+codec.Name, codec)
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		track.channel = ch
+		track.params = nil
+		if codec.Name == webrtc.H264 {
+			track.params = spropParameterSets(codec.SDPFmtpLine)
+		}
+		t.mu.Unlock()
+		channels[ch] = track
+	}
+	if len(channels) == 0 {
+		return errRTSPNoMedia
+	}
+
+	t.retain(channels)
+
+	if _, err := client.do("PLAY", base, nil); err != nil {
+		return err
+	}
+
+	logrus.Infof("rtsp transport %s playing %s", t.id, client.url)
+
+	for _, track := range channels {
+		if !track.published {
+			track.published = true
+			t.session.AddRouter(track.router)
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go client.keepalive(done)
+
+	for {
+		_ = client.conn.SetReadDeadline(time.Now().Add(rtspReadTimeout))
+		ch, data, err := client.read()
+		if err != nil {
+			return err
+		}
+
+		track, ok := channels[ch]
+		if !ok {
+			// rtcp of the camera on the odd channels
+			continue
+		}
+
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(data); err != nil {
+			logrus.Debugf("rtsp rtp unmarshal err: %v", err)
+			continue
+		}
+
+		t.mu.Lock()
+		if track.resync {
+			track.offset = track.lastSN + 1 - pkt.SequenceNumber
+			track.resync = false
+		}
+		var params *rtp.Packet
+		if len(track.params) > 0 {
+			hasParams, keyframe := h264PacketNALUs(pkt.Payload)
+			if hasParams {
+				track.inbandParams = true
+			}
+			if keyframe && !track.inbandParams {
+				params = &rtp.Packet{Header: pkt.Header, Payload: stapA(track.params)}
+				params.Marker = false
+				params.SequenceNumber += track.offset
+				track.offset++
+			}
+			if keyframe {
+				track.inbandParams = false
+			}
+		}
+		pkt.SequenceNumber += track.offset
+		track.lastSN = pkt.SequenceNumber
+		t.mu.Unlock()
+
+		for _, p := range []*rtp.Packet{params, pkt} {
+			if p == nil {
+				continue
+			}
+			p.SSRC = track.receiver.Track().SSRC()
+			p.PayloadType = track.receiver.Track().PayloadType()
+			track.receiver.push(p)
+		}
+	}
+}
+
+// track returns the track of a media, creating it with its router when the
+// camera announces it the first time
+func (t *RTSPTransport) track(key string, codec *webrtc.RTPCodec) (*rtspTrack, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if track, ok := t.tracks[key]; ok {
+		track.resync = true
+		return track, nil
+	}
+
+	wt, err := webrtc.NewTrack(codec.PayloadType, randomSSRC(), cuid.New(), t.id, codec)
+	if err != nil {
+		return nil, err
+	}
+
+	recv := NewPlainRTPReceiver(wt)
+	router := NewRouter(t.id, recv)
+	track := &rtspTrack{key: key, receiver: recv, router: router}
+	t.tracks[key] = track
+	t.routers[wt.SSRC()] = router
+
+	logrus.Debugf("Created router %s %d", t.id, wt.SSRC())
+
+	go t.sendRTCP(track)
+
+	return track, nil
+}
+
+// retain closes the routers of tracks the camera no longer announces
+func (t *RTSPTransport) retain(channels map[byte]*rtspTrack) {
+	keep := make(map[string]bool)
+	for _, track := range channels {
+		keep[track.key] = true
+	}
+
+	t.mu.Lock()
+	var closed []*Router
+	for key, track := range t.tracks {
+		if keep[key] {
+			continue
+		}
+		delete(t.tracks, key)
+		delete(t.routers, track.receiver.Track().SSRC())
+		closed = append(closed, track.router)
+	}
+	t.mu.Unlock()
+
+	for _, router := range closed {
+		router.Close()
+	}
+}
+
+// sendRTCP forwards feedback of subscribers to the camera, most ignore it
+// but some honor picture loss indications
+func (t *RTSPTransport) sendRTCP(track *rtspTrack) {
+	for {
+		pkt, err := track.receiver.ReadRTCP()
+		if err != nil {
+			return
+		}
+
+		t.mu.RLock()
+		client := t.client
+		channel := track.channel
+		t.mu.RUnlock()
+		if client == nil {
+			continue
+		}
+
+		buf, err := pkt.Marshal()
+		if err != nil {
+			logrus.Errorf("Error marshaling RTCP %s", err)
+			continue
+		}
+
+		if err := client.writeInterleaved(channel+1, buf); err != nil {
+			logrus.Debugf("rtsp transport %s rtcp write err: %v", t.id, err)
+		}
+	}
+}
+
+func (t *RTSPTransport) stats() TransportStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return TransportStats{ID: t.id, Kind: transportKind(t), Routers: routerStats(t.routers)}
+}
+
+// spropParameterSets decodes the parameter sets given in the fmtp of an h264
+// media, RFC 6184 8.1
+func spropParameterSets(fmtp string) [][]byte {
+	for _, p := range strings.Split(fmtp, ";") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 || kv[0] != "sprop-parameter-sets" {
+			continue
+		}
+		var sets [][]byte
+		for _, set := range strings.Split(kv[1], ",") {
+			if b, err := base64.StdEncoding.DecodeString(set); err == nil && len(b) > 0 {
+				sets = append(sets, b)
+			}
+		}
+		return sets
+	}
+	return nil
+}
+
+// h264PacketNALUs reports whether an h264 packet carries parameter sets and
+// whether it starts a keyframe, RFC 6184 5
+func h264PacketNALUs(payload []byte) (params, keyframe bool) {
+	if len(payload) == 0 {
+		return false, false
+	}
+
+	check := func(naluType byte) {
+		switch naluType {
+		case naluTypeSPS, naluTypePPS:
+			params = true
+		case naluTypeIDR:
+			keyframe = true
+		}
+	}
+
+	switch naluType := payload[0] & 0x1f; naluType {
+	case naluTypeSTAPA:
+		buf := payload[1:]
+		for len(buf) > 2 {
+			size := int(buf[0])<<8 | int(buf[1])
+			if size == 0 || len(buf) < size+2 {
+				break
+			}
+			check(buf[2] & 0x1f)
+			buf = buf[size+2:]
+		}
+	case naluTypeFUA:
+		if len(payload) > 1 && payload[1]&0x80 != 0 {
+			check(payload[1] & 0x1f)
+		}
+	default:
+		check(naluType)
+	}
+	return params, keyframe
+}
+
+// stapA aggregates nal units in a single packet, RFC 6184 5.7.1
+func stapA(nalus [][]byte) []byte {
+	var nri byte
+	for _, nalu := range nalus {
+		if n := nalu[0] & 0x60; n > nri {
+			nri = n
+		}
+	}
+
+	b := []byte{nri | naluTypeSTAPA}
+	for _, nalu := range nalus {
+		b = append(b, byte(len(nalu)>>8), byte(len(nalu)))
+		b = append(b, nalu...)
+	}
+	return b
+}
+
+// rtspCodec returns the first supported codec of a media. Payload types are
+// looked up per media as cameras reuse dynamic types across medias.
+func rtspCodec(md *sdp.MediaDescription) (*webrtc.RTPCodec, bool) {
+	attr := func(name, format string) string {
+		for _, a := range md.Attributes {
+			if a.Key == name && strings.HasPrefix(a.Value, format+" ") {
+				return strings.TrimSpace(strings.TrimPrefix(a.Value, format+" "))
+			}
+		}
+		return ""
+	}
+
+	for _, format := range md.MediaName.Formats {
+		pt, err := strconv.Atoi(format)
+		if err != nil {
+			continue
+		}
+
+		// encoding/clock rate[/channels]
+		rtpmap := strings.Split(attr("rtpmap", format), "/")
+		name, clockRate := rtpmap[0], uint32(0)
+		if len(rtpmap) > 1 {
+			if rate, err := strconv.ParseUint(rtpmap[1], 10, 32); err == nil {
+				clockRate = uint32(rate)
+			}
+		}
+		if name == "" && pt == webrtc.DefaultPayloadTypePCMU {
+			// static payload type, may come without rtpmap
+			name = webrtc.PCMU
+		}
+
+		codec, err := newRTPCodec(name, uint8(pt), clockRate, attr("fmtp", format))
+		if err == nil {
+			return codec, true
+		}
+	}
+	return nil, false
+}
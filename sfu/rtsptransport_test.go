@@ -0,0 +1,264 @@
+package sfu
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const rtspTestSDP = "v=0\r\n" +
+	"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+	"s=camera\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 0 RTP/AVP 0\r\n" +
+	"a=rtpmap:0 PCMU/8000\r\n" +
+	"a=control:track1\r\n"
+
+// serveRTSPCamera stands in for a camera, it answers DESCRIBE, SETUP and PLAY
+// with the sdp then streams the payloads of each connection interleaved. The
+// first connection drops once drop is closed.
+func serveRTSPCamera(l net.Listener, desc string, payload func(n byte, sn uint16) []byte, drop, done <-chan struct{}) {
+	for n := byte(1); ; n++ {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn, n byte) {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				req, err := readRTSPRequest(r)
+				if err != nil {
+					return
+				}
+
+				res := &rtspResponse{status: 200, reason: "OK", header: textproto.MIMEHeader{
+					"Cseq": {req.header.Get("CSeq")},
+				}}
+				switch req.method {
+				case "DESCRIBE":
+					res.header.Set("Content-Type", "application/sdp")
+					res.header.Set("Content-Base", req.url+"/")
+					res.body = []byte(desc)
+				case "SETUP":
+					res.header.Set("Transport", req.header.Get("Transport"))
+					res.header.Set("Session", "camera;timeout=60")
+				}
+				if err := res.write(conn); err != nil {
+					return
+				}
+				if req.method == "PLAY" {
+					break
+				}
+			}
+
+			// only the first connection drops
+			dropped := drop
+			if n > 1 {
+				dropped = nil
+			}
+			for sn := uint16(1); ; sn++ {
+				pkt := &rtp.Packet{
+					Header:  rtp.Header{Version: 2, SequenceNumber: sn, Timestamp: uint32(sn) * 160, SSRC: 42},
+					Payload: payload(n, sn),
+				}
+				buf, _ := pkt.Marshal()
+				if err := writeInterleaved(conn, 0, buf); err != nil {
+					return
+				}
+				select {
+				case <-done:
+					return
+				case <-dropped:
+					return
+				case <-time.After(20 * time.Millisecond):
+				}
+			}
+		}(conn, n)
+	}
+}
+
+// TestRTSPReconnect pulls from a camera that drops, its router is published
+// once and keeps forwarding with continuous sequence numbers once reconnected
+func TestRTSPReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	drop, done := make(chan struct{}), make(chan struct{})
+	defer close(done)
+	// payloads are tagged with the connection number
+	go serveRTSPCamera(l, rtspTestSDP, func(n byte, sn uint16) []byte { return []byte{n} }, drop, done)
+
+	s := NewSFU(Config{})
+	transport, err := s.NewRTSPTransport("camera", RTSPTransportConfig{URL: "rtsp://" + l.Addr().String() + "/stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	var router *Router
+	if !waitFor(t, 5*time.Second, func() bool {
+		for _, r := range transport.Routers() {
+			router = r
+		}
+		return router != nil && s.GetSession("camera").GetRouter(router.Track().ID()) == router
+	}) {
+		t.Fatal("router not published")
+	}
+
+	subscriber := listenLoopback(t)
+	defer subscriber.Close()
+	egress, err := s.NewPlainRTPEgress("camera", router.Track().ID(), PlainRTPSenderConfig{
+		Host: "127.0.0.1",
+		Port: subscriber.LocalAddr().(*net.UDPAddr).Port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer egress.Close()
+
+	// packets of the second connection follow those of the first
+	buf := make([]byte, receiveMTU)
+	_ = subscriber.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var last *rtp.Packet
+	for {
+		n, _, err := subscriber.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("no rtp after reconnect: %v", err)
+		}
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(append([]byte{}, buf[:n]...)); err != nil || len(pkt.Payload) == 0 {
+			continue
+		}
+		if pkt.SSRC != router.Track().SSRC() {
+			t.Fatalf("ssrc %d, want %d", pkt.SSRC, router.Track().SSRC())
+		}
+
+		if last == nil {
+			close(drop)
+		}
+		if last != nil && last.Payload[0] == 1 && pkt.Payload[0] == 2 {
+			if want := last.SequenceNumber + 1; pkt.SequenceNumber != want {
+				t.Fatalf("sequence number %d after reconnect, want %d", pkt.SequenceNumber, want)
+			}
+			break
+		}
+		last = pkt
+	}
+
+	if got := s.GetSession("camera").GetRouter(router.Track().ID()); got != router {
+		t.Fatal("router replaced on reconnect")
+	}
+	if routers := transport.Routers(); len(routers) != 1 {
+		t.Fatalf("%d routers after reconnect, want 1", len(routers))
+	}
+}
+
+// TestRTSPParameterSets checks the parameter sets of the sdp are sent ahead of
+// keyframes of a camera that doesn't send them in band
+func TestRTSPParameterSets(t *testing.T) {
+	sps := []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01, 0x40, 0x16, 0xe8}
+	pps := []byte{0x68, 0xce, 0x3c, 0x80}
+	desc := "v=0\r\n" +
+		"o=- 0 0 IN IP4 127.0.0.1\r\n" +
+		"s=camera\r\n" +
+		"t=0 0\r\n" +
+		"m=video 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1;profile-level-id=42c01f;sprop-parameter-sets=" +
+		base64.StdEncoding.EncodeToString(sps) + "," + base64.StdEncoding.EncodeToString(pps) + "\r\n" +
+		"a=control:track1\r\n"
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	// an idr every 10 packets, other slices in between
+	go serveRTSPCamera(l, desc, func(n byte, sn uint16) []byte {
+		if sn%10 == 1 {
+			return []byte{0x65, 0x88}
+		}
+		return []byte{0x41, 0x9a}
+	}, nil, done)
+
+	s := NewSFU(Config{})
+	transport, err := s.NewRTSPTransport("camera", RTSPTransportConfig{URL: "rtsp://" + l.Addr().String() + "/stream"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	var router *Router
+	if !waitFor(t, 5*time.Second, func() bool {
+		for _, r := range transport.Routers() {
+			router = r
+		}
+		return router != nil
+	}) {
+		t.Fatal("router not created")
+	}
+
+	subscriber := listenLoopback(t)
+	defer subscriber.Close()
+	egress, err := s.NewPlainRTPEgress("camera", router.Track().ID(), PlainRTPSenderConfig{
+		Host: "127.0.0.1",
+		Port: subscriber.LocalAddr().(*net.UDPAddr).Port,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer egress.Close()
+
+	want := append([]byte{0x68&0x60 | naluTypeSTAPA, 0, byte(len(sps))}, sps...)
+	want = append(append(want, 0, byte(len(pps))), pps...)
+
+	buf := make([]byte, receiveMTU)
+	_ = subscriber.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var prev, params *rtp.Packet
+	for {
+		n, _, err := subscriber.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("no parameter sets before a keyframe: %v", err)
+		}
+		pkt := &rtp.Packet{}
+		if err := pkt.Unmarshal(append([]byte{}, buf[:n]...)); err != nil || len(pkt.Payload) == 0 {
+			continue
+		}
+		if prev != nil && pkt.SequenceNumber != prev.SequenceNumber+1 {
+			t.Fatalf("sequence number %d after %d", pkt.SequenceNumber, prev.SequenceNumber)
+		}
+		prev = pkt
+
+		switch {
+		case pkt.Payload[0]&0x1f == naluTypeSTAPA:
+			if !bytes.Equal(pkt.Payload, want) {
+				t.Fatalf("parameter sets %x, want %x", pkt.Payload, want)
+			}
+			params = pkt
+		case pkt.Payload[0]&0x1f == naluTypeIDR:
+			if params == nil {
+				// subscribed after the parameter sets of this keyframe
+				continue
+			}
+			if params.Timestamp != pkt.Timestamp {
+				t.Fatalf("parameter sets at %d, keyframe at %d", params.Timestamp, pkt.Timestamp)
+			}
+			return
+		default:
+			params = nil
+		}
+	}
+}
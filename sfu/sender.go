@@ -4,9 +4,13 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/lucsky/cuid"
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v2"
@@ -17,20 +21,23 @@ import (
 type Sender interface {
 	ReadRTCP() (rtcp.Packet, error)
 	WriteRTP(*rtp.Packet)
-	stats() string
+	stats() SenderStats
 	Close()
 }
 
 // WebRTCSender represents a Sender which writes RTP to a webrtc track
 type WebRTCSender struct {
-	mu       sync.RWMutex
-	track    *webrtc.Track
-	stop     bool
-	rtcpCh   chan rtcp.Packet
-	useRemb  bool
-	rembCh   chan *rtcp.ReceiverEstimatedMaximumBitrate
-	target   uint64
-	sendChan chan *rtp.Packet
+	mu          sync.RWMutex
+	track       *webrtc.Track
+	stop        bool
+	rtcpCh      chan rtcp.Packet
+	useRemb     bool
+	rembCh      chan *rtcp.ReceiverEstimatedMaximumBitrate
+	target      uint64
+	sendChan    chan *rtp.Packet
+	muter       rtpMuter
+	counter     rtpCounter
+	rtcpCounter feedbackCounter
 }
 
 // NewWebRTCSender creates a new track sender instance
@@ -40,6 +47,7 @@ func NewWebRTCSender(track *webrtc.Track, sender *webrtc.RTPSender) *WebRTCSende
 		rtcpCh:   make(chan rtcp.Packet, maxSize),
 		rembCh:   make(chan *rtcp.ReceiverEstimatedMaximumBitrate, maxSize),
 		sendChan: make(chan *rtp.Packet, maxSize),
+		muter:    newRTPMuter(track),
 	}
 
 	for _, feedback := range track.Codec().RTCPFeedback {
@@ -62,12 +70,16 @@ func NewWebRTCSender(track *webrtc.Track, sender *webrtc.RTPSender) *WebRTCSende
 
 func (s *WebRTCSender) sendRTP() {
 	for pkt := range s.sendChan {
-		s.mu.RLock()
+		s.mu.Lock()
 		stop := s.stop
-		s.mu.RUnlock()
+		pkt, ok := s.muter.forward(pkt)
+		s.mu.Unlock()
 		if stop {
 			break
 		}
+		if !ok {
+			continue
+		}
 
 		// Transform payload type
 		pt := s.track.Codec().PayloadType
@@ -77,7 +89,9 @@ func (s *WebRTCSender) sendRTP() {
 
 		if err := s.track.WriteRTP(pkt); err != nil {
 			logrus.Errorf("wt.WriteRTP err=%v", err)
+			continue
 		}
+		s.counter.add(pkt)
 	}
 }
 
@@ -95,6 +109,30 @@ func (s *WebRTCSender) WriteRTP(pkt *rtp.Packet) {
 	s.sendChan <- pkt
 }
 
+// SetPaused stops or resumes sending the track to this subscriber only.
+// Video resumes on a keyframe requested from the publisher.
+func (s *WebRTCSender) SetPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop {
+		return
+	}
+
+	if _, keyframe := s.muter.setMuted(paused); keyframe {
+		select {
+		case s.rtcpCh <- &rtcp.PictureLossIndication{MediaSSRC: s.track.SSRC()}:
+		default:
+		}
+	}
+}
+
+// Paused reports whether the track is paused
+func (s *WebRTCSender) Paused() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.muter.muted
+}
+
 // Close track
 func (s *WebRTCSender) Close() {
 	s.mu.Lock()
@@ -119,16 +157,30 @@ func (s *WebRTCSender) receiveRTCP(sender *webrtc.RTPSender) {
 		}
 
 		s.mu.RLock()
-		stop := s.stop
+		stop, paused, muter := s.stop, s.muter.muted, s.muter
 		s.mu.RUnlock()
 		if stop {
 			return
 		}
 
 		for _, pkt := range pkts {
+			s.rtcpCounter.add(pkt)
 			switch pkt := pkt.(type) {
-			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest, *rtcp.TransportLayerNack:
-				s.rtcpCh <- pkt
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+				if !paused {
+					s.rtcpCh <- pkt
+				}
+			case *rtcp.TransportLayerNack:
+				if paused {
+					continue
+				}
+				// nacks refer to the sequence numbers sent to this subscriber
+				nack := *pkt
+				nack.Nacks = make([]rtcp.NackPair, len(pkt.Nacks))
+				for i, pair := range pkt.Nacks {
+					nack.Nacks[i] = rtcp.NackPair{PacketID: muter.original(pair.PacketID), LostPackets: pair.LostPackets}
+				}
+				s.rtcpCh <- &nack
 			case *rtcp.ReceiverEstimatedMaximumBitrate:
 				if s.useRemb {
 					s.rembCh <- pkt
@@ -198,6 +250,501 @@ func (s *WebRTCSender) rembLoop() {
 	}
 }
 
-func (s *WebRTCSender) stats() string {
-	return fmt.Sprintf("payload: %d | remb: %dkbps", s.track.PayloadType(), s.target/1000)
+func (s *WebRTCSender) stats() SenderStats {
+	stats := senderStats(s.track.PayloadType(), &s.counter, &s.rtcpCounter)
+	stats.Paused = s.Paused()
+	return stats
+}
+
+// senderReportInterval between the rtcp sender reports of a plain rtp sender
+const senderReportInterval = 5 * time.Second
+
+// PlainRTPSenderConfig represents configuration options of a plain rtp sender
+type PlainRTPSenderConfig struct {
+	// Host and Port rtp is sent to
+	Host string
+	Port int
+	// RTCPPort of the remote host, Port+1 when 0
+	RTCPPort int
+}
+
+// PlainRTPSender represents a Sender which forwards RTP unencrypted to an external host
+type PlainRTPSender struct {
+	id             string
+	mu             sync.RWMutex
+	track          *webrtc.Track
+	conn           *net.UDPConn
+	rtcpConn       *net.UDPConn
+	addr           *net.UDPAddr
+	rtcpPort       int
+	stop           bool
+	rtcpCh         chan rtcp.Packet
+	sendChan       chan *rtp.Packet
+	onCloseHandler func()
+	counter        rtpCounter
+	rtcpCounter    feedbackCounter
+	report         senderReport
+	done           chan struct{}
+}
+
+// senderReport keeps what the rtcp sender reports of a plain rtp sender describe
+type senderReport struct {
+	mu      sync.Mutex
+	ssrc    uint32
+	rtpTime uint32
+	sentAt  time.Time
+	packets uint32
+	octets  uint32
+}
+
+// NewPlainRTPSender creates a new plain rtp sender of track
+func NewPlainRTPSender(track *webrtc.Track, cfg PlainRTPSenderConfig) (*PlainRTPSender, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &PlainRTPSender{
+		id:       cuid.New(),
+		track:    track,
+		conn:     conn,
+		addr:     addr,
+		rtcpPort: cfg.RTCPPort,
+		rtcpCh:   make(chan rtcp.Packet, maxSize),
+		sendChan: make(chan *rtp.Packet, maxSize),
+		done:     make(chan struct{}),
+	}
+
+	if s.rtcpPort == 0 {
+		s.rtcpPort = addr.Port + 1
+	}
+
+	// Receivers send rtcp to the rtp source port + 1 unless it is muxed
+	localPort := conn.LocalAddr().(*net.UDPAddr).Port
+	if rtcpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: localPort + 1}); err == nil {
+		s.rtcpConn = rtcpConn
+		go s.receiveRTCP(rtcpConn)
+	}
+
+	go s.receiveRTCP(conn)
+	go s.sendRTP()
+	go s.sendReports()
+
+	return s, nil
+}
+
+// ID of sender
+func (s *PlainRTPSender) ID() string {
+	return s.id
+}
+
+// SDP describes the forwarded stream for consumers like `ffmpeg -i stream.sdp`
+func (s *PlainRTPSender) SDP() string {
+	codec := s.track.Codec()
+	ipVer := "IP4"
+	if s.addr.IP.To4() == nil {
+		ipVer = "IP6"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "v=0\r\n")
+	fmt.Fprintf(&b, "o=- 0 0 IN %s %s\r\n", ipVer, s.addr.IP)
+	fmt.Fprintf(&b, "s=%s\r\n", s.track.Label())
+	fmt.Fprintf(&b, "c=IN %s %s\r\n", ipVer, s.addr.IP)
+	fmt.Fprintf(&b, "t=0 0\r\n")
+	fmt.Fprintf(&b, "m=%s %d RTP/AVP %d\r\n", s.track.Kind(), s.addr.Port, s.track.PayloadType())
+	if codec.Channels > 1 {
+		fmt.Fprintf(&b, "a=rtpmap:%d %s/%d/%d\r\n", s.track.PayloadType(), codec.Name, codec.ClockRate, codec.Channels)
+	} else {
+		fmt.Fprintf(&b, "a=rtpmap:%d %s/%d\r\n", s.track.PayloadType(), codec.Name, codec.ClockRate)
+	}
+	if codec.SDPFmtpLine != "" {
+		fmt.Fprintf(&b, "a=fmtp:%d %s\r\n", s.track.PayloadType(), codec.SDPFmtpLine)
+	}
+	fmt.Fprintf(&b, "a=rtcp:%d\r\n", s.rtcpPort)
+	fmt.Fprintf(&b, "a=ssrc:%d cname:%s\r\n", s.track.SSRC(), s.track.Label())
+	fmt.Fprintf(&b, "a=recvonly\r\n")
+	return b.String()
+}
+
+// OnClose handler called when the sender is closed
+func (s *PlainRTPSender) OnClose(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onCloseHandler = f
+}
+
+func (s *PlainRTPSender) sendRTP() {
+	for pkt := range s.sendChan {
+		buf, err := pkt.Marshal()
+		if err != nil {
+			logrus.Errorf("plain rtp marshal err=%v", err)
+			continue
+		}
+
+		if _, err := s.conn.WriteToUDP(buf, s.addr); err != nil {
+			logrus.Debugf("plain rtp write err=%v", err)
+			continue
+		}
+		s.counter.add(pkt)
+
+		s.report.mu.Lock()
+		s.report.ssrc = pkt.SSRC
+		s.report.rtpTime = pkt.Timestamp
+		s.report.sentAt = time.Now()
+		s.report.packets++
+		s.report.octets += uint32(len(pkt.Payload))
+		s.report.mu.Unlock()
+	}
+}
+
+// sendReports sends rtcp sender reports to the rtcp port of the remote host
+// so it can synchronize the streams and compute the round trip time
+func (s *PlainRTPSender) sendReports() {
+	addr := &net.UDPAddr{IP: s.addr.IP, Port: s.rtcpPort, Zone: s.addr.Zone}
+	clockRate := float64(s.track.Codec().ClockRate)
+
+	t := time.NewTicker(senderReportInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-t.C:
+		}
+
+		s.report.mu.Lock()
+		if s.report.sentAt.IsZero() {
+			s.report.mu.Unlock()
+			continue
+		}
+		// the rtp time of now, extrapolated from the last packet sent
+		now := time.Now()
+		sr := &rtcp.SenderReport{
+			SSRC:        s.report.ssrc,
+			NTPTime:     ntpTime(now),
+			RTPTime:     s.report.rtpTime + uint32(now.Sub(s.report.sentAt).Seconds()*clockRate),
+			PacketCount: s.report.packets,
+			OctetCount:  s.report.octets,
+		}
+		s.report.mu.Unlock()
+
+		buf, err := sr.Marshal()
+		if err != nil {
+			logrus.Errorf("plain rtp sender report marshal err=%v", err)
+			continue
+		}
+		if _, err := s.conn.WriteToUDP(buf, addr); err != nil {
+			logrus.Debugf("plain rtp sender report write err=%v", err)
+		}
+	}
+}
+
+// ntpTime converts a time to the 64 bit ntp format of sender reports
+func ntpTime(t time.Time) uint64 {
+	// seconds between the ntp epoch, 1900, and the unix epoch
+	const ntpEpochOffset = 2208988800
+	secs := uint64(t.Unix()) + ntpEpochOffset
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+// ReadRTCP read rtcp packet
+func (s *PlainRTPSender) ReadRTCP() (rtcp.Packet, error) {
+	rtcp, ok := <-s.rtcpCh
+	if !ok {
+		return nil, errChanClosed
+	}
+	return rtcp, nil
+}
+
+// WriteRTP to the remote host
+func (s *PlainRTPSender) WriteRTP(pkt *rtp.Packet) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stop {
+		return
+	}
+	s.sendChan <- pkt
+}
+
+// Close sender
+func (s *PlainRTPSender) Close() {
+	s.mu.Lock()
+	if s.stop {
+		s.mu.Unlock()
+		return
+	}
+	s.stop = true
+	close(s.sendChan)
+	close(s.rtcpCh)
+	close(s.done)
+	_ = s.conn.Close()
+	if s.rtcpConn != nil {
+		_ = s.rtcpConn.Close()
+	}
+	handler := s.onCloseHandler
+	s.mu.Unlock()
+
+	if handler != nil {
+		handler()
+	}
+}
+
+func (s *PlainRTPSender) receiveRTCP(conn *net.UDPConn) {
+	buf := make([]byte, receiveMTU)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		pkts, err := rtcp.Unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		s.mu.RLock()
+		if s.stop {
+			s.mu.RUnlock()
+			return
+		}
+		for _, pkt := range pkts {
+			s.rtcpCounter.add(pkt)
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest, *rtcp.TransportLayerNack:
+				select {
+				case s.rtcpCh <- pkt:
+				default:
+				}
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
+
+func (s *PlainRTPSender) stats() SenderStats {
+	stats := senderStats(s.track.PayloadType(), &s.counter, &s.rtcpCounter)
+	stats.Destination = s.addr.String()
+	return stats
+}
+
+// RTSPSender represents a Sender which writes RTP interleaved in the tcp
+// connection of an rtsp client
+type RTSPSender struct {
+	mu          sync.RWMutex
+	track       *webrtc.Track
+	channel     byte
+	write       func(channel byte, data []byte) error
+	stop        bool
+	rtcpCh      chan rtcp.Packet
+	sendChan    chan *rtp.Packet
+	counter     rtpCounter
+	rtcpCounter feedbackCounter
+}
+
+// NewRTSPSender creates a new rtsp sender of track writing on an interleaved channel
+func NewRTSPSender(track *webrtc.Track, channel byte, write func(channel byte, data []byte) error) *RTSPSender {
+	s := &RTSPSender{
+		track:    track,
+		channel:  channel,
+		write:    write,
+		rtcpCh:   make(chan rtcp.Packet, maxSize),
+		sendChan: make(chan *rtp.Packet, maxSize),
+	}
+
+	// players can't decode until the next keyframe
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		s.rtcpCh <- &rtcp.PictureLossIndication{MediaSSRC: track.SSRC()}
+	}
+
+	go s.sendRTP()
+
+	return s
+}
+
+func (s *RTSPSender) sendRTP() {
+	for pkt := range s.sendChan {
+		buf, err := pkt.Marshal()
+		if err != nil {
+			logrus.Errorf("rtsp marshal err=%v", err)
+			continue
+		}
+
+		if err := s.write(s.channel, buf); err != nil {
+			logrus.Debugf("rtsp write err=%v", err)
+			continue
+		}
+		s.counter.add(pkt)
+	}
+}
+
+// ReadRTCP read rtcp packet
+func (s *RTSPSender) ReadRTCP() (rtcp.Packet, error) {
+	rtcp, ok := <-s.rtcpCh
+	if !ok {
+		return nil, errChanClosed
+	}
+	return rtcp, nil
+}
+
+// WriteRTP to the rtsp client, packets are dropped while the client falls behind
+func (s *RTSPSender) WriteRTP(pkt *rtp.Packet) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stop {
+		return
+	}
+
+	select {
+	case s.sendChan <- pkt:
+	default:
+		logrus.Debugf("rtsp sender %d queue full", s.track.SSRC())
+		countDropped(DropRTSP)
+	}
+}
+
+// writeRTCP queues feedback of the rtsp client for the router
+func (s *RTSPSender) writeRTCP(pkt rtcp.Packet) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stop {
+		return
+	}
+
+	s.rtcpCounter.add(pkt)
+	switch pkt.(type) {
+	case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest, *rtcp.TransportLayerNack:
+		select {
+		case s.rtcpCh <- pkt:
+		default:
+		}
+	}
+}
+
+// Close sender
+func (s *RTSPSender) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop {
+		return
+	}
+	s.stop = true
+	close(s.sendChan)
+	close(s.rtcpCh)
+}
+
+func (s *RTSPSender) stats() SenderStats {
+	return senderStats(s.track.PayloadType(), &s.counter, &s.rtcpCounter)
+}
+
+// RelaySender represents a Sender which forwards RTP to another sfu instance over a relay link
+type RelaySender struct {
+	mu             sync.RWMutex
+	track          *webrtc.Track
+	write          func(pkt *rtp.Packet) error
+	stop           bool
+	rtcpCh         chan rtcp.Packet
+	sendChan       chan *rtp.Packet
+	onCloseHandler func()
+	counter        rtpCounter
+	rtcpCounter    feedbackCounter
+}
+
+// NewRelaySender creates a new relay sender of track
+func NewRelaySender(track *webrtc.Track, write func(pkt *rtp.Packet) error) *RelaySender {
+	s := &RelaySender{
+		track:    track,
+		write:    write,
+		rtcpCh:   make(chan rtcp.Packet, maxSize),
+		sendChan: make(chan *rtp.Packet, maxSize),
+	}
+
+	go s.sendRTP()
+
+	return s
+}
+
+// OnClose handler called when the sender is closed
+func (s *RelaySender) OnClose(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onCloseHandler = f
+}
+
+func (s *RelaySender) sendRTP() {
+	for pkt := range s.sendChan {
+		if err := s.write(pkt); err != nil {
+			logrus.Debugf("relay write err=%v", err)
+			continue
+		}
+		s.counter.add(pkt)
+	}
+}
+
+// ReadRTCP read rtcp packet
+func (s *RelaySender) ReadRTCP() (rtcp.Packet, error) {
+	rtcp, ok := <-s.rtcpCh
+	if !ok {
+		return nil, errChanClosed
+	}
+	return rtcp, nil
+}
+
+// WriteRTP to the relay link, packets are dropped while the link falls behind
+func (s *RelaySender) WriteRTP(pkt *rtp.Packet) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stop {
+		return
+	}
+
+	select {
+	case s.sendChan <- pkt:
+	default:
+		logrus.Debugf("relay sender %d queue full", s.track.SSRC())
+		countDropped(DropRelay)
+	}
+}
+
+// writeRTCP queues feedback of the remote instance for the router
+func (s *RelaySender) writeRTCP(pkt rtcp.Packet) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.stop {
+		return
+	}
+
+	s.rtcpCounter.add(pkt)
+	select {
+	case s.rtcpCh <- pkt:
+	default:
+	}
+}
+
+// Close sender
+func (s *RelaySender) Close() {
+	s.mu.Lock()
+	if s.stop {
+		s.mu.Unlock()
+		return
+	}
+	s.stop = true
+	close(s.sendChan)
+	close(s.rtcpCh)
+	handler := s.onCloseHandler
+	s.mu.Unlock()
+
+	if handler != nil {
+		handler()
+	}
+}
+
+func (s *RelaySender) stats() SenderStats {
+	return senderStats(s.track.PayloadType(), &s.counter, &s.rtcpCounter)
 }
@@ -1,36 +1,59 @@
 package sfu
 
 import (
-	"fmt"
 	"sync"
 
+	"github.com/pion/webrtc/v2"
 	"github.com/sirupsen/logrus"
 )
 
 type Session struct {
 	id             string
 	transports     map[string]Transport
+	participants   map[string]*Participant
+	hls            *HLSStream
 	mu             sync.RWMutex
 	onCloseHandler func()
+	closed         bool
+	timeline       *timelineStore
+	quality        map[string]*qualityState
 }
 
 func NewSession(id string) *Session {
 	return &Session{
-		id:         id,
-		transports: make(map[string]Transport),
+		id:           id,
+		transports:   make(map[string]Transport),
+		participants: make(map[string]*Participant),
 	}
 }
 
+// ID of the session
+func (r *Session) ID() string {
+	return r.id
+}
+
 func (r *Session) AddTransport(transport Transport) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	tid := transport.ID()
+	r.transports[tid] = transport
+
+	participant := &Participant{ID: tid, Identity: tid, Role: RolePresenter, Tracks: []string{}}
+	if p, ok := transport.(*WebRTCTransport); ok {
+		participant.Role = p.role
+		if p.identity != "" {
+			participant.Identity = p.identity
+			participant.Metadata = p.metadata
+		}
+	}
+	r.participants[tid] = participant
+	event := SessionEvent{Type: EventParticipantJoined, Participant: participant.copy()}
+	r.mu.Unlock()
 
-	r.transports[transport.ID()] = transport
+	r.emit(tid, event)
 }
 
 func (r *Session) RemoveTransport(tid string) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
 
 	delete(r.transports, tid)
 
@@ -40,24 +63,51 @@ func (r *Session) RemoveTransport(tid string) {
 		}
 	}
 
-	if len(r.transports) == 0 && r.onCloseHandler != nil {
-		r.onCloseHandler()
+	participant, left := r.participants[tid]
+	delete(r.participants, tid)
+	delete(r.quality, tid)
+
+	empty := len(r.transports) == 0
+	r.mu.Unlock()
+
+	if left {
+		r.emit(tid, SessionEvent{Type: EventParticipantLeft, Participant: participant.copy()})
+	}
+
+	if empty {
+		r.close()
 	}
 }
 
 func (r *Session) AddRouter(router *Router) {
 	r.mu.Lock()
-	defer r.mu.Unlock()
+	defer func() {
+		r.mu.Unlock()
+		r.emitTrack(EventTrackPublished, router)
+	}()
+
+	if participant, ok := r.participants[router.tid]; ok {
+		participant.Tracks = append(participant.Tracks, router.Track().ID())
+	}
 
 	for tid, t := range r.transports {
 		if router.tid == tid {
 			continue
 		}
 
+		if s, ok := t.(subscriber); ok && !s.subscribes(router) {
+			continue
+		}
+
 		logrus.Infof("AddRouter ssrc %d to %s", router.Track().SSRC(), tid)
 
 		sender, err := t.NewSender(router.Track())
 
+		if err == errMethodNotSupported {
+			// Ingest only transport
+			continue
+		}
+
 		if err != nil {
 			logrus.Errorf("Error subscribing transport to router: %s", err)
 			continue
@@ -66,32 +116,167 @@ func (r *Session) AddRouter(router *Router) {
 		// Attach sender to source
 		router.AddSender(tid, sender)
 
-		if t.(*WebRTCTransport).onNegotiationNeededHandler != nil {
-			t.(*WebRTCTransport).onNegotiationNeededHandler()
+		if p, ok := t.(*WebRTCTransport); ok && p.onNegotiationNeededHandler != nil {
+			p.onNegotiationNeededHandler()
 		}
 	}
+
+	if r.hls != nil {
+		r.hls.attach(router)
+	}
+
+	router.OnClose(func() {
+		r.removeRouter(router)
+	})
 }
 
-// Transports returns transports in this session
-func (r *Session) Transports() map[string]Transport {
+// removeRouter removes the track of a closed router from the transports
+// subscribed to it
+func (r *Session) removeRouter(router *Router) {
+	r.mu.Lock()
+	var peers []*WebRTCTransport
+	for _, t := range r.transports {
+		if p, ok := t.(*WebRTCTransport); ok {
+			peers = append(peers, p)
+		}
+	}
+	removed := false
+	if participant, ok := r.participants[router.tid]; ok {
+		removed = participant.removeTrack(router.Track().ID())
+	}
+	r.mu.Unlock()
+
+	for _, p := range peers {
+		p.removeTrack(router.Track().ID())
+	}
+
+	if removed {
+		r.emitTrack(EventTrackUnpublished, router)
+	}
+}
+
+// emitTrack notifies the participants of a track published or unpublished
+// by the participant of its router
+func (r *Session) emitTrack(typ string, router *Router) {
+	r.mu.RLock()
+	participant, ok := r.participants[router.tid]
+	var p Participant
+	if ok {
+		p = participant.copy()
+	}
+	r.mu.RUnlock()
+
+	if ok {
+		r.emit(router.tid, SessionEvent{Type: typ, Participant: p, Track: router.Track().ID()})
+	}
+}
+
+// relayData sends a data channel message to the channels with the same label
+// of the other transports
+func (r *Session) relayData(from, label string, msg webrtc.DataChannelMessage) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for tid, t := range r.transports {
+		if tid == from {
+			continue
+		}
+		if p, ok := t.(*WebRTCTransport); ok {
+			if dc := p.dataChannel(label); dc != nil {
+				dc.send(msg)
+			}
+		}
+	}
+}
+
+// StartHLS serves the session's h264 and opus routers over hls
+func (r *Session) StartHLS(cfg HLSConfig) *HLSStream {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.hls != nil {
+		return r.hls
+	}
+
+	r.hls = newHLSStream(r, cfg)
+	for _, t := range r.transports {
+		for _, router := range t.Routers() {
+			r.hls.attach(router)
+		}
+	}
+	return r.hls
+}
+
+// StopHLS stops serving the session over hls
+func (r *Session) StopHLS() {
+	r.mu.Lock()
+	hls := r.hls
+	r.hls = nil
+	r.mu.Unlock()
+
+	if hls != nil {
+		hls.Close()
+	}
+}
+
+// HLS returns the hls stream of the session if it is started
+func (r *Session) HLS() *HLSStream {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return r.transports
+	return r.hls
 }
 
-// OnClose called when session is closed
-func (r *Session) OnClose(f func()) {
-	r.onCloseHandler = f
+// GetTransport returns transport with id
+func (r *Session) GetTransport(tid string) Transport {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.transports[tid]
 }
 
-func (r *Session) stats() string {
-	info := fmt.Sprintf("\nsession: %s\n", r.id)
+// GetRouter returns the router publishing the track with id
+func (r *Session) GetRouter(trackID string) *Router {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, t := range r.transports {
+		for _, router := range t.Routers() {
+			if router.Track().ID() == trackID {
+				return router
+			}
+		}
+	}
+	return nil
+}
 
+// Transports returns transports in this session
+func (r *Session) Transports() map[string]Transport {
 	r.mu.RLock()
-	for _, transport := range r.transports {
-		info += transport.stats()
+	defer r.mu.RUnlock()
+	// transports join and leave while the copy is used
+	transports := make(map[string]Transport, len(r.transports))
+	for id, t := range r.transports {
+		transports[id] = t
 	}
-	r.mu.RUnlock()
+	return transports
+}
+
+// close runs the close handler once
+func (r *Session) close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	f := r.onCloseHandler
+	r.mu.Unlock()
 
-	return info
+	if f != nil {
+		f()
+	}
+}
+
+// OnClose called when session is closed
+func (r *Session) OnClose(f func()) {
+	r.onCloseHandler = f
 }
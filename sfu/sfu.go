@@ -1,17 +1,25 @@
 package sfu
 
 import (
+	"net"
 	"sync"
 	"time"
 
 	"github.com/pion/webrtc/v2"
-	"github.com/sirupsen/logrus"
 )
 
 type SFU struct {
 	webrtc   WebRTCTransportConfig
 	mu       sync.RWMutex
 	sessions map[string]*Session
+	egresses map[string]*plainRTPEgress
+	bans     map[string]map[string]time.Time
+	timeline *timelineStore
+}
+
+type plainRTPEgress struct {
+	router *Router
+	sender *PlainRTPSender
 }
 
 func NewSFU(c Config) *SFU {
@@ -24,9 +32,17 @@ func NewSFU(c Config) *SFU {
 	s := &SFU{
 		webrtc:   w,
 		sessions: make(map[string]*Session),
+		egresses: make(map[string]*plainRTPEgress),
+		bans:     make(map[string]map[string]time.Time),
 	}
 
 	config = c
+	if config.DataChannel.MaxMessageSize == 0 {
+		config.DataChannel.MaxMessageSize = defaultMaxMessageSize
+	}
+	if config.DataChannel.MaxBufferedAmount == 0 {
+		config.DataChannel.MaxBufferedAmount = defaultMaxBufferedAmount
+	}
 
 	var icePortStart, icePortEnd uint16
 
@@ -47,7 +63,14 @@ func NewSFU(c Config) *SFU {
 		},
 	}
 
-	go s.stats()
+	if c.Timeline.SampleCycle > 0 {
+		s.timeline = newTimelineStore(c.Timeline)
+		go s.sampleLoop(time.Duration(c.Timeline.SampleCycle) * time.Second)
+	}
+
+	if c.Quality.Cycle > 0 {
+		go s.qualityLoop(time.Duration(c.Quality.Cycle) * time.Second)
+	}
 
 	return s
 }
@@ -55,10 +78,12 @@ func NewSFU(c Config) *SFU {
 // NewSession creates a new session instance
 func (s *SFU) newSession(id string) *Session {
 	session := NewSession(id)
+	session.timeline = s.timeline
 	session.OnClose(func() {
 		s.mu.Lock()
 		delete(s.sessions, id)
 		s.mu.Unlock()
+		s.timeline.end(id)
 	})
 
 	s.mu.Lock()
@@ -68,7 +93,7 @@ func (s *SFU) newSession(id string) *Session {
 }
 
 // GetSession by id
-func (s *SFU) getSession(id string) *Session {
+func (s *SFU) GetSession(id string) *Session {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	return s.sessions[id]
@@ -76,13 +101,22 @@ func (s *SFU) getSession(id string) *Session {
 
 // NewWebRTCTransport creates a new WebRTCTransport that is a member of a session
 func (s *SFU) NewWebRTCTransport(sid string, offer webrtc.SessionDescription) (*WebRTCTransport, error) {
-	session := s.getSession(sid)
+	return s.NewWebRTCTransportWithOptions(sid, offer, WebRTCTransportOptions{})
+}
+
+// NewWebRTCTransportWithOptions creates a new WebRTCTransport with per transport options
+func (s *SFU) NewWebRTCTransportWithOptions(sid string, offer webrtc.SessionDescription, opts WebRTCTransportOptions) (*WebRTCTransport, error) {
+	if opts.Identity != "" && s.banned(sid, opts.Identity) {
+		return nil, ErrBanned
+	}
+
+	session := s.GetSession(sid)
 
 	if session == nil {
 		session = s.newSession(sid)
 	}
 
-	t, err := NewWebRTCTransport(session, offer, s.webrtc)
+	t, err := NewWebRTCTransport(session, offer, s.webrtc, opts)
 	if err != nil {
 		return nil, err
 	}
@@ -90,21 +124,136 @@ func (s *SFU) NewWebRTCTransport(sid string, offer webrtc.SessionDescription) (*
 	return t, nil
 }
 
-func (s *SFU) stats() {
-	t := time.NewTicker(statCycle)
-	for range t.C {
-		info := "\n----------------stats-----------------\n"
+// NewPlainRTPTransport creates a new PlainRTPTransport that publishes its tracks to a session
+func (s *SFU) NewPlainRTPTransport(sid string, cfg PlainRTPTransportConfig) (*PlainRTPTransport, error) {
+	session := s.GetSession(sid)
+
+	if session == nil {
+		session = s.newSession(sid)
+	}
+
+	return NewPlainRTPTransport(session, cfg)
+}
+
+// NewRTSPTransport creates a new RTSPTransport that pulls a camera into a session
+func (s *SFU) NewRTSPTransport(sid string, cfg RTSPTransportConfig) (*RTSPTransport, error) {
+	session := s.GetSession(sid)
+
+	if session == nil {
+		session = s.newSession(sid)
+	}
+
+	return NewRTSPTransport(session, cfg)
+}
+
+// NewRelayTransport creates a new RelayTransport linking a session with the
+// session of the same id on another sfu instance
+func (s *SFU) NewRelayTransport(sid string, cfg RelayTransportConfig) (*RelayTransport, error) {
+	session := s.GetSession(sid)
+
+	if session == nil {
+		session = s.newSession(sid)
+	}
+
+	return NewRelayTransport(session, cfg)
+}
+
+// NewPlainRTPEgress forwards the router of a track in a session to an external host as plain rtp.
+// The egress is removed when the router closes.
+func (s *SFU) NewPlainRTPEgress(sid, trackID string, cfg PlainRTPSenderConfig) (*PlainRTPSender, error) {
+	session := s.GetSession(sid)
+	if session == nil {
+		return nil, ErrSessionNotFound
+	}
+
+	router := session.GetRouter(trackID)
+	if router == nil {
+		return nil, ErrRouterNotFound
+	}
+
+	sender, err := NewPlainRTPSender(router.Track(), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.egresses[sender.ID()] = &plainRTPEgress{router: router, sender: sender}
+	s.mu.Unlock()
+
+	sender.OnClose(func() {
+		s.mu.Lock()
+		delete(s.egresses, sender.ID())
+		s.mu.Unlock()
+	})
+
+	router.AddSender(sender.ID(), sender)
+
+	return sender, nil
+}
+
+// GetPlainRTPEgress by id
+func (s *SFU) GetPlainRTPEgress(id string) *PlainRTPSender {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e, ok := s.egresses[id]; ok {
+		return e.sender
+	}
+	return nil
+}
+
+// ClosePlainRTPEgress stops forwarding a plain rtp egress
+func (s *SFU) ClosePlainRTPEgress(id string) bool {
+	s.mu.RLock()
+	e, ok := s.egresses[id]
+	s.mu.RUnlock()
+	if !ok {
+		return false
+	}
 
-		s.mu.RLock()
-		if len(s.sessions) == 0 {
-			s.mu.RUnlock()
-			continue
+	e.router.RemoveSender(id)
+	return true
+}
+
+// StartHLS serves the h264 and opus routers of a session over hls
+func (s *SFU) StartHLS(sid string, cfg HLSConfig) (*HLSStream, error) {
+	session := s.GetSession(sid)
+	if session == nil {
+		return nil, ErrSessionNotFound
+	}
+	return session.StartHLS(cfg), nil
+}
+
+// StopHLS stops serving a session over hls
+func (s *SFU) StopHLS(sid string) error {
+	session := s.GetSession(sid)
+	if session == nil {
+		return ErrSessionNotFound
+	}
+	session.StopHLS()
+	return nil
+}
+
+// ServeRTMP accepts rtmp publishers on a listener, each publishing to the session
+// its stream key maps to. It blocks until the listener fails.
+func (s *SFU) ServeRTMP(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
 		}
+		go s.serveRTMP(conn)
+	}
+}
 
-		for _, session := range s.sessions {
-			info += session.stats()
+// ServeRTSP serves session tracks to rtsp clients accepted on a listener,
+// authorize checks the token a client gives for a session, all are served
+// when nil. It blocks until the listener fails.
+func (s *SFU) ServeRTSP(l net.Listener, authorize func(sid, token string) bool) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
 		}
-		s.mu.RUnlock()
-		logrus.Infof(info)
+		go s.serveRTSP(conn, authorize)
 	}
 }
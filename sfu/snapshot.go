@@ -0,0 +1,205 @@
+package sfu
+
+import "sort"
+
+// SessionSnapshot is a read-only view of a session
+type SessionSnapshot struct {
+	ID           string              `json:"id"`
+	Participants int                 `json:"participants"`
+	Tracks       int                 `json:"tracks"`
+	HLS          bool                `json:"hls"`
+	Transports   []TransportSnapshot `json:"transports,omitempty"`
+}
+
+// TransportSnapshot is a read-only view of a transport and its routers
+type TransportSnapshot struct {
+	ID          string           `json:"id"`
+	Kind        string           `json:"kind"`
+	Participant *Participant     `json:"participant,omitempty"`
+	Routers     []RouterSnapshot `json:"routers"`
+	// webrtc transports only
+	ConnectionState    string   `json:"connectionState,omitempty"`
+	ICEConnectionState string   `json:"iceConnectionState,omitempty"`
+	SignalingState     string   `json:"signalingState,omitempty"`
+	Subscriptions      []string `json:"subscriptions,omitempty"`
+	DataChannels       []string `json:"dataChannels,omitempty"`
+}
+
+// RouterSnapshot is a read-only view of a router and its senders
+type RouterSnapshot struct {
+	TrackID     string           `json:"trackId"`
+	Label       string           `json:"label"`
+	Kind        string           `json:"kind"`
+	Codec       string           `json:"codec"`
+	SSRC        uint32           `json:"ssrc"`
+	PayloadType uint8            `json:"payloadType"`
+	Muted       bool             `json:"muted"`
+	Senders     []SenderSnapshot `json:"senders"`
+}
+
+// SenderSnapshot is a read-only view of a sender attached to a router
+type SenderSnapshot struct {
+	// ID of the subscribed transport or egress
+	ID     string `json:"id"`
+	Kind   string `json:"kind"`
+	Paused bool   `json:"paused,omitempty"`
+}
+
+// Snapshot lists the sessions with their participant and track counts
+func (s *SFU) Snapshot() []SessionSnapshot {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.RUnlock()
+
+	snapshots := make([]SessionSnapshot, 0, len(sessions))
+	for _, session := range sessions {
+		snapshot := session.Snapshot()
+		snapshot.Transports = nil
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].ID < snapshots[j].ID
+	})
+	return snapshots
+}
+
+// Snapshot describes the session down to its routers and senders
+func (r *Session) Snapshot() SessionSnapshot {
+	r.mu.RLock()
+	transports := make([]Transport, 0, len(r.transports))
+	for _, t := range r.transports {
+		transports = append(transports, t)
+	}
+	participants := make(map[string]Participant, len(r.participants))
+	for tid, p := range r.participants {
+		participants[tid] = p.copy()
+	}
+	snapshot := SessionSnapshot{
+		ID:           r.id,
+		Participants: len(r.participants),
+		HLS:          r.hls != nil,
+	}
+	r.mu.RUnlock()
+
+	for _, t := range transports {
+		var ts TransportSnapshot
+		if p, ok := t.(*WebRTCTransport); ok {
+			ts = p.Snapshot()
+		} else {
+			ts = transportSnapshot(t)
+		}
+		if p, ok := participants[t.ID()]; ok {
+			ts.Participant = &p
+		}
+		snapshot.Tracks += len(ts.Routers)
+		snapshot.Transports = append(snapshot.Transports, ts)
+	}
+	sort.Slice(snapshot.Transports, func(i, j int) bool {
+		return snapshot.Transports[i].ID < snapshot.Transports[j].ID
+	})
+	return snapshot
+}
+
+// Snapshot describes the peer connection, its routers and subscriptions
+func (p *WebRTCTransport) Snapshot() TransportSnapshot {
+	snapshot := transportSnapshot(p)
+	snapshot.ConnectionState = p.pc.ConnectionState().String()
+	snapshot.ICEConnectionState = p.pc.ICEConnectionState().String()
+	snapshot.SignalingState = p.pc.SignalingState().String()
+
+	p.sendersMu.Lock()
+	for id := range p.senders {
+		snapshot.Subscriptions = append(snapshot.Subscriptions, id)
+	}
+	p.sendersMu.Unlock()
+	sort.Strings(snapshot.Subscriptions)
+
+	p.mu.RLock()
+	for label := range p.dataChannels {
+		snapshot.DataChannels = append(snapshot.DataChannels, label)
+	}
+	p.mu.RUnlock()
+	sort.Strings(snapshot.DataChannels)
+
+	return snapshot
+}
+
+func transportSnapshot(t Transport) TransportSnapshot {
+	snapshot := TransportSnapshot{
+		ID:      t.ID(),
+		Kind:    transportKind(t),
+		Routers: []RouterSnapshot{},
+	}
+
+	for _, router := range t.Routers() {
+		snapshot.Routers = append(snapshot.Routers, router.snapshot())
+	}
+	sort.Slice(snapshot.Routers, func(i, j int) bool {
+		return snapshot.Routers[i].TrackID < snapshot.Routers[j].TrackID
+	})
+	return snapshot
+}
+
+func (r *Router) snapshot() RouterSnapshot {
+	track := r.Track()
+	snapshot := RouterSnapshot{
+		TrackID:     track.ID(),
+		Label:       track.Label(),
+		Kind:        track.Kind().String(),
+		Codec:       track.Codec().Name,
+		SSRC:        track.SSRC(),
+		PayloadType: track.PayloadType(),
+		Senders:     []SenderSnapshot{},
+	}
+
+	r.mu.RLock()
+	snapshot.Muted = r.muter.muted
+	for pid, sender := range r.senders {
+		s := SenderSnapshot{ID: pid, Kind: senderKind(sender)}
+		if ws, ok := sender.(*WebRTCSender); ok {
+			s.Paused = ws.Paused()
+		}
+		snapshot.Senders = append(snapshot.Senders, s)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(snapshot.Senders, func(i, j int) bool {
+		return snapshot.Senders[i].ID < snapshot.Senders[j].ID
+	})
+	return snapshot
+}
+
+func transportKind(t Transport) string {
+	switch t.(type) {
+	case *WebRTCTransport:
+		return "webrtc"
+	case *PlainRTPTransport:
+		return "plainrtp"
+	case *RTMPTransport:
+		return "rtmp"
+	case *RTSPTransport:
+		return "rtsp"
+	case *RelayTransport:
+		return "relay"
+	}
+	return "unknown"
+}
+
+func senderKind(s Sender) string {
+	switch s.(type) {
+	case *WebRTCSender:
+		return "webrtc"
+	case *PlainRTPSender:
+		return "plainrtp"
+	case *HLSSender:
+		return "hls"
+	case *RTSPSender:
+		return "rtsp"
+	case *RelaySender:
+		return "relay"
+	}
+	return "unknown"
+}
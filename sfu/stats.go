@@ -0,0 +1,395 @@
+package sfu
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// bitrates are averaged over at least this long
+	bitrateWindow = time.Second
+)
+
+// SessionStats of the transports of a session
+type SessionStats struct {
+	ID         string           `json:"id"`
+	Transports []TransportStats `json:"transports"`
+}
+
+// TransportStats of the tracks a transport publishes
+type TransportStats struct {
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// Remote address of ingests and relays
+	Remote string `json:"remote,omitempty"`
+	// Port plain rtp is received on
+	Port    int           `json:"port,omitempty"`
+	Routers []RouterStats `json:"routers"`
+	// Client stats last reported by webrtc participants
+	Client *ClientStats `json:"client,omitempty"`
+}
+
+// RouterStats of a track, received from its publisher and sent to its subscribers
+type RouterStats struct {
+	TrackID string `json:"trackId"`
+	Kind    string `json:"kind"`
+	SSRC    uint32 `json:"ssrc"`
+	Muted   bool   `json:"muted"`
+	// NACKsServed are packets nacked by subscribers resent from the buffer
+	NACKsServed uint64        `json:"nacksServed"`
+	Receiver    ReceiverStats `json:"receiver"`
+	Senders     []SenderStats `json:"senders"`
+}
+
+// ReceiverStats of a track received from its publisher, bitrates are in bits
+// per second and jitter in milliseconds
+type ReceiverStats struct {
+	PayloadType uint8   `json:"payloadType"`
+	Packets     uint64  `json:"packets"`
+	Bytes       uint64  `json:"bytes"`
+	Bitrate     uint64  `json:"bitrate"`
+	PacketsLost uint64  `json:"packetsLost"`
+	Loss        float64 `json:"loss"`
+	Jitter      float64 `json:"jitter"`
+	// feedback sent to the publisher
+	NACKsSent  uint64       `json:"nacksSent"`
+	PLIsSent   uint64       `json:"plisSent"`
+	REMBTarget uint64       `json:"rembTarget,omitempty"`
+	Buffer     *BufferStats `json:"buffer,omitempty"`
+	// RecentLoss and Bandwidth received over the last remb cycle, video only
+	RecentLoss float64 `json:"recentLoss,omitempty"`
+	Bandwidth  uint64  `json:"bandwidth,omitempty"`
+}
+
+// SenderStats of a track sent to a subscriber or egress, bitrates are in bits
+// per second
+type SenderStats struct {
+	// ID of the subscribed transport or egress
+	ID          string `json:"id"`
+	Kind        string `json:"kind"`
+	PayloadType uint8  `json:"payloadType"`
+	Packets     uint64 `json:"packets"`
+	Bytes       uint64 `json:"bytes"`
+	Bitrate     uint64 `json:"bitrate"`
+	// feedback received from the subscriber
+	NACKsReceived uint64 `json:"nacksReceived"`
+	PLIsReceived  uint64 `json:"plisReceived"`
+	REMBTarget    uint64 `json:"rembTarget,omitempty"`
+	Paused        bool   `json:"paused,omitempty"`
+	Destination   string `json:"destination,omitempty"`
+	Segments      int    `json:"segments,omitempty"`
+}
+
+// BufferStats of the range of sequence numbers kept to answer nacks
+type BufferStats struct {
+	FirstSN    uint16 `json:"firstSN"`
+	LastSN     uint16 `json:"lastSN"`
+	LastNackSN uint16 `json:"lastNackSN"`
+}
+
+// Stats of all sessions
+func (s *SFU) Stats() []SessionStats {
+	s.mu.RLock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	s.mu.RUnlock()
+
+	stats := make([]SessionStats, 0, len(sessions))
+	for _, session := range sessions {
+		stats = append(stats, session.Stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
+
+// LogStats logs the stats of all sessions every cycle, it never returns
+func (s *SFU) LogStats(cycle time.Duration) {
+	t := time.NewTicker(cycle)
+	defer t.Stop()
+	for range t.C {
+		stats := s.Stats()
+		if len(stats) == 0 {
+			continue
+		}
+		logrus.Info(formatStats(stats))
+	}
+}
+
+// Stats of the transports of the session
+func (r *Session) Stats() SessionStats {
+	r.mu.RLock()
+	transports := make([]Transport, 0, len(r.transports))
+	for _, t := range r.transports {
+		transports = append(transports, t)
+	}
+	r.mu.RUnlock()
+
+	stats := SessionStats{ID: r.id, Transports: make([]TransportStats, 0, len(transports))}
+	for _, t := range transports {
+		stats.Transports = append(stats.Transports, t.stats())
+	}
+	sort.Slice(stats.Transports, func(i, j int) bool {
+		return stats.Transports[i].ID < stats.Transports[j].ID
+	})
+	return stats
+}
+
+// routerStats of the routers of a transport
+func routerStats(routers map[uint32]*Router) []RouterStats {
+	stats := make([]RouterStats, 0, len(routers))
+	for _, router := range routers {
+		stats = append(stats, router.stats())
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].TrackID < stats[j].TrackID
+	})
+	return stats
+}
+
+// formatStats renders stats for the log
+func formatStats(sessions []SessionStats) string {
+	var b strings.Builder
+	b.WriteString("\n----------------stats-----------------\n")
+	for _, session := range sessions {
+		fmt.Fprintf(&b, "\nsession: %s\n", session.ID)
+		for _, t := range session.Transports {
+			fmt.Fprintf(&b, "  %s: %s", t.Kind, t.ID)
+			if t.Remote != "" {
+				fmt.Fprintf(&b, " remote: %s", t.Remote)
+			}
+			if t.Port != 0 {
+				fmt.Fprintf(&b, " port: %d", t.Port)
+			}
+			b.WriteString("\n")
+
+			for _, router := range t.Routers {
+				recv := router.Receiver
+				fmt.Fprintf(&b, "    track router id: %s ssrc: %d | payload: %d | %dkbps | lost: %d (%.2f) | jitter: %.1fms | nacks: %d | plis: %d",
+					router.TrackID, router.SSRC, recv.PayloadType, recv.Bitrate/1000, recv.PacketsLost, recv.Loss, recv.Jitter, recv.NACKsSent, recv.PLIsSent)
+				if recv.Buffer != nil {
+					fmt.Fprintf(&b, " | buffer: [%d, %d] | lastNackSN: %d", recv.Buffer.FirstSN, recv.Buffer.LastSN, recv.Buffer.LastNackSN)
+				}
+				b.WriteString("\n")
+
+				if len(router.Senders) < 6 {
+					for _, sender := range router.Senders {
+						fmt.Fprintf(&b, "      sender: %s | %s | payload: %d | %dkbps | nacks: %d | plis: %d",
+							sender.ID, sender.Kind, sender.PayloadType, sender.Bitrate/1000, sender.NACKsReceived, sender.PLIsReceived)
+						if sender.REMBTarget != 0 {
+							fmt.Fprintf(&b, " | remb: %dkbps", sender.REMBTarget/1000)
+						}
+						if sender.Destination != "" {
+							fmt.Fprintf(&b, " | dest: %s", sender.Destination)
+						}
+						b.WriteString("\n")
+					}
+					b.WriteString("\n")
+				} else {
+					fmt.Fprintf(&b, "      senders: %d\n\n", len(router.Senders))
+				}
+			}
+		}
+	}
+	return b.String()
+}
+
+// rtpCounter counts the packets of a stream and samples its bitrate
+type rtpCounter struct {
+	mu           sync.Mutex
+	packets      uint64
+	bytes        uint64
+	sampledAt    time.Time
+	sampledBytes uint64
+	bitrate      uint64
+}
+
+// add counts a packet sent
+func (c *rtpCounter) add(pkt *rtp.Packet) {
+	size := uint64(pkt.MarshalSize())
+	c.mu.Lock()
+	c.packets++
+	c.bytes += size
+	c.mu.Unlock()
+
+	atomic.AddUint64(&counters.rtpPacketsOut, 1)
+	atomic.AddUint64(&counters.rtpBytesOut, size)
+}
+
+// sample returns the counts and the bitrate since the previous sample
+func (c *rtpCounter) sample() (packets, bytes, bitrate uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sampleLocked(time.Now())
+	return c.packets, c.bytes, c.bitrate
+}
+
+func (c *rtpCounter) sampleLocked(now time.Time) {
+	if c.sampledAt.IsZero() {
+		c.sampledAt, c.sampledBytes = now, c.bytes
+		return
+	}
+	if elapsed := now.Sub(c.sampledAt); elapsed >= bitrateWindow {
+		c.bitrate = uint64(float64(c.bytes-c.sampledBytes) * 8 / elapsed.Seconds())
+		c.sampledAt, c.sampledBytes = now, c.bytes
+	}
+}
+
+// receiveCounter also tracks the loss and interarrival jitter of a received
+// stream, RFC 3550 A.3 and A.8
+type receiveCounter struct {
+	rtpCounter
+	clockRate uint32
+	started   bool
+	epoch     time.Time
+	baseSN    uint16
+	maxSN     uint16
+	cycles    uint64
+	transit   uint32
+	jitter    float64
+}
+
+// push counts a packet received now
+func (c *receiveCounter) push(pkt *rtp.Packet) {
+	now := time.Now()
+	size := uint64(pkt.MarshalSize())
+	atomic.AddUint64(&counters.rtpPacketsIn, 1)
+	atomic.AddUint64(&counters.rtpBytesIn, size)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.packets++
+	c.bytes += size
+
+	if !c.started {
+		c.started = true
+		c.epoch = now
+		c.baseSN, c.maxSN = pkt.SequenceNumber, pkt.SequenceNumber
+		c.transit = -pkt.Timestamp
+		return
+	}
+
+	if delta := pkt.SequenceNumber - c.maxSN; delta != 0 && delta < 0x8000 {
+		if pkt.SequenceNumber < c.maxSN {
+			c.cycles += 1 << 16
+		}
+		c.maxSN = pkt.SequenceNumber
+	}
+
+	if c.clockRate == 0 {
+		return
+	}
+	arrival := uint32(now.Sub(c.epoch).Seconds() * float64(c.clockRate))
+	transit := arrival - pkt.Timestamp
+	d := float64(int32(transit - c.transit))
+	if d < 0 {
+		d = -d
+	}
+	c.transit = transit
+	c.jitter += (d - c.jitter) / 16
+}
+
+// receiveSample are the counts of a received stream
+type receiveSample struct {
+	packets, bytes, bitrate, lost uint64
+	loss, jitter                  float64
+}
+
+func (c *receiveCounter) sample() receiveSample {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sampleLocked(time.Now())
+
+	s := receiveSample{packets: c.packets, bytes: c.bytes, bitrate: c.bitrate}
+	if !c.started {
+		return s
+	}
+	expected := c.cycles + uint64(c.maxSN) - uint64(c.baseSN) + 1
+	if expected > c.packets {
+		s.lost = expected - c.packets
+		s.loss = float64(s.lost) / float64(expected)
+	}
+	if c.clockRate != 0 {
+		s.jitter = c.jitter / float64(c.clockRate) * 1000
+	}
+	return s
+}
+
+// stats of the receiver with its feedback
+func (c *receiveCounter) stats(pt uint8, fb *feedbackCounter) ReceiverStats {
+	s := c.sample()
+	nacks, plis, remb := fb.sample()
+	return ReceiverStats{
+		PayloadType: pt,
+		Packets:     s.packets,
+		Bytes:       s.bytes,
+		Bitrate:     s.bitrate,
+		PacketsLost: s.lost,
+		Loss:        s.loss,
+		Jitter:      s.jitter,
+		NACKsSent:   nacks,
+		PLIsSent:    plis,
+		REMBTarget:  remb,
+	}
+}
+
+// feedbackCounter counts the rtcp feedback of a stream, sent to a publisher
+// when out is set or received from a subscriber
+type feedbackCounter struct {
+	mu    sync.Mutex
+	out   bool
+	nacks uint64
+	plis  uint64
+	remb  uint64
+}
+
+func (f *feedbackCounter) add(pkt rtcp.Packet) {
+	if f.out {
+		atomic.AddUint64(&counters.rtcpOut, 1)
+	} else {
+		atomic.AddUint64(&counters.rtcpIn, 1)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch pkt := pkt.(type) {
+	case *rtcp.TransportLayerNack:
+		f.nacks++
+	case *rtcp.PictureLossIndication, *rtcp.FullIntraRequest:
+		f.plis++
+	case *rtcp.ReceiverEstimatedMaximumBitrate:
+		f.remb = pkt.Bitrate
+	}
+}
+
+func (f *feedbackCounter) sample() (nacks, plis, remb uint64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nacks, f.plis, f.remb
+}
+
+// senderStats of a sender with its counters
+func senderStats(pt uint8, c *rtpCounter, fb *feedbackCounter) SenderStats {
+	packets, bytes, bitrate := c.sample()
+	nacks, plis, remb := fb.sample()
+	return SenderStats{
+		PayloadType:   pt,
+		Packets:       packets,
+		Bytes:         bytes,
+		Bitrate:       bitrate,
+		NACKsReceived: nacks,
+		PLIsReceived:  plis,
+		REMBTarget:    remb,
+	}
+}
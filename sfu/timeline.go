@@ -0,0 +1,325 @@
+package sfu
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultTimelineMaxEntries  = 10000
+	defaultTimelineMaxSessions = 100
+)
+
+// Timeline entry types besides the session event types
+const (
+	// TimelineTrack samples a track received from its publisher
+	TimelineTrack = "track"
+	// TimelineSubscription samples a track sent to a subscriber or egress
+	TimelineSubscription = "subscription"
+	// TimelineKeyframeRequest counts keyframes requested from a publisher since the previous sample
+	TimelineKeyframeRequest = "keyframeRequest"
+	// TimelineSessionEnded marks the end of a session
+	TimelineSessionEnded = "sessionEnded"
+)
+
+// TimelineConfig defines the stats history kept for each session
+type TimelineConfig struct {
+	// SampleCycle in seconds stats are sampled at, no timeline is kept when 0
+	SampleCycle int `mapstructure:"samplecycle"`
+	// MaxEntries kept per session, the oldest are dropped first
+	MaxEntries int `mapstructure:"maxentries"`
+	// MaxSessions ended sessions are kept in memory
+	MaxSessions int `mapstructure:"maxsessions"`
+	// File entries are appended to as json lines, not persisted when empty
+	File string `mapstructure:"file"`
+}
+
+// TimelineEntry is a stats sample or an event of a session, bitrates are in
+// bits per second and jitter in milliseconds
+type TimelineEntry struct {
+	Time    time.Time `json:"time"`
+	Session string    `json:"session"`
+	Type    string    `json:"type"`
+	// Participant the entry is about, the subscriber of subscription samples
+	Participant string  `json:"participant,omitempty"`
+	Identity    string  `json:"identity,omitempty"`
+	Track       string  `json:"track,omitempty"`
+	Bitrate     uint64  `json:"bitrate,omitempty"`
+	PacketsLost uint64  `json:"packetsLost,omitempty"`
+	Loss        float64 `json:"loss,omitempty"`
+	Jitter      float64 `json:"jitter,omitempty"`
+	REMBTarget  uint64  `json:"rembTarget,omitempty"`
+	Keyframes   uint64  `json:"keyframes,omitempty"`
+	// Quality score of connectionQuality events
+	Quality int `json:"quality,omitempty"`
+}
+
+// timeline of a session
+type timeline struct {
+	entries    []TimelineEntry
+	identities map[string]string
+	plis       map[string]uint64
+	ended      bool
+}
+
+// timelineStore keeps the timelines of live and recently ended sessions
+type timelineStore struct {
+	mu       sync.Mutex
+	cfg      TimelineConfig
+	sessions map[string]*timeline
+	ended    []string
+	file     *os.File
+	w        *bufio.Writer
+}
+
+func newTimelineStore(cfg TimelineConfig) *timelineStore {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultTimelineMaxEntries
+	}
+	if cfg.MaxSessions <= 0 {
+		cfg.MaxSessions = defaultTimelineMaxSessions
+	}
+
+	t := &timelineStore{
+		cfg:      cfg,
+		sessions: make(map[string]*timeline),
+	}
+
+	if cfg.File != "" {
+		f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			logrus.Errorf("timeline not persisted: %v", err)
+		} else {
+			t.file = f
+			t.w = bufio.NewWriter(f)
+		}
+	}
+	return t
+}
+
+// sampleLoop adds the stats of every session each cycle
+func (s *SFU) sampleLoop(cycle time.Duration) {
+	t := time.NewTicker(cycle)
+	defer t.Stop()
+	for range t.C {
+		s.mu.RLock()
+		sessions := make([]*Session, 0, len(s.sessions))
+		for _, session := range s.sessions {
+			sessions = append(sessions, session)
+		}
+		s.mu.RUnlock()
+
+		for _, session := range sessions {
+			s.timeline.sample(session.Stats())
+		}
+		s.timeline.flush()
+	}
+}
+
+// Timeline returns the entries of a session, only those about a participant
+// when given by transport id or identity. Sessions no longer kept in memory are
+// read back from the timeline file.
+func (s *SFU) Timeline(sid, participant string) ([]TimelineEntry, error) {
+	if s.timeline == nil {
+		return nil, ErrTimelineNotFound
+	}
+	return s.timeline.query(sid, participant)
+}
+
+func (t *timelineStore) query(sid, participant string) ([]TimelineEntry, error) {
+	match := func(e TimelineEntry) bool {
+		return participant == "" || e.Participant == participant || e.Identity == participant
+	}
+
+	t.mu.Lock()
+	tl, ok := t.sessions[sid]
+	var entries []TimelineEntry
+	if ok {
+		entries = make([]TimelineEntry, 0, len(tl.entries))
+		for _, e := range tl.entries {
+			if match(e) {
+				entries = append(entries, e)
+			}
+		}
+	}
+	if t.w != nil {
+		_ = t.w.Flush()
+	}
+	t.mu.Unlock()
+
+	if ok {
+		return entries, nil
+	}
+	if t.file == nil {
+		return nil, ErrTimelineNotFound
+	}
+
+	f, err := os.Open(t.cfg.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e TimelineEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		if e.Session == sid && match(e) {
+			entries = append(entries, e)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if entries == nil {
+		return nil, ErrTimelineNotFound
+	}
+	return entries, nil
+}
+
+// event adds a session event
+func (t *timelineStore) event(sid string, event SessionEvent) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tl := t.session(sid)
+	if event.Participant.ID != "" {
+		tl.identities[event.Participant.ID] = event.Participant.Identity
+	}
+	e := TimelineEntry{
+		Type:        event.Type,
+		Participant: event.Participant.ID,
+		Track:       event.Track,
+	}
+	if event.Quality != nil {
+		e.Quality = event.Quality.Score
+	}
+	t.add(sid, tl, e)
+}
+
+// sample adds the stats of a session
+func (t *timelineStore) sample(stats SessionStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tl, ok := t.sessions[stats.ID]; ok && tl.ended {
+		// sampled while ending
+		return
+	}
+	tl := t.session(stats.ID)
+
+	for _, transport := range stats.Transports {
+		for _, router := range transport.Routers {
+			recv := router.Receiver
+			t.add(stats.ID, tl, TimelineEntry{
+				Type:        TimelineTrack,
+				Participant: transport.ID,
+				Track:       router.TrackID,
+				Bitrate:     recv.Bitrate,
+				PacketsLost: recv.PacketsLost,
+				Loss:        recv.Loss,
+				Jitter:      recv.Jitter,
+				REMBTarget:  recv.REMBTarget,
+			})
+
+			if last := tl.plis[router.TrackID]; recv.PLIsSent > last {
+				t.add(stats.ID, tl, TimelineEntry{
+					Type:        TimelineKeyframeRequest,
+					Participant: transport.ID,
+					Track:       router.TrackID,
+					Keyframes:   recv.PLIsSent - last,
+				})
+			}
+			tl.plis[router.TrackID] = recv.PLIsSent
+
+			for _, sender := range router.Senders {
+				t.add(stats.ID, tl, TimelineEntry{
+					Type:        TimelineSubscription,
+					Participant: sender.ID,
+					Track:       router.TrackID,
+					Bitrate:     sender.Bitrate,
+					REMBTarget:  sender.REMBTarget,
+				})
+			}
+		}
+	}
+}
+
+// end marks a session ended, the oldest ended sessions are dropped
+func (t *timelineStore) end(sid string) {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tl := t.session(sid)
+	t.add(sid, tl, TimelineEntry{Type: TimelineSessionEnded})
+	tl.ended = true
+	t.ended = append(t.ended, sid)
+
+	for len(t.ended) > t.cfg.MaxSessions {
+		if old := t.sessions[t.ended[0]]; old != nil && old.ended {
+			delete(t.sessions, t.ended[0])
+		}
+		t.ended = t.ended[1:]
+	}
+	if t.w != nil {
+		_ = t.w.Flush()
+	}
+}
+
+func (t *timelineStore) flush() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.w != nil {
+		if err := t.w.Flush(); err != nil {
+			logrus.Errorf("timeline flush err: %v", err)
+		}
+	}
+}
+
+// session returns the timeline of a session, a session id reused after it
+// ended starts over
+func (t *timelineStore) session(sid string) *timeline {
+	tl, ok := t.sessions[sid]
+	if !ok || tl.ended {
+		tl = &timeline{
+			identities: make(map[string]string),
+			plis:       make(map[string]uint64),
+		}
+		t.sessions[sid] = tl
+	}
+	return tl
+}
+
+func (t *timelineStore) add(sid string, tl *timeline, e TimelineEntry) {
+	e.Time = time.Now()
+	e.Session = sid
+	if e.Participant != "" {
+		e.Identity = tl.identities[e.Participant]
+	}
+
+	if len(tl.entries) >= t.cfg.MaxEntries {
+		// drop a tenth at once rather than shifting on every entry
+		drop := len(tl.entries)/10 + 1
+		tl.entries = append(tl.entries[:0], tl.entries[drop:]...)
+	}
+	tl.entries = append(tl.entries, e)
+
+	if t.w != nil {
+		data, err := json.Marshal(e)
+		if err == nil {
+			_, _ = t.w.Write(append(data, '\n'))
+		}
+	}
+}
@@ -7,5 +7,11 @@ type Transport interface {
 	GetRouter(uint32) *Router
 	Routers() map[uint32]*Router
 	NewSender(track *webrtc.Track) (Sender, error)
-	stats() string
+	Close() error
+	stats() TransportStats
+}
+
+// subscriber is implemented by transports that only subscribe to some routers
+type subscriber interface {
+	subscribes(router *Router) bool
 }
@@ -1,26 +1,38 @@
 package sfu
 
 import (
-	"fmt"
+	"encoding/json"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/lucsky/cuid"
 	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v2"
 	"github.com/pion/webrtc/v2"
 	"github.com/sirupsen/logrus"
 )
 
-const (
-	statCycle = 6 * time.Second
-)
-
 // WebRTCTransportConfig represents configuration options
 type WebRTCTransportConfig struct {
 	configuration webrtc.Configuration
 	setting       webrtc.SettingEngine
 }
 
+// WebRTCTransportOptions represents per transport options
+type WebRTCTransportOptions struct {
+	// Subscribe decides which routers of the session the transport is subscribed to,
+	// all routers are subscribed when nil. Tracks may still be subscribed explicitly.
+	Subscribe func(*Router) bool
+	// Identity of the participant in the session roster, the transport id when empty
+	Identity string
+	// Metadata of the participant in the session roster
+	Metadata json.RawMessage
+	// Role of the participant in the session, presenter when empty
+	Role Role
+}
+
 // WebRTCTransport represents a sfu peer connection
 type WebRTCTransport struct {
 	id                         string
@@ -30,12 +42,31 @@ type WebRTCTransport struct {
 	stop                       bool
 	session                    *Session
 	routers                    map[uint32]*Router
+	subscribe                  func(*Router) bool
+	identity                   string
+	metadata                   json.RawMessage
+	role                       Role
+	pending                    []pendingTrack
+	clientStats                *ClientStats
+	dataChannels               map[string]*dataChannel
+	sendersMu                  sync.Mutex
+	senders                    map[string]*webrtc.RTPSender
 	onNegotiationNeededHandler func()
 	onTrackHandler             func(*webrtc.Track, *webrtc.RTPReceiver)
+	onTrackRemovedHandler      func(string)
+	onSessionEventHandler      func(SessionEvent)
+	onKickHandler              func(string)
 }
 
 // NewWebRTCTransport creates a new WebRTCTransport
-func NewWebRTCTransport(session *Session, offer webrtc.SessionDescription, cfg WebRTCTransportConfig) (*WebRTCTransport, error) {
+func NewWebRTCTransport(session *Session, offer webrtc.SessionDescription, cfg WebRTCTransportConfig, opts WebRTCTransportOptions) (*WebRTCTransport, error) {
+	if opts.Role == "" {
+		opts.Role = RolePresenter
+	}
+	if !opts.Role.Valid() {
+		return nil, ErrRoleInvalid
+	}
+
 	// We make our own mediaEngine so we can place the sender's codecs in it.  This because we must use the
 	// dynamic media type from the sender in our answer. This is not required if we are the offerer
 	me := MediaEngine{}
@@ -52,11 +83,17 @@ func NewWebRTCTransport(session *Session, offer webrtc.SessionDescription, cfg W
 	}
 
 	p := &WebRTCTransport{
-		id:      cuid.New(),
-		pc:      pc,
-		me:      me,
-		session: session,
-		routers: make(map[uint32]*Router),
+		id:           cuid.New(),
+		pc:           pc,
+		me:           me,
+		session:      session,
+		routers:      make(map[uint32]*Router),
+		subscribe:    opts.Subscribe,
+		identity:     opts.Identity,
+		metadata:     opts.Metadata,
+		role:         opts.Role,
+		dataChannels: make(map[string]*dataChannel),
+		senders:      make(map[string]*webrtc.RTPSender),
 	}
 
 	session.AddTransport(p)
@@ -65,6 +102,9 @@ func NewWebRTCTransport(session *Session, offer webrtc.SessionDescription, cfg W
 	for _, t := range session.Transports() {
 		logrus.Infof("transport %s", t.ID())
 		for _, router := range t.Routers() {
+			if !p.subscribes(router) {
+				continue
+			}
 			sender, err := p.NewSender(router.Track())
 			logrus.Infof("Init add router ssrc %d to %s", router.Track().SSRC(), p.id)
 			if err != nil {
@@ -77,34 +117,49 @@ func NewWebRTCTransport(session *Session, offer webrtc.SessionDescription, cfg W
 
 	pc.OnTrack(func(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
 		logrus.Debugf("Peer %s got remote track id: %s ssrc: %d", p.id, track.ID(), track.SSRC())
-		var recv Receiver
-		switch track.Kind() {
-		case webrtc.RTPCodecTypeVideo:
-			recv = NewWebRTCVideoReceiver(config.Receiver.Video, track)
-		case webrtc.RTPCodecTypeAudio:
-			recv = NewWebRTCAudioReceiver(track)
-		}
-
-		if recv.Track().Kind() == webrtc.RTPCodecTypeVideo {
-			go p.sendRTCP(recv)
-		}
-
-		router := NewRouter(p.id, recv)
-		logrus.Debugf("Created router %s %d", p.id, recv.Track().SSRC())
-
-		p.session.AddRouter(router)
 
 		p.mu.Lock()
-		p.routers[recv.Track().SSRC()] = router
-
-		if p.onTrackHandler != nil {
-			p.onTrackHandler(track, receiver)
+		if !p.role.CanPublish() {
+			logrus.Infof("Peer %s is a %s, holding track %s until promoted", p.id, p.role, track.ID())
+			p.pending = append(p.pending, pendingTrack{track: track, receiver: receiver})
+			p.mu.Unlock()
+			return
 		}
 		p.mu.Unlock()
+
+		p.publish(track, receiver)
+	})
+
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		label := dc.Label()
+		logrus.Debugf("Peer %s got data channel %s", p.id, label)
+
+		d := newDataChannel(dc)
+		dc.OnOpen(func() {
+			p.mu.Lock()
+			p.dataChannels[label] = d
+			p.mu.Unlock()
+		})
+		dc.OnClose(func() {
+			p.mu.Lock()
+			if p.dataChannels[label] == d {
+				delete(p.dataChannels, label)
+			}
+			p.mu.Unlock()
+			d.close()
+		})
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			if len(msg.Data) > config.DataChannel.MaxMessageSize {
+				logrus.Debugf("Peer %s data channel %s message too large: %d", p.id, label, len(msg.Data))
+				return
+			}
+			p.session.relayData(p.id, label, msg)
+		})
 	})
 
 	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		logrus.Debugf("ice connection state: %s", connectionState)
+		countICEState(connectionState)
 		switch connectionState {
 		case webrtc.ICEConnectionStateDisconnected:
 			logrus.Debugf("webrtc ice disconnected for peer: %s", p.id)
@@ -119,6 +174,78 @@ func NewWebRTCTransport(session *Session, offer webrtc.SessionDescription, cfg W
 	return p, nil
 }
 
+// pendingTrack is a track offered by a peer not allowed to publish
+type pendingTrack struct {
+	track    *webrtc.Track
+	receiver *webrtc.RTPReceiver
+}
+
+// publish routes a track of the peer to the session
+func (p *WebRTCTransport) publish(track *webrtc.Track, receiver *webrtc.RTPReceiver) {
+	var recv Receiver
+	switch track.Kind() {
+	case webrtc.RTPCodecTypeVideo:
+		recv = NewWebRTCVideoReceiver(config.Receiver.Video, track)
+	case webrtc.RTPCodecTypeAudio:
+		recv = NewWebRTCAudioReceiver(track)
+	}
+
+	if recv.Track().Kind() == webrtc.RTPCodecTypeVideo {
+		go p.sendRTCP(recv)
+	}
+
+	router := NewRouter(p.id, recv)
+	logrus.Debugf("Created router %s %d", p.id, recv.Track().SSRC())
+
+	p.session.AddRouter(router)
+
+	p.mu.Lock()
+	p.routers[recv.Track().SSRC()] = router
+
+	if p.onTrackHandler != nil && receiver != nil {
+		p.onTrackHandler(track, receiver)
+	}
+	p.mu.Unlock()
+}
+
+// Role of the peer in the session
+func (p *WebRTCTransport) Role() Role {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.role
+}
+
+// setRole changes the role of the peer. Held tracks are published once it may
+// publish, its tracks are unpublished and held once it may not.
+func (p *WebRTCTransport) setRole(role Role) {
+	p.mu.Lock()
+	p.role = role
+	var pending []pendingTrack
+	var demoted []*Router
+	if role.CanPublish() {
+		pending = p.pending
+		p.pending = nil
+	} else {
+		for ssrc, router := range p.routers {
+			delete(p.routers, ssrc)
+			demoted = append(demoted, router)
+			p.pending = append(p.pending, pendingTrack{track: router.Track()})
+		}
+	}
+	p.mu.Unlock()
+
+	for _, t := range pending {
+		p.publish(t.track, t.receiver)
+	}
+	for _, router := range demoted {
+		router.Close()
+	}
+
+	if len(pending) > 0 || len(demoted) > 0 {
+		p.negotiate()
+	}
+}
+
 // CreateOffer generates the localDescription
 func (p *WebRTCTransport) CreateOffer() (webrtc.SessionDescription, error) {
 	offer, err := p.pc.CreateOffer(nil)
@@ -154,15 +281,31 @@ func (p *WebRTCTransport) CreateAnswer() (webrtc.SessionDescription, error) {
 
 // SetRemoteDescription sets the SessionDescription of the remote peer
 func (p *WebRTCTransport) SetRemoteDescription(desc webrtc.SessionDescription) error {
+	if current := p.pc.RemoteDescription(); current != nil && iceUfrag(desc.SDP) != iceUfrag(current.SDP) {
+		return ErrICERestartNotSupported
+	}
+
 	err := p.pc.SetRemoteDescription(desc)
 	if err != nil {
 		logrus.Errorf("SetRemoteDescription error: %v", err)
 		return err
 	}
 
+	p.pruneRouters(desc)
+
 	return nil
 }
 
+// LocalDescription returns the local SessionDescription including gathered candidates
+func (p *WebRTCTransport) LocalDescription() *webrtc.SessionDescription {
+	return p.pc.LocalDescription()
+}
+
+// RemoteDescription returns the SessionDescription of the remote peer
+func (p *WebRTCTransport) RemoteDescription() *webrtc.SessionDescription {
+	return p.pc.RemoteDescription()
+}
+
 // AddICECandidate to peer connection
 func (p *WebRTCTransport) AddICECandidate(candidate webrtc.ICECandidateInit) error {
 	return p.pc.AddICECandidate(candidate)
@@ -190,11 +333,50 @@ func (p *WebRTCTransport) OnTrack(f func(*webrtc.Track, *webrtc.RTPReceiver)) {
 	p.onTrackHandler = f
 }
 
+// OnTrackRemoved handler, called with the id of a subscribed track once its
+// publisher stopped it
+func (p *WebRTCTransport) OnTrackRemoved(f func(string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onTrackRemovedHandler = f
+}
+
+// OnSessionEvent handler, called when other participants of the session
+// join, leave, publish or unpublish tracks or update their metadata
+func (p *WebRTCTransport) OnSessionEvent(f func(SessionEvent)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onSessionEventHandler = f
+}
+
+// OnKick handler, called with the reason before the peer is closed by a moderator
+func (p *WebRTCTransport) OnKick(f func(string)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onKickHandler = f
+}
+
+func (p *WebRTCTransport) kicked(reason string) {
+	p.mu.RLock()
+	f := p.onKickHandler
+	p.mu.RUnlock()
+	if f != nil {
+		f(reason)
+	}
+}
+
 // OnConnectionStateChange handler
 func (p *WebRTCTransport) OnConnectionStateChange(f func(webrtc.PeerConnectionState)) {
 	p.pc.OnConnectionStateChange(f)
 }
 
+// dataChannel returns the open data channel with label
+func (p *WebRTCTransport) dataChannel(label string) *dataChannel {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.dataChannels[label]
+}
+
 // NewSender for peer
 func (p *WebRTCTransport) NewSender(intrack *webrtc.Track) (Sender, error) {
 	to := p.me.GetCodecsByName(intrack.Codec().Name)
@@ -221,22 +403,261 @@ func (p *WebRTCTransport) NewSender(intrack *webrtc.Track) (Sender, error) {
 		return nil, err
 	}
 
+	p.sendersMu.Lock()
+	p.senders[intrack.ID()] = s
+	p.sendersMu.Unlock()
+
 	// Create webrtc sender for the peer we are sending track to
 	sender := NewWebRTCSender(outtrack, s)
 
 	return sender, nil
 }
 
+// Subscribe attaches the transport to the routers publishing the tracks and
+// renegotiates to send them. Tracks already subscribed are skipped.
+func (p *WebRTCTransport) Subscribe(trackIDs []string) error {
+	var routers []*Router
+	for _, id := range trackIDs {
+		router := p.session.GetRouter(id)
+		if router == nil {
+			return ErrRouterNotFound
+		}
+		routers = append(routers, router)
+	}
+
+	added := false
+	for _, router := range routers {
+		if router.tid == p.id || p.subscribed(router.Track().ID()) {
+			continue
+		}
+
+		sender, err := p.NewSender(router.Track())
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Subscribe router ssrc %d to %s", router.Track().SSRC(), p.id)
+		router.AddSender(p.id, sender)
+		added = true
+	}
+
+	if added {
+		p.negotiate()
+	}
+	return nil
+}
+
+// Unsubscribe detaches the transport from the routers of the tracks and
+// renegotiates to stop sending them. Tracks not subscribed are skipped.
+func (p *WebRTCTransport) Unsubscribe(trackIDs []string) error {
+	removed := false
+	for _, id := range trackIDs {
+		if !p.subscribed(id) {
+			continue
+		}
+
+		if router := p.session.GetRouter(id); router != nil {
+			router.RemoveSender(p.id)
+		}
+
+		logrus.Infof("Unsubscribe track %s from %s", id, p.id)
+		ok, err := p.removeSender(id)
+		if err != nil {
+			return err
+		}
+		removed = removed || ok
+	}
+
+	if removed {
+		p.negotiate()
+	}
+	return nil
+}
+
+func (p *WebRTCTransport) sessionEvent(event SessionEvent) {
+	p.mu.RLock()
+	f := p.onSessionEventHandler
+	p.mu.RUnlock()
+	if f != nil {
+		f(event)
+	}
+}
+
+// SetTrackMuted mutes or unmutes a track published by the peer
+func (p *WebRTCTransport) SetTrackMuted(trackID string, muted bool) error {
+	router := p.session.GetRouter(trackID)
+	if router == nil || router.tid != p.id {
+		return ErrRouterNotFound
+	}
+	return p.session.SetTrackMuted(trackID, muted)
+}
+
+// SetTrackPaused pauses or resumes sending a subscribed track to the peer,
+// other subscribers keep receiving it
+func (p *WebRTCTransport) SetTrackPaused(trackID string, paused bool) error {
+	router := p.session.GetRouter(trackID)
+	if router == nil {
+		return ErrRouterNotFound
+	}
+
+	sender, ok := router.sender(p.id).(*WebRTCSender)
+	if !ok {
+		return ErrNotSubscribed
+	}
+	sender.SetPaused(paused)
+	return nil
+}
+
+// removeTrack stops sending a track whose router was closed
+func (p *WebRTCTransport) removeTrack(trackID string) {
+	removed, err := p.removeSender(trackID)
+	if err != nil {
+		logrus.Debugf("Error removing track %s from %s: %v", trackID, p.id, err)
+	}
+	if !removed {
+		return
+	}
+
+	p.negotiate()
+
+	p.mu.RLock()
+	f := p.onTrackRemovedHandler
+	p.mu.RUnlock()
+	if f != nil {
+		f(trackID)
+	}
+}
+
+// removeSender removes the rtp sender of a track from the peer connection
+func (p *WebRTCTransport) removeSender(trackID string) (bool, error) {
+	p.sendersMu.Lock()
+	s, ok := p.senders[trackID]
+	delete(p.senders, trackID)
+	p.sendersMu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, p.pc.RemoveTrack(s)
+}
+
+// iceUfrag returns the ice username fragment of a session description, given
+// at the session or the media level
+func iceUfrag(desc string) string {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc)); err != nil {
+		return ""
+	}
+	if ufrag, ok := parsed.Attribute("ice-ufrag"); ok {
+		return ufrag
+	}
+	for _, md := range parsed.MediaDescriptions {
+		if ufrag, ok := md.Attribute("ice-ufrag"); ok {
+			return ufrag
+		}
+	}
+	return ""
+}
+
+// pruneRouters closes the routers of tracks the peer stopped sending in a
+// renegotiation, their m-lines are rejected, inactive, recvonly or removed
+func (p *WebRTCTransport) pruneRouters(desc webrtc.SessionDescription) {
+	parsed := sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(desc.SDP)); err != nil {
+		return
+	}
+
+	sending := make(map[uint32]bool)
+	for _, md := range parsed.MediaDescriptions {
+		if md.MediaName.Port.Value == 0 {
+			continue
+		}
+		if _, ok := md.Attribute(webrtc.RTPTransceiverDirectionRecvonly.String()); ok {
+			continue
+		}
+		if _, ok := md.Attribute(webrtc.RTPTransceiverDirectionInactive.String()); ok {
+			continue
+		}
+		for _, a := range md.Attributes {
+			if a.Key != "ssrc" {
+				continue
+			}
+			fields := strings.Fields(a.Value)
+			if len(fields) == 0 {
+				continue
+			}
+			if ssrc, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				sending[uint32(ssrc)] = true
+			}
+		}
+	}
+
+	p.mu.Lock()
+	var closed []*Router
+	for ssrc, router := range p.routers {
+		if !sending[ssrc] {
+			delete(p.routers, ssrc)
+			closed = append(closed, router)
+		}
+	}
+	pending := p.pending[:0]
+	for _, t := range p.pending {
+		if sending[t.track.SSRC()] {
+			pending = append(pending, t)
+		}
+	}
+	p.pending = pending
+	p.mu.Unlock()
+
+	for _, router := range closed {
+		logrus.Infof("Peer %s stopped track %s", p.id, router.Track().ID())
+		router.Close()
+	}
+}
+
+// subscribed reports whether the transport sends the track with id
+func (p *WebRTCTransport) subscribed(trackID string) bool {
+	p.sendersMu.Lock()
+	defer p.sendersMu.Unlock()
+	_, ok := p.senders[trackID]
+	return ok
+}
+
+// negotiate asks the peer to renegotiate after tracks were added or removed
+func (p *WebRTCTransport) negotiate() {
+	p.mu.RLock()
+	f := p.onNegotiationNeededHandler
+	p.mu.RUnlock()
+
+	if f != nil {
+		f()
+	}
+}
+
+// subscribes reports whether the transport should be subscribed to router
+func (p *WebRTCTransport) subscribes(router *Router) bool {
+	return p.subscribe == nil || p.subscribe(router)
+}
+
 // ID of peer
 func (p *WebRTCTransport) ID() string {
 	return p.id
 }
 
+// Session the peer is a member of
+func (p *WebRTCTransport) Session() *Session {
+	return p.session
+}
+
 // Routers returns routers for this peer
 func (p *WebRTCTransport) Routers() map[uint32]*Router {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-	return p.routers
+	// routers are pruned on renegotiation and when the role is demoted
+	routers := make(map[uint32]*Router, len(p.routers))
+	for ssrc, router := range p.routers {
+		routers[ssrc] = router
+	}
+	return routers
 }
 
 // GetRouter returns router with ssrc
@@ -246,21 +667,33 @@ func (p *WebRTCTransport) GetRouter(ssrc uint32) *Router {
 	return p.routers[ssrc]
 }
 
+// Closed reports whether the peer was closed
+func (p *WebRTCTransport) Closed() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.stop
+}
+
 // Close peer
 func (p *WebRTCTransport) Close() error {
 	p.mu.Lock()
-	defer p.mu.Unlock()
-
 	if p.stop {
+		p.mu.Unlock()
 		return nil
 	}
-
+	p.stop = true
+	routers := make([]*Router, 0, len(p.routers))
 	for _, router := range p.routers {
+		routers = append(routers, router)
+	}
+	p.mu.Unlock()
+
+	// routers notify the other peers when closed, which must not wait on this peer
+	for _, router := range routers {
 		router.Close()
 	}
 
 	p.session.RemoveTransport(p.id)
-	p.stop = true
 	return p.pc.Close()
 }
 
@@ -287,16 +720,10 @@ func (p *WebRTCTransport) sendRTCP(recv Receiver) {
 	}
 }
 
-func (p *WebRTCTransport) stats() string {
+func (p *WebRTCTransport) stats() TransportStats {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
-
-	info := fmt.Sprintf("  peer: %s\n", p.id)
-	for _, router := range p.routers {
-		info += router.stats()
-	}
-
-	return info
+	return TransportStats{ID: p.id, Kind: transportKind(p), Routers: routerStats(p.routers), Client: p.clientStats}
 }
 
 type debouncer struct {